@@ -209,9 +209,14 @@ func handlePostMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 		return
 	}
 
+	// Verify passwords before taking applyMu, since hashing is slow.
+	credentials := ircServer.VerifyCredentials(req.Data)
+
 	applyMu.Lock()
 	msg := ircServer.NewRobustMessage(types.RobustIRCFromClient, session, req.Data)
 	msg.ClientMessageId = req.ClientMessageId
+	msg.Credentials = credentials
+	msg.CredentialsVerified = true
 	msgbytes, err := json.Marshal(msg)
 	if err != nil {
 		applyMu.Unlock()
@@ -417,8 +422,15 @@ func handleGetMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 		// Id=1431542836610113945.
 		// Hence, we need to Get(1431542836610113945.2) to send
 		// 1431542836610113945.3 and following to the client.
-		if msgs, ok := ircServer.Get(lastSeen); ok && int(lastSeen.Reply) < len(msgs) {
-			msgschan <- msgs[lastSeen.Reply:]
+		// Note that messages can share a Reply id when they are variants of
+		// the same message with different IRCv3 tags.
+		if msgs, ok := ircServer.Get(lastSeen); ok {
+			for idx, msg := range msgs {
+				if msg.Id.Reply > lastSeen.Reply {
+					msgschan <- msgs[idx:]
+					break
+				}
+			}
 		}
 
 		for {
@@ -463,6 +475,18 @@ func handleGetMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 					continue
 				}
 
+				if msg.History {
+					// CHATHISTORY responses are answered from the
+					// outputstream of this server, see ExpandHistory.
+					for _, m := range ircServer.ExpandHistory(session, msg) {
+						if err := enc.Encode(m); err != nil {
+							log.Printf("Error encoding JSON: %v\n", err)
+							return
+						}
+					}
+					continue
+				}
+
 				if err := enc.Encode(msg); err != nil {
 					log.Printf("Error encoding JSON: %v\n", err)
 					return
@@ -661,9 +685,13 @@ func handlePostConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var unused config.Network
 	var body bytes.Buffer
-	if _, err := toml.DecodeReader(io.TeeReader(r.Body, &body), &unused); err != nil {
+	if _, err := body.ReadFrom(r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg, err := config.FromString(body.String())
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -682,4 +710,10 @@ func handlePostConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+
+	// Warn only here instead of in config.FromString, which runs whenever a
+	// configuration is applied, including when replaying the raft log.
+	for _, warning := range config.PlaintextPasswordWarnings(cfg) {
+		log.Printf("Warning: %s\n", warning)
+	}
 }
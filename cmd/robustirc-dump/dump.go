@@ -14,6 +14,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 	"github.com/hashicorp/raft"
 	"github.com/robustirc/robustirc/types"
 	"github.com/robustirc/robustirc/util"
+	"github.com/sorcix/irc"
 	"github.com/syndtr/goleveldb/leveldb"
 	leveldb_errors "github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/opt"
@@ -44,8 +46,57 @@ var (
 
 	lastId       int64
 	lastModified = time.Now()
+
+	// redacted contains the ids of the messages whose output was retracted
+	// using REDACT, see collectRedactions.
+	redacted = make(map[int64]bool)
 )
 
+// decodeSnapshot decodes the base64-encoded snapshot of a RobustState message.
+func decodeSnapshot(data string) (*pb.Snapshot, error) {
+	state, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode robuststate: %v", err)
+	}
+	var snapshot pb.Snapshot
+	if err := proto.Unmarshal(state, &snapshot); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal proto: %v", err)
+	}
+	return &snapshot, nil
+}
+
+// collectRedactions adds the ids of the messages whose output |rlog| retracts
+// to |redacted|. REDACT commands are not validated, so messages are also
+// considered redacted when the REDACT command failed.
+func collectRedactions(rlog *raft.Log) {
+	if rlog.Type != raft.LogCommand {
+		return
+	}
+	rmsg := types.NewRobustMessageFromBytes(rlog.Data)
+	switch rmsg.Type {
+	case types.RobustIRCFromClient:
+		_, data := types.SplitTags(rmsg.Data)
+		ircmsg := irc.ParseMessage(data)
+		if ircmsg == nil || strings.ToUpper(ircmsg.Command) != "REDACT" || len(ircmsg.Params) < 2 {
+			return
+		}
+		// The output message ids have the form <input message id>.<reply>.
+		parts := strings.Split(ircmsg.Params[1], ".")
+		if id, err := strconv.ParseInt(parts[0], 10, 64); err == nil {
+			redacted[id] = true
+		}
+	case types.RobustState:
+		snapshot, err := decodeSnapshot(rmsg.Data)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		for _, id := range snapshot.Redacted {
+			redacted[id.Id] = true
+		}
+	}
+}
+
 func dumpLog(key uint64, rlog *raft.Log) {
 	if rlog.Type != raft.LogCommand {
 		// TODO: hexdump
@@ -56,20 +107,20 @@ func dumpLog(key uint64, rlog *raft.Log) {
 	unfilteredMsg := types.NewRobustMessageFromBytes(rlog.Data)
 	rmsg := &unfilteredMsg
 	if rmsg.Type == types.RobustIRCFromClient {
-		rmsg = util.PrivacyFilterMsg(rmsg)
+		if redacted[rmsg.Id.Id] {
+			// Neither the text nor the tags of retracted messages are
+			// dumped.
+			rmsg.Data = "<redacted>"
+		} else {
+			rmsg = util.PrivacyFilterMsg(rmsg)
+		}
 	} else if rmsg.Type == types.RobustState {
-		state, err := base64.StdEncoding.DecodeString(rmsg.Data)
+		decoded, err := decodeSnapshot(rmsg.Data)
 		if err != nil {
-			log.Printf("Could not decode robuststate: %v", err)
+			log.Print(err)
 			return
 		}
-
-		var snapshot pb.Snapshot
-		if err := proto.Unmarshal(state, &snapshot); err != nil {
-			log.Printf("Could not unmarshal proto: %v", err)
-			return
-		}
-		snapshot = util.PrivacyFilterSnapshot(snapshot)
+		snapshot := util.PrivacyFilterSnapshot(*decoded)
 		var marshaler proto.TextMarshaler
 		rmsg.Data = marshaler.Text(&snapshot)
 	}
@@ -122,6 +173,18 @@ func dumpLeveldb(path string) error {
 			i.Prev()
 		}
 	}
+
+	// Redactions may refer to any earlier message, so they need to be known
+	// before dumping.
+	for ok := i.First(); ok; ok = i.Next() {
+		if bytes.HasPrefix(i.Key(), []byte("stablestore-")) {
+			continue
+		}
+		if err := json.Unmarshal(i.Value(), &rlog); err != nil {
+			log.Fatalf("Corrupted database: %v\n", err)
+		}
+		collectRedactions(&rlog)
+	}
 	i.First()
 
 	fmt.Printf(fmt.Sprintf("%%%ds", padding)+"\tValue\n", "Key")
@@ -148,7 +211,19 @@ func dumpSnapshot(path string) error {
 	}
 	lastModified = fi.ModTime()
 	log.Printf("trying to dump %q as a snapshot\n", path)
-	f, err := os.Open(filepath.Join(path, "state.bin"))
+	// Redactions may refer to any earlier message, so they need to be known
+	// before dumping.
+	if err := decodeLogs(filepath.Join(path, "state.bin"), collectRedactions); err != nil {
+		return err
+	}
+	return decodeLogs(filepath.Join(path, "state.bin"), func(rlog *raft.Log) {
+		dumpLog(0, rlog)
+	})
+}
+
+// decodeLogs calls |fn| for each raft log entry in the file |path|.
+func decodeLogs(path string, fn func(rlog *raft.Log)) error {
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
@@ -163,7 +238,7 @@ func dumpSnapshot(path string) error {
 			return err
 		}
 
-		dumpLog(0, &rlog)
+		fn(&rlog)
 	}
 }
 
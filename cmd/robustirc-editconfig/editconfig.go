@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"io"
@@ -9,9 +10,12 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 
+	"github.com/robustirc/robustirc/config"
 	"github.com/robustirc/robustirc/robusthttp"
 	"github.com/robustirc/robustirc/util"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
@@ -22,8 +26,42 @@ var (
 	networkPassword = flag.String("network_password",
 		"",
 		"A secure password to protect the communication between raft nodes. Use pwgen(1) or similar.")
+
+	hashPassword = flag.Bool("hash_password",
+		false,
+		"Read a password from stdin, print its hash for use as IRC.Operators.Password or IRC.Services.Password and exit.")
 )
 
+// printPasswordHash reads a password from stdin and prints its hash, so that
+// it can be pasted into the configuration instead of the plaintext password.
+func printPasswordHash() error {
+	var password string
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintf(os.Stderr, "Password: ")
+		b, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		password = string(b)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
+	hash, err := config.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
+
 // getConfig obtains the RobustIRC network configuration from |server| and
 // returns the TOML configuration as a string and its revision identifier
 // (string) or an error.
@@ -76,8 +114,15 @@ func postConfig(server string, revision string, config io.Reader) error {
 func main() {
 	flag.Parse()
 
+	if *hashPassword {
+		if err := printPasswordHash(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	servers := util.ResolveNetwork(*network)
-	config, revision, err := getConfig(servers[0])
+	current, revision, err := getConfig(servers[0])
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -87,7 +132,7 @@ func main() {
 		log.Fatal(err)
 	}
 	defer os.Remove(tmp.Name())
-	if _, err := tmp.Write(config); err != nil {
+	if _, err := tmp.Write(current); err != nil {
 		log.Fatal(err)
 	}
 
@@ -108,6 +153,16 @@ func main() {
 		return
 	}
 
+	edited, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Parsing the configuration logs a warning for plaintext passwords.
+	if _, err := config.FromString(string(edited)); err != nil {
+		log.Printf("Find your edited configuration in %q\n", tmp.Name())
+		log.Fatal(err)
+	}
+
 	if _, err := tmp.Seek(0, 0); err != nil {
 		log.Fatal(err)
 	}
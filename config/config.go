@@ -1,6 +1,9 @@
 package config
 
 import (
+	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -25,18 +28,276 @@ func (d Duration) String() string {
 }
 
 type IRCOp struct {
-	Name     string
+	Name string
+	// Password is a scrypt or bcrypt hash, see HashPassword. Plaintext
+	// passwords are still accepted, but deprecated.
 	Password string
+
+	// Class is the name of an OperatorClass which defines the privileges of
+	// this operator. Operators without a class are in DefaultOperatorClass.
+	Class string
+}
+
+// Operator privileges, see OperatorClass.
+const (
+	// PrivilegeKill allows disconnecting users using KILL.
+	PrivilegeKill = "kill"
+
+	// PrivilegeBan allows managing network-wide bans using KLINE, UNKLINE and
+	// STATS k.
+	PrivilegeBan = "ban"
+
+	// PrivilegeOverride allows changing channel modes without being a channel
+	// operator.
+	PrivilegeOverride = "override"
+
+	// PrivilegeSeeSecret allows seeing secret (+s) channels in LIST and WHOIS.
+	PrivilegeSeeSecret = "see-secret"
+
+	// PrivilegeWallops allows sending messages using WALLOPS and GLOBOPS.
+	PrivilegeWallops = "wallops"
+
+	// PrivilegeSnomask allows receiving server notices (user mode +s).
+	PrivilegeSnomask = "snomask"
+)
+
+// Privileges contains all operator privileges.
+var Privileges = []string{
+	PrivilegeKill,
+	PrivilegeBan,
+	PrivilegeOverride,
+	PrivilegeSeeSecret,
+	PrivilegeWallops,
+	PrivilegeSnomask,
+}
+
+// DefaultOperatorClass is the class of operators which do not specify one. A
+// class with this name can be configured, otherwise it has
+// DefaultPrivileges.
+const DefaultOperatorClass = "default"
+
+// DefaultPrivileges are the privileges of DefaultOperatorClass unless it is
+// configured. They are all privileges, so that operators which were
+// configured before operator classes existed keep their abilities. Configure
+// the default class to restrict them.
+var DefaultPrivileges = []string{
+	PrivilegeKill,
+	PrivilegeBan,
+	PrivilegeOverride,
+	PrivilegeSeeSecret,
+	PrivilegeWallops,
+	PrivilegeSnomask,
+}
+
+// OperatorClass is a named set of privileges, which allows handing out
+// limited rights, e.g. to volunteer moderators.
+type OperatorClass struct {
+	Name       string
+	Privileges []string
 }
 
 type Service struct {
+	// Password is a scrypt or bcrypt hash, see HashPassword. Plaintext
+	// passwords are still accepted, but deprecated.
 	Password string
 }
 
+// Admin is the administrative contact information, sent in response to ADMIN.
+type Admin struct {
+	// Name of the organization or person running the network.
+	Name string
+
+	// Location of the servers, e.g. “Zürich, Switzerland”.
+	Location string
+
+	// Email address under which the administrators can be reached.
+	Email string
+}
+
 // IRC is the IRC-related configuration.
 type IRC struct {
-	Operators []IRCOp
-	Services  []Service
+	Operators       []IRCOp
+	Services        []Service
+	OperatorClasses []OperatorClass
+}
+
+// Class returns the OperatorClass called |name|. The empty name refers to
+// DefaultOperatorClass.
+func (i IRC) Class(name string) (OperatorClass, bool) {
+	if name == "" {
+		name = DefaultOperatorClass
+	}
+	for _, class := range i.OperatorClasses {
+		if class.Name == name {
+			return class, true
+		}
+	}
+	if name == DefaultOperatorClass {
+		return OperatorClass{Name: DefaultOperatorClass, Privileges: DefaultPrivileges}, true
+	}
+	return OperatorClass{}, false
+}
+
+func validPrivilege(privilege string) bool {
+	for _, p := range Privileges {
+		if p == privilege {
+			return true
+		}
+	}
+	return false
+}
+
+// Case mappings, see Network.CaseMapping.
+const (
+	// CaseMappingASCII only considers the letters A-Z to be the upper case
+	// equivalents of a-z.
+	CaseMappingASCII = "ascii"
+
+	// CaseMappingRFC1459 additionally considers []\~ to be the upper case
+	// equivalents of {}|^, because of IRC’s scandinavian origin.
+	CaseMappingRFC1459 = "rfc1459"
+
+	// CaseMappingRFC7613 allows UTF-8 nicknames and channel names, which are
+	// compared using the PRECIS UsernameCaseMapped profile of RFC 7613.
+	CaseMappingRFC7613 = "rfc7613"
+)
+
+// Spam filter targets, see SpamFilter.Targets.
+const (
+	// SpamFilterChannel matches the text of PRIVMSGs and NOTICEs to channels.
+	SpamFilterChannel = "channel"
+
+	// SpamFilterPrivate matches the text of PRIVMSGs and NOTICEs to users.
+	SpamFilterPrivate = "private"
+
+	// SpamFilterQuit matches QUIT messages.
+	SpamFilterQuit = "quit"
+
+	// SpamFilterNick matches nicknames, both on login and when changing them.
+	SpamFilterNick = "nick"
+
+	// SpamFilterRealname matches realnames on login.
+	SpamFilterRealname = "realname"
+)
+
+// SpamFilterTargets contains all spam filter targets.
+var SpamFilterTargets = []string{
+	SpamFilterChannel,
+	SpamFilterPrivate,
+	SpamFilterQuit,
+	SpamFilterNick,
+	SpamFilterRealname,
+}
+
+// Spam filter actions, see SpamFilter.Action. IRC operators are notified
+// (snomask s) about every match, regardless of the action.
+const (
+	// SpamFilterBlock drops the message or refuses the nickname. Sessions
+	// whose realname matches cannot log in.
+	SpamFilterBlock = "block"
+
+	// SpamFilterKill disconnects the session.
+	SpamFilterKill = "kill"
+
+	// SpamFilterNotice only notifies IRC operators.
+	SpamFilterNotice = "notice"
+
+	// SpamFilterBan disconnects the session and adds a K-line for its
+	// nickname which expires after SpamFilter.BanDuration. Since session
+	// hosts are unique, the K-line cannot match the host, so reconnecting
+	// with a different nickname evades it.
+	SpamFilterBan = "ban"
+)
+
+// SpamFilterActions contains all spam filter actions.
+var SpamFilterActions = []string{
+	SpamFilterBlock,
+	SpamFilterKill,
+	SpamFilterNotice,
+	SpamFilterBan,
+}
+
+// SpamFilter is a rule which is applied to the text which clients send.
+// Messages from IRC operators and services are never filtered.
+type SpamFilter struct {
+	// Name identifies the rule in server notices and in the
+	// irc_spam_filter_matches metric.
+	Name string
+
+	// Pattern is a regular expression in RE2 syntax (see
+	// https://golang.org/s/re2syntax) or, if Glob is true, a glob pattern in
+	// which * matches any text and ? matches any character. Patterns are
+	// matched case-insensitively, glob patterns must match the entire text.
+	Pattern string
+	Glob    bool
+
+	// Targets lists the kinds of text which this rule applies to, see
+	// SpamFilterTargets.
+	Targets []string
+
+	// Action is one of SpamFilterActions.
+	Action string
+
+	// BanDuration is how long the K-line which SpamFilterBan adds is in
+	// effect. Defaults to one hour.
+	BanDuration Duration
+
+	// Reason is sent to the user whose text matched.
+	Reason string
+}
+
+// Expr returns the regular expression which f.Pattern corresponds to.
+func (f SpamFilter) Expr() string {
+	if !f.Glob {
+		return "(?i)" + f.Pattern
+	}
+	expr := regexp.QuoteMeta(f.Pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return "(?is)^" + expr + "$"
+}
+
+// AppliesTo returns true if f.Targets contains |target|.
+func (f SpamFilter) AppliesTo(target string) bool {
+	for _, t := range f.Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+func validSpamFilter(f SpamFilter) error {
+	if f.Name == "" {
+		return fmt.Errorf("spam filter %q: no Name", f.Pattern)
+	}
+	if _, err := regexp.Compile(f.Expr()); err != nil {
+		return fmt.Errorf("spam filter %q: %v", f.Name, err)
+	}
+	if len(f.Targets) == 0 {
+		return fmt.Errorf("spam filter %q: no Targets (known targets: %s)",
+			f.Name, strings.Join(SpamFilterTargets, ", "))
+	}
+	for _, target := range f.Targets {
+		if !contains(SpamFilterTargets, target) {
+			return fmt.Errorf("spam filter %q: unknown target %q (known targets: %s)",
+				f.Name, target, strings.Join(SpamFilterTargets, ", "))
+		}
+	}
+	if !contains(SpamFilterActions, f.Action) {
+		return fmt.Errorf("spam filter %q: unknown action %q (known actions: %s)",
+			f.Name, f.Action, strings.Join(SpamFilterActions, ", "))
+	}
+	return nil
+}
+
+func contains(list []string, entry string) bool {
+	for _, e := range list {
+		if e == entry {
+			return true
+		}
+	}
+	return false
 }
 
 // Network is the network configuration, i.e. the top level.
@@ -51,16 +312,81 @@ type Network struct {
 
 	// Enforced cooloff between two messages sent by a user. Set to 0 to disable throttling.
 	PostMessageCooloff Duration
+
+	// Maximum number of messages returned in response to a single CHATHISTORY
+	// request. Defaults to 100, set to 0 to disable CHATHISTORY.
+	ChatHistoryLimit int
+
+	// Short description of the network, sent as the first line of the MOTD.
+	NetworkDescription string
+
+	// Message of the day, sent to clients on login and in response to MOTD.
+	// Every line is sent as a separate message.
+	MOTD string
+
+	Admin Admin
+
+	// CaseMapping defines which nicknames and channel names are considered
+	// equal, one of CaseMappingASCII, CaseMappingRFC1459 or
+	// CaseMappingRFC7613. When unset, nicknames are compared like
+	// CaseMappingRFC1459 without ~ and ^ and channel names are lower-cased
+	// using Unicode rules, as before the case mapping became configurable.
+	// When changing the case mapping, sessions whose nickname collides with
+	// an older session’s nickname are renamed.
+	CaseMapping string
+
+	// ClientTagDeny lists the client-only message tags (without the leading
+	// “+”, e.g. “typing”) which clients may not send. “*” denies all tags,
+	// entries starting with “-” exempt a tag, e.g. ["*", "-typing"] only
+	// allows typing notifications. Sent to clients as CLIENTTAGDENY.
+	ClientTagDeny []string
+
+	// Maximum number of comma-separated targets in a single PRIVMSG, NOTICE
+	// or TAGMSG, sent to clients as TARGMAX. Values below 1 select the
+	// default of 4.
+	MaxTargets int
+
+	// SpamFilters are checked in order, the first matching rule applies.
+	SpamFilters []SpamFilter
 }
 
 var DefaultConfig = Network{
 	SessionExpiration:  Duration(30 * time.Minute),
 	PostMessageCooloff: Duration(500 * time.Millisecond),
+	ChatHistoryLimit:   100,
+	MaxTargets:         4,
 }
 
+// FromString parses |input| on top of DefaultConfig, so that options which
+// |input| does not specify keep their default value.
 func FromString(input string) (Network, error) {
-	var cfg Network
-	_, err := toml.Decode(input, &cfg)
-	// TODO(secure): Use scrypt to hash the ircop passwords to make brute-forcing harder.
-	return cfg, err
+	cfg := DefaultConfig
+	if _, err := toml.Decode(input, &cfg); err != nil {
+		return cfg, err
+	}
+	for _, class := range cfg.IRC.OperatorClasses {
+		for _, privilege := range class.Privileges {
+			if !validPrivilege(privilege) {
+				return cfg, fmt.Errorf("operator class %q: unknown privilege %q (known privileges: %s)",
+					class.Name, privilege, strings.Join(Privileges, ", "))
+			}
+		}
+	}
+	switch cfg.CaseMapping {
+	case "", CaseMappingASCII, CaseMappingRFC1459, CaseMappingRFC7613:
+	default:
+		return cfg, fmt.Errorf("unknown CaseMapping %q (known case mappings: %s, %s, %s)",
+			cfg.CaseMapping, CaseMappingASCII, CaseMappingRFC1459, CaseMappingRFC7613)
+	}
+	for _, filter := range cfg.SpamFilters {
+		if err := validSpamFilter(filter); err != nil {
+			return cfg, err
+		}
+	}
+	for _, op := range cfg.IRC.Operators {
+		if _, ok := cfg.IRC.Class(op.Class); op.Class != "" && !ok {
+			return cfg, fmt.Errorf("IRC operator %q: unknown operator class %q", op.Name, op.Class)
+		}
+	}
+	return cfg, nil
 }
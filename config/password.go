@@ -0,0 +1,106 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters for newly hashed passwords, as recommended by
+// https://godoc.org/golang.org/x/crypto/scrypt
+const (
+	scryptN      = 32768
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// scryptPrefix starts passwords hashed by HashPassword. The format is
+// “$scrypt$<N>$<r>$<p>$<base64 salt>$<base64 key>”.
+const scryptPrefix = "$scrypt$"
+
+// IsHashed returns true if |password| is a scrypt or bcrypt hash as opposed
+// to a (deprecated) plaintext password.
+func IsHashed(password string) bool {
+	return strings.HasPrefix(password, scryptPrefix) || isBcrypt(password)
+}
+
+// PlaintextPasswordWarnings returns a warning for each IRC operator and
+// service of |cfg| which uses a plaintext password.
+func PlaintextPasswordWarnings(cfg Network) []string {
+	var warnings []string
+	for _, op := range cfg.IRC.Operators {
+		if !IsHashed(op.Password) {
+			warnings = append(warnings, fmt.Sprintf("IRC operator %q uses a plaintext password, which is deprecated. Use robustirc-editconfig -hash_password to hash it.", op.Name))
+		}
+	}
+	for idx, service := range cfg.IRC.Services {
+		if !IsHashed(service.Password) {
+			warnings = append(warnings, fmt.Sprintf("service %d uses a plaintext password, which is deprecated. Use robustirc-editconfig -hash_password to hash it.", idx))
+		}
+	}
+	return warnings
+}
+
+func isBcrypt(password string) bool {
+	return strings.HasPrefix(password, "$2a$") ||
+		strings.HasPrefix(password, "$2b$") ||
+		strings.HasPrefix(password, "$2y$")
+}
+
+// HashPassword returns a scrypt hash of |password| which can be used in the
+// configuration instead of the plaintext password.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d$%d$%d$%s$%s", scryptPrefix, scryptN, scryptR, scryptP,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword returns true if |password| matches |configured|, which is
+// either a hash (see IsHashed) or a plaintext password.
+func VerifyPassword(configured, password string) bool {
+	if isBcrypt(configured) {
+		return bcrypt.CompareHashAndPassword([]byte(configured), []byte(password)) == nil
+	}
+	if !strings.HasPrefix(configured, scryptPrefix) {
+		return subtle.ConstantTimeCompare([]byte(configured), []byte(password)) == 1
+	}
+	parts := strings.Split(strings.TrimPrefix(configured, scryptPrefix), "$")
+	if len(parts) != 5 {
+		return false
+	}
+	var params [3]int
+	for idx := range params {
+		var err error
+		if params[idx], err = strconv.Atoi(parts[idx]); err != nil {
+			return false
+		}
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := scrypt.Key([]byte(password), salt, params[0], params[1], params[2], len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
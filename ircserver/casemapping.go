@@ -0,0 +1,284 @@
+package ircserver
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/secure/precis"
+
+	"github.com/robustirc/robustirc/config"
+	"github.com/robustirc/robustirc/types"
+	"github.com/sorcix/irc"
+)
+
+// caseMappingLegacy is the case mapping which RobustIRC used before the case
+// mapping became configurable: nicknames are compared following RFC2812 (i.e.
+// without ~ and ^), channel names using strings.ToLower. Networks which do not
+// set config.Network.CaseMapping keep using it, so that upgrading does not
+// rename any sessions or merge any channels.
+const caseMappingLegacy = "legacy"
+
+var (
+	rfc1459Replacer = strings.NewReplacer("[", "{", "]", "}", "\\", "|", "~", "^")
+	rfc2812Replacer = strings.NewReplacer("[", "{", "]", "}", "\\", "|")
+)
+
+// caseMappingOf returns the case mapping which |cfg| configures.
+func caseMappingOf(cfg config.Network) string {
+	if cfg.CaseMapping == "" {
+		return caseMappingLegacy
+	}
+	return cfg.CaseMapping
+}
+
+// isupportCaseMapping returns the CASEMAPPING ISUPPORT token value for
+// |mapping|. strict-rfc1459 is the closest standard value for the legacy case
+// mapping: it describes how nicknames are compared.
+func isupportCaseMapping(mapping string) string {
+	if mapping == caseMappingLegacy {
+		return "strict-rfc1459"
+	}
+	return mapping
+}
+
+func asciiToLower(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, name)
+}
+
+func toLower(mapping, name string) string {
+	switch mapping {
+	case config.CaseMappingASCII:
+		return asciiToLower(name)
+	case config.CaseMappingRFC7613:
+		lower, err := precis.UsernameCaseMapped.String(name)
+		if err != nil {
+			// Names which the PRECIS profile rejects (e.g. containing
+			// spaces) still need to be comparable.
+			return strings.ToLower(name)
+		}
+		return lower
+	case caseMappingLegacy:
+		return rfc2812Replacer.Replace(strings.ToLower(name))
+	default:
+		return rfc1459Replacer.Replace(asciiToLower(name))
+	}
+}
+
+// validUTF8NickRe additionally allows Unicode letters and numbers, for
+// networks which use CaseMappingRFC7613.
+var validUTF8NickRe = regexp.MustCompile(`^[\pL` + letter + special + `][\pL\pN` + letter + digit + special + `-]{0,` + maxNickLen + `}$`)
+
+// isValidNickname returns true if |nick| is valid according to RFC2812 or, if
+// the network uses CaseMappingRFC7613, a valid UTF-8 nickname.
+func (i *IRCServer) isValidNickname(nick string) bool {
+	if IsValidNickname(nick) {
+		return true
+	}
+	if i.caseMapping != config.CaseMappingRFC7613 || !validUTF8NickRe.MatchString(nick) {
+		return false
+	}
+	_, err := precis.UsernameCaseMapped.String(nick)
+	return err == nil
+}
+
+// NickToLower converts a nickname to lower case, following the case mapping
+// of the network, see config.Network.CaseMapping.
+func (i *IRCServer) NickToLower(nick string) lcNick {
+	return lcNick(toLower(i.caseMapping, nick))
+}
+
+// ChanToLower converts a channel to lower case, following the case mapping of
+// the network, see config.Network.CaseMapping.
+func (i *IRCServer) ChanToLower(channelname string) lcChan {
+	if i.caseMapping == caseMappingLegacy {
+		return lcChan(strings.ToLower(channelname))
+	}
+	return lcChan(toLower(i.caseMapping, channelname))
+}
+
+// UpdateCaseMapping switches to the case mapping configured in i.Config. It
+// must be called after i.Config was changed by the message with |id|. The
+// returned messages notify clients about nicknames and channels which collided
+// (see setCaseMapping) and need to be passed to SendMessages.
+func (i *IRCServer) UpdateCaseMapping(id types.RobustId) *Replyctx {
+	i.sessionsMu.Lock()
+	defer i.sessionsMu.Unlock()
+	reply := &Replyctx{msgid: id.Id}
+	i.setCaseMapping(caseMappingOf(i.Config), reply)
+	i.tagMessages(reply)
+	return reply
+}
+
+// setCaseMapping switches to |mapping|, re-keying all nicknames and channel
+// names. Collisions are resolved deterministically: the session which was
+// created first keeps its nickname, the others are renamed. Of colliding
+// channels, the one whose name sorts first is kept. The members of the others
+// are kicked, and their ban, ban exception and invite exception lists are
+// merged into the channel which is kept.
+//
+// The renames and kicks are sent as part of |reply|, so the case mapping must
+// only be switched when applying a configuration change (see
+// UpdateCaseMapping), never when restoring a snapshot.
+func (i *IRCServer) setCaseMapping(mapping string, reply *Replyctx) {
+	if mapping == i.caseMapping {
+		return
+	}
+	log.Printf("Switching case mapping from %q to %q\n", i.caseMapping, mapping)
+	i.caseMapping = mapping
+
+	oldNicks := i.nicks
+	oldChannels := i.channels
+
+	// Sort the sessions by id so that the session which was created first
+	// keeps its nickname.
+	sessions := make([]*Session, 0, len(oldNicks))
+	for _, s := range oldNicks {
+		sessions = append(sessions, s)
+	}
+	sort.Sort(sessionsById(sessions))
+	i.nicks = make(map[lcNick]*Session, len(sessions))
+	var renamed []*Session
+	oldPrefixes := make(map[*Session]irc.Prefix)
+	for _, s := range sessions {
+		if other, ok := i.nicks[i.NickToLower(s.Nick)]; ok {
+			newNick := i.collisionNick(s)
+			log.Printf("Nickname %q collides with %q, renaming to %q\n", s.Nick, other.Nick, newNick)
+			renamed = append(renamed, s)
+			oldPrefixes[s] = s.ircPrefix
+			s.Nick = newNick
+			s.updateIrcPrefix()
+		}
+		i.nicks[i.NickToLower(s.Nick)] = s
+	}
+
+	oldChannelKeys := make([]string, 0, len(oldChannels))
+	for key := range oldChannels {
+		oldChannelKeys = append(oldChannelKeys, string(key))
+	}
+	sort.Strings(oldChannelKeys)
+	i.channels = make(map[lcChan]*channel, len(oldChannels))
+	var dropped []*channel
+	for _, key := range oldChannelKeys {
+		c := oldChannels[lcChan(key)]
+		nicks := make(map[lcNick]*[maxChanMemberStatus]bool, len(c.nicks))
+		for oldNick, perms := range c.nicks {
+			if s, ok := oldNicks[oldNick]; ok {
+				nicks[i.NickToLower(s.Nick)] = perms
+			}
+		}
+		c.nicks = nicks
+		if existing, ok := i.channels[i.ChanToLower(c.name)]; ok {
+			log.Printf("Channel %q collides with %q, kicking its members\n", c.name, existing.name)
+			for _, mode := range []byte{'b', 'e', 'I'} {
+				list := existing.maskList(mode)
+				for _, entry := range *c.maskList(mode) {
+					if !i.maskListed(*list, entry.mask) {
+						*list = append(*list, entry)
+					}
+				}
+			}
+			dropped = append(dropped, c)
+			continue
+		}
+		i.channels[i.ChanToLower(c.name)] = c
+	}
+
+	rekeyChannels := func(old map[lcChan]bool) map[lcChan]bool {
+		result := make(map[lcChan]bool, len(old))
+		for key := range old {
+			name := string(key)
+			if c, ok := oldChannels[key]; ok {
+				name = c.name
+			}
+			result[i.ChanToLower(name)] = true
+		}
+		return result
+	}
+	for _, s := range i.sessions {
+		channels := rekeyChannels(s.Channels)
+		for key := range channels {
+			// Members of channels which were dropped are only in the
+			// channel which is kept if they were members of it before.
+			if c, ok := i.channels[key]; !ok || c.nicks[i.NickToLower(s.Nick)] == nil {
+				delete(channels, key)
+			}
+		}
+		s.Channels = channels
+		s.invitedTo = rekeyChannels(s.invitedTo)
+		monitored := make(map[lcNick]string, len(s.monitored))
+		for _, nick := range s.monitored {
+			monitored[i.NickToLower(nick)] = nick
+		}
+		s.monitored = monitored
+	}
+
+	svsholds := make(map[lcNick]svshold, len(i.svsholds))
+	for nick, hold := range i.svsholds {
+		svsholds[i.NickToLower(string(nick))] = hold
+	}
+	i.svsholds = svsholds
+
+	for _, s := range renamed {
+		oldPrefix := oldPrefixes[s]
+		i.sendServices(reply,
+			i.sendCommonChannels(s, reply,
+				i.sendUser(s, reply, &irc.Message{
+					Prefix:   &oldPrefix,
+					Command:  irc.NICK,
+					Trailing: s.Nick,
+				})))
+	}
+	for _, c := range dropped {
+		existing := i.channels[i.ChanToLower(c.name)]
+		nicks := make([]string, 0, len(c.nicks))
+		for nick := range c.nicks {
+			nicks = append(nicks, string(nick))
+		}
+		sort.Strings(nicks)
+		for _, nick := range nicks {
+			i.sendServices(reply,
+				i.sendChannel(c, reply, &irc.Message{
+					Prefix:   i.ServerPrefix,
+					Command:  irc.KICK,
+					Params:   []string{c.name, i.nicks[lcNick(nick)].Nick},
+					Trailing: fmt.Sprintf("Channel name collides with %s after changing the case mapping", existing.name),
+				}))
+			delete(c.nicks, lcNick(nick))
+		}
+	}
+}
+
+// maskListed returns true if |list| contains |mask|.
+func (i *IRCServer) maskListed(list []maskEntry, mask string) bool {
+	for _, entry := range list {
+		if i.NickToLower(entry.mask) == i.NickToLower(mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// collisionNick returns a nickname for |s| which is not yet in use.
+func (i *IRCServer) collisionNick(s *Session) string {
+	nick := fmt.Sprintf("Guest%d", s.Id.Id%100000)
+	for {
+		if _, ok := i.nicks[i.NickToLower(nick)]; !ok {
+			return nick
+		}
+		nick = nick + "_"
+	}
+}
+
+type sessionsById []*Session
+
+func (s sessionsById) Len() int           { return len(s) }
+func (s sessionsById) Swap(a, b int)      { s[a], s[b] = s[b], s[a] }
+func (s sessionsById) Less(a, b int) bool { return idLess(s[a].Id, s[b].Id) }
@@ -0,0 +1,263 @@
+package ircserver
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robustirc/robustirc/outputstream"
+	"github.com/robustirc/robustirc/types"
+	"github.com/sorcix/irc"
+)
+
+// historyMessage is a message which was previously sent and is replayed in
+// response to CHATHISTORY.
+type historyMessage struct {
+	id  types.RobustId
+	msg *irc.Message
+}
+
+// idLess returns true if |a| was sent before |b|.
+func idLess(a, b types.RobustId) bool {
+	return a.Id < b.Id || (a.Id == b.Id && a.Reply < b.Reply)
+}
+
+type robustIds []types.RobustId
+
+func (r robustIds) Len() int           { return len(r) }
+func (r robustIds) Swap(a, b int)      { r[a], r[b] = r[b], r[a] }
+func (r robustIds) Less(a, b int) bool { return idLess(r[a], r[b]) }
+
+// parseHistoryRef parses a CHATHISTORY message reference, which is either
+// “timestamp=2015-01-02T19:50:18.166Z” or “msgid=1420228218166687920.1”.
+func parseHistoryRef(ref string) (types.RobustId, bool) {
+	if strings.HasPrefix(ref, "timestamp=") {
+		t, err := time.Parse(time.RFC3339Nano, ref[len("timestamp="):])
+		if err != nil {
+			return types.RobustId{}, false
+		}
+		return types.RobustId{Id: t.UnixNano()}, true
+	}
+	if strings.HasPrefix(ref, "msgid=") {
+		parts := strings.Split(ref[len("msgid="):], ".")
+		if len(parts) != 2 {
+			return types.RobustId{}, false
+		}
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return types.RobustId{}, false
+		}
+		reply, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return types.RobustId{}, false
+		}
+		return types.RobustId{Id: id, Reply: reply}, true
+	}
+	return types.RobustId{}, false
+}
+
+// historyMatches returns the parsed message if |msg| is part of the
+// conversation with |target| (a channel or nickname) as seen by |s|.
+func (i *IRCServer) historyMatches(s *Session, target string, msg outputstream.Message) (*irc.Message, bool) {
+	if msg.Data == "" || i.redacted[msg.Id] {
+		return nil, false
+	}
+	_, data := types.SplitTags(msg.Data)
+	parsed := irc.ParseMessage(data)
+	if parsed == nil || parsed.Prefix == nil || len(parsed.Params) < 1 {
+		return nil, false
+	}
+	if parsed.Command != irc.PRIVMSG && parsed.Command != irc.NOTICE {
+		return nil, false
+	}
+	if strings.HasPrefix(target, "#") {
+		return parsed, i.ChanToLower(parsed.Params[0]) == i.ChanToLower(target)
+	}
+	if strings.HasPrefix(parsed.Params[0], "#") {
+		return nil, false
+	}
+	// The host part of the prefix contains the session id, so it identifies
+	// messages which |s| sent even when |s| changed nicknames since.
+	sent := parsed.Prefix.Host == s.ircPrefix.Host &&
+		i.NickToLower(parsed.Params[0]) == i.NickToLower(target)
+	received := msg.InterestingFor[s.Id.Id] &&
+		i.NickToLower(parsed.Prefix.Name) == i.NickToLower(target)
+	return parsed, sent || received
+}
+
+// chatHistory returns up to |limit| messages of the conversation with
+// |target| which were sent after |after| and before |before|, in chronological
+// order. If |latest| is true, the most recent messages within that interval
+// are returned, otherwise the oldest ones.
+//
+// The messages are taken from the outputstream, which contains the output of
+// all messages that were not yet compacted.
+func (i *IRCServer) chatHistory(s *Session, target string, after, before types.RobustId, limit int, latest bool) []historyMessage {
+	var result []historyMessage
+	if limit <= 0 {
+		return result
+	}
+	var lastId types.RobustId
+	i.output.Iterate(after.Id, before.Id, latest, func(msgs []outputstream.Message) bool {
+		for idx := range msgs {
+			msg := msgs[idx]
+			if latest {
+				msg = msgs[len(msgs)-1-idx]
+			}
+			if !idLess(after, msg.Id) || !idLess(msg.Id, before) {
+				continue
+			}
+			// Variants of the same message (see tagMessages) share an id.
+			if msg.Id == lastId {
+				continue
+			}
+			parsed, ok := i.historyMatches(s, target, msg)
+			if !ok {
+				continue
+			}
+			lastId = msg.Id
+			result = append(result, historyMessage{id: msg.Id, msg: parsed})
+			if len(result) >= limit {
+				return false
+			}
+		}
+		return true
+	})
+	if latest {
+		for l, r := 0, len(result)-1; l < r; l, r = l+1, r-1 {
+			result[l], result[r] = result[r], result[l]
+		}
+	}
+	return result
+}
+
+// historyQuery returns up to |n| messages of the conversation with |target|
+// which the CHATHISTORY |subcommand| with the message references |refs|
+// selects.
+func (i *IRCServer) historyQuery(s *Session, subcommand, target string, refs []types.RobustId, n int) []historyMessage {
+	switch subcommand {
+	case "LATEST":
+		return i.chatHistory(s, target, refs[0], maxRobustId, n, true)
+	case "BEFORE":
+		return i.chatHistory(s, target, types.RobustId{}, refs[0], n, true)
+	case "AFTER":
+		return i.chatHistory(s, target, refs[0], maxRobustId, n, false)
+	case "AROUND":
+		messages := i.chatHistory(s, target, types.RobustId{}, refs[0], n/2, true)
+		// Include the referenced message itself.
+		after := types.RobustId{Id: refs[0].Id, Reply: refs[0].Reply - 1}
+		return append(messages, i.chatHistory(s, target, after, maxRobustId, n-len(messages), false)...)
+	case "BETWEEN":
+		if idLess(refs[0], refs[1]) {
+			return i.chatHistory(s, target, refs[0], refs[1], n, false)
+		}
+		return i.chatHistory(s, target, refs[1], refs[0], n, true)
+	}
+	return nil
+}
+
+// ExpandHistory returns the messages which answer the CHATHISTORY request
+// that |msg| stands for, as sent to |session|. |msg| is a placeholder (see
+// types.RobustMessage.History) which cmdChathistory sends after validating the
+// request.
+//
+// The messages are taken from the outputstream of this server, which is not
+// part of the replicated state, so they must never end up in the output of
+// ProcessMessage. All of them share the id of |msg|, so that clients which
+// resume after |msg| do not receive them again.
+func (i *IRCServer) ExpandHistory(session types.RobustId, msg *types.RobustMessage) []*types.RobustMessage {
+	i.sessionsMu.RLock()
+	defer i.sessionsMu.RUnlock()
+
+	s, ok := i.sessions[session]
+	if !ok {
+		return nil
+	}
+	tags, data := types.SplitTags(msg.Data)
+	request := irc.ParseMessage(data)
+	if request == nil || len(request.Params) < 4 {
+		return nil
+	}
+	subcommand := request.Params[0]
+	target := request.Params[1]
+	var refs []types.RobustId
+	for _, param := range request.Params[2 : len(request.Params)-1] {
+		if param == "*" {
+			refs = append(refs, types.RobustId{})
+			continue
+		}
+		ref, ok := parseHistoryRef(param)
+		if !ok {
+			return nil
+		}
+		refs = append(refs, ref)
+	}
+	n, err := strconv.Atoi(request.Params[len(request.Params)-1])
+	if err != nil {
+		return nil
+	}
+	messages := i.historyQuery(s, subcommand, target, refs, n)
+
+	// labelMessages labeled the placeholder if the request carried a label.
+	var label string
+	for _, tag := range strings.Split(strings.TrimSpace(strings.TrimPrefix(tags, "@")), ";") {
+		if strings.HasPrefix(tag, "label=") {
+			label = tag
+		}
+	}
+
+	var result []*types.RobustMessage
+	send := func(tags string, m *irc.Message) {
+		data := string(m.Bytes())
+		if tags != "" {
+			data = "@" + tags + " " + data
+		}
+		result = append(result, &types.RobustMessage{
+			Id:             msg.Id,
+			Session:        msg.Session,
+			Type:           msg.Type,
+			Data:           data,
+			InterestingFor: map[int64]bool{session.Id: true},
+		})
+	}
+
+	batch := s.capabilities["batch"]
+	ref := batchRef(msg.Id)
+	if batch {
+		send(label, &irc.Message{
+			Prefix:  i.ServerPrefix,
+			Command: "BATCH",
+			Params:  []string{"+" + ref, "chathistory", target},
+		})
+		label = ""
+	} else if label != "" && len(messages) == 0 {
+		send(label, &irc.Message{
+			Prefix:  i.ServerPrefix,
+			Command: "ACK",
+		})
+	}
+	for _, m := range messages {
+		var tags []string
+		if batch {
+			tags = append(tags, "batch="+ref)
+		} else if label != "" && len(messages) == 1 {
+			tags = append(tags, label)
+		}
+		if t := messageTags(s, m.id, nil); t != "" {
+			tags = append(tags, t)
+		}
+		send(strings.Join(tags, ";"), m.msg)
+	}
+	if batch {
+		send("", &irc.Message{
+			Prefix:  i.ServerPrefix,
+			Command: "BATCH",
+			Params:  []string{"-" + ref},
+		})
+	}
+	return result
+}
+
+// maxRobustId is larger than any id of a message which was sent.
+var maxRobustId = types.RobustId{Id: math.MaxInt64}
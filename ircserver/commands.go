@@ -8,6 +8,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/robustirc/robustirc/config"
+	"github.com/robustirc/robustirc/types"
 	"github.com/sorcix/irc"
 )
 
@@ -36,6 +38,14 @@ func init() {
 		Func:      (*IRCServer).cmdUser,
 		MinParams: 3,
 	}
+	Commands["CAP"] = &ircCommand{
+		Func:      (*IRCServer).cmdCap,
+		MinParams: 1,
+	}
+	Commands["AUTHENTICATE"] = &ircCommand{
+		Func:      (*IRCServer).cmdAuthenticate,
+		MinParams: 1,
+	}
 	Commands["JOIN"] = &ircCommand{
 		Func:      (*IRCServer).cmdJoin,
 		MinParams: 1,
@@ -57,6 +67,13 @@ func init() {
 	Commands["NOTICE"] = &ircCommand{
 		Func: (*IRCServer).cmdPrivmsg,
 	}
+	Commands["TAGMSG"] = &ircCommand{
+		Func: (*IRCServer).cmdPrivmsg,
+	}
+	Commands["REDACT"] = &ircCommand{
+		Func:      (*IRCServer).cmdRedact,
+		MinParams: 2,
+	}
 	Commands["MODE"] = &ircCommand{
 		Func:      (*IRCServer).cmdMode,
 		MinParams: 1,
@@ -65,10 +82,33 @@ func init() {
 		Func: (*IRCServer).cmdWho,
 	}
 	Commands["OPER"] = &ircCommand{Func: (*IRCServer).cmdOper, MinParams: 2}
+	Commands["PRIVS"] = &ircCommand{Func: (*IRCServer).cmdPrivs}
 	Commands["KILL"] = &ircCommand{
 		Func:      (*IRCServer).cmdKill,
 		MinParams: 1,
 	}
+	Commands["WALLOPS"] = &ircCommand{
+		Func: (*IRCServer).cmdWallops,
+	}
+	// RobustIRC does not distinguish between messages to all IRC operators
+	// (GLOBOPS) and messages to all users with user mode +w (WALLOPS).
+	Commands["GLOBOPS"] = Commands["WALLOPS"]
+	Commands["KLINE"] = &ircCommand{
+		Func:      (*IRCServer).cmdKline,
+		MinParams: 1,
+	}
+	Commands["UNKLINE"] = &ircCommand{
+		Func:      (*IRCServer).cmdUnkline,
+		MinParams: 1,
+	}
+	// RobustIRC is a single logical server, so there is no distinction
+	// between local (K-line) and global (G-line) bans.
+	Commands["GLINE"] = Commands["KLINE"]
+	Commands["UNGLINE"] = Commands["UNKLINE"]
+	Commands["STATS"] = &ircCommand{
+		Func:      (*IRCServer).cmdStats,
+		MinParams: 1,
+	}
 	Commands["AWAY"] = &ircCommand{
 		Func: (*IRCServer).cmdAway,
 	}
@@ -79,10 +119,29 @@ func init() {
 	Commands["MOTD"] = &ircCommand{
 		Func: (*IRCServer).cmdMotd,
 	}
+	Commands["LUSERS"] = &ircCommand{
+		Func: (*IRCServer).cmdLusers,
+	}
+	Commands["VERSION"] = &ircCommand{
+		Func: (*IRCServer).cmdVersion,
+	}
+	Commands["TIME"] = &ircCommand{
+		Func: (*IRCServer).cmdTime,
+	}
+	Commands["ADMIN"] = &ircCommand{
+		Func: (*IRCServer).cmdAdmin,
+	}
+	Commands["INFO"] = &ircCommand{
+		Func: (*IRCServer).cmdInfo,
+	}
 	Commands["WHOIS"] = &ircCommand{
 		Func:      (*IRCServer).cmdWhois,
 		MinParams: 1,
 	}
+	Commands["WHOWAS"] = &ircCommand{
+		Func:      (*IRCServer).cmdWhowas,
+		MinParams: 1,
+	}
 	Commands["LIST"] = &ircCommand{
 		Func: (*IRCServer).cmdList,
 	}
@@ -94,6 +153,9 @@ func init() {
 		Func:      (*IRCServer).cmdUserhost,
 		MinParams: 1,
 	}
+	Commands["ISON"] = &ircCommand{
+		Func: (*IRCServer).cmdIson,
+	}
 	Commands["NAMES"] = &ircCommand{
 		Func: (*IRCServer).cmdNames,
 	}
@@ -101,6 +163,14 @@ func init() {
 		Func:      (*IRCServer).cmdKnock,
 		MinParams: 1,
 	}
+	Commands["MONITOR"] = &ircCommand{
+		Func:      (*IRCServer).cmdMonitor,
+		MinParams: 1,
+	}
+	Commands["CHATHISTORY"] = &ircCommand{
+		Func:      (*IRCServer).cmdChathistory,
+		MinParams: 1,
+	}
 	serviceAlias := &ircCommand{
 		Func: (*IRCServer).cmdServiceAlias,
 	}
@@ -144,9 +214,75 @@ func (i *IRCServer) cmdPing(s *Session, reply *Replyctx, msg *irc.Message) {
 	})
 }
 
+// maxTargets returns the maximum number of targets in PRIVMSG, NOTICE and
+// TAGMSG, see config.Network.MaxTargets.
+func (i *IRCServer) maxTargets() int {
+	if i.Config.MaxTargets < 1 {
+		return config.DefaultConfig.MaxTargets
+	}
+	return i.Config.MaxTargets
+}
+
+// sendIsupport sends RPL_ISUPPORT as per:
+// http://www.irc.org/tech_docs/draft-brocklesby-irc-isupport-03.txt
+// http://www.irc.org/tech_docs/005.html
+func (i *IRCServer) sendIsupport(s *Session, reply *Replyctx) {
+	isupport := []string{
+		"CHANTYPES=#",
+		"CHANNELLEN=" + maxChannelLen,
+		"NICKLEN=" + maxNickLen,
+		"MODES=1",
+		"PREFIX=(ohv)@%+",
+		"CHANMODES=beI,k,fl,imnst",
+		"KNOCK",
+		"EXCEPTS",
+		"INVEX",
+		"MONITOR=" + strconv.Itoa(maxMonitorTargets),
+		"USERMODES=,,s,iorw",
+		"CASEMAPPING=" + isupportCaseMapping(i.caseMapping),
+		"WHOX",
+		"STATUSMSG=" + statusmsgPrefixes,
+		fmt.Sprintf("TARGMAX=PRIVMSG:%d,NOTICE:%d,TAGMSG:%d", i.maxTargets(), i.maxTargets(), i.maxTargets()),
+	}
+	if i.Config.ChatHistoryLimit > 0 {
+		isupport = append(isupport, "CHATHISTORY="+strconv.Itoa(i.Config.ChatHistoryLimit))
+	}
+	if len(i.Config.ClientTagDeny) > 0 {
+		isupport = append(isupport, "CLIENTTAGDENY="+strings.Join(i.Config.ClientTagDeny, ","))
+	}
+	// At most 13 tokens may be sent per RPL_ISUPPORT message.
+	for len(isupport) > 0 {
+		n := len(isupport)
+		if n > 13 {
+			n = 13
+		}
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  "005",
+			Params:   isupport[:n],
+			Trailing: "are supported by this server",
+		})
+		isupport = isupport[n:]
+	}
+}
+
 // login is called by either cmdNick or cmdUser, depending on which message the
 // client sends last.
 func (i *IRCServer) login(s *Session, reply *Replyctx, msg *irc.Message) {
+	if k, ok := i.matchingKline(s, time.Unix(0, reply.msgid)); ok {
+		// The session was not yet announced to the services or any channel.
+		i.DeleteSession(s, reply)
+		i.sendKlined(s, reply, k)
+		return
+	}
+
+	if f, ok := i.matchSpamFilter(s, reply, config.SpamFilterRealname, s.Realname); ok && f.Action != config.SpamFilterNotice {
+		// Like K-lined sessions, sessions whose realname is blocked cannot
+		// log in.
+		i.spamFilterDisconnect(s, reply, f, false)
+		return
+	}
+
 	i.sendUser(s, reply, &irc.Message{
 		Prefix:   i.ServerPrefix,
 		Command:  irc.RPL_WELCOME,
@@ -172,25 +308,10 @@ func (i *IRCServer) login(s *Session, reply *Replyctx, msg *irc.Message) {
 		Prefix:   i.ServerPrefix,
 		Command:  irc.RPL_MYINFO,
 		Params:   []string{s.Nick},
-		Trailing: i.ServerPrefix.Name + " v1 i nsti",
+		Trailing: i.ServerPrefix.Name + " v1 iorsw beIfhiklmnostv",
 	})
 
-	// send ISUPPORT as per:
-	// http://www.irc.org/tech_docs/draft-brocklesby-irc-isupport-03.txt
-	// http://www.irc.org/tech_docs/005.html
-	i.sendUser(s, reply, &irc.Message{
-		Prefix:  i.ServerPrefix,
-		Command: "005",
-		Params: []string{
-			"CHANTYPES=#",
-			"CHANNELLEN=" + maxChannelLen,
-			"NICKLEN=" + maxNickLen,
-			"MODES=1",
-			"PREFIX=(o)@",
-			"KNOCK",
-		},
-		Trailing: "are supported by this server",
-	})
+	i.sendIsupport(s, reply)
 
 	i.sendServices(reply, &irc.Message{
 		Command: irc.NICK,
@@ -220,11 +341,16 @@ func (i *IRCServer) login(s *Session, reply *Replyctx, msg *irc.Message) {
 	if pass := extractPassword(s.Pass, "oper"); pass != "" {
 		parsed := irc.ParseMessage("OPER " + pass)
 		if len(parsed.Params) > 1 {
-			i.cmdOper(s, reply, parsed)
+			i.oper(s, reply, parsed.Params[0], s.passCredentials)
 		}
 	}
 
 	i.cmdMotd(s, reply, msg)
+
+	i.notifyMonitors(reply, s.ircPrefix, true)
+
+	i.sendSnotice(reply, snoConnects, fmt.Sprintf("Client connecting: %s (%s@%s) [%s]",
+		s.Nick, s.ircPrefix.User, s.ircPrefix.Host, s.Realname))
 }
 
 func (i *IRCServer) cmdNick(s *Session, reply *Replyctx, msg *irc.Message) {
@@ -250,10 +376,10 @@ func (i *IRCServer) cmdNick(s *Session, reply *Replyctx, msg *irc.Message) {
 	onlyCapsChanged := false // Whether the nick change only changes capitalization.
 	if s.loggedIn() {
 		dest = s.Nick
-		onlyCapsChanged = NickToLower(nick) == NickToLower(dest)
+		onlyCapsChanged = i.NickToLower(nick) == i.NickToLower(dest)
 	}
 
-	if !IsValidNickname(nick) {
+	if !i.isValidNickname(nick) {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_ERRONEUSNICKNAME,
@@ -263,7 +389,21 @@ func (i *IRCServer) cmdNick(s *Session, reply *Replyctx, msg *irc.Message) {
 		return
 	}
 
-	if _, ok := i.nicks[NickToLower(nick)]; (ok && !onlyCapsChanged) || IsServicesNickname(nick) {
+	if f, ok := i.matchSpamFilter(s, reply, config.SpamFilterNick, nick); ok && f.Action != config.SpamFilterNotice {
+		if f.Action == config.SpamFilterBlock {
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   i.ServerPrefix,
+				Command:  irc.ERR_ERRONEUSNICKNAME,
+				Params:   []string{dest, nick},
+				Trailing: "Erroneous Nickname: " + spamFilterReason(f),
+			})
+		} else {
+			i.spamFilterDisconnect(s, reply, f, s.loggedIn())
+		}
+		return
+	}
+
+	if _, ok := i.nicks[i.NickToLower(nick)]; (ok && !onlyCapsChanged) || IsServicesNickname(nick) {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_NICKNAMEINUSE,
@@ -273,7 +413,27 @@ func (i *IRCServer) cmdNick(s *Session, reply *Replyctx, msg *irc.Message) {
 		return
 	}
 
-	if hold, ok := i.svsholds[NickToLower(nick)]; ok {
+	if s.loggedIn() && !onlyCapsChanged {
+		var banned []string
+		for channelname := range s.Channels {
+			c, ok := i.channels[channelname]
+			if ok && !c.nicks[i.NickToLower(s.Nick)][chanop] && c.isBanned(s) {
+				banned = append(banned, c.name)
+			}
+		}
+		if len(banned) > 0 {
+			sort.Strings(banned)
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   i.ServerPrefix,
+				Command:  "435", // ERR_BANNICKCHANGE
+				Params:   []string{dest, nick, banned[0]},
+				Trailing: "Cannot change nickname while banned on channel",
+			})
+			return
+		}
+	}
+
+	if hold, ok := i.svsholds[i.NickToLower(nick)]; ok {
 		if !s.LastActivity.After(hold.added.Add(hold.duration)) {
 			i.sendUser(s, reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
@@ -284,19 +444,19 @@ func (i *IRCServer) cmdNick(s *Session, reply *Replyctx, msg *irc.Message) {
 			return
 		}
 		// The SVSHOLD expired, so remove it.
-		delete(i.svsholds, NickToLower(nick))
+		delete(i.svsholds, i.NickToLower(nick))
 	}
 
 	loggedIn := s.loggedIn()
-	oldNick := NickToLower(s.Nick)
+	oldNick := i.NickToLower(s.Nick)
 	s.Nick = nick
-	i.nicks[NickToLower(s.Nick)] = s
+	i.nicks[i.NickToLower(s.Nick)] = s
 	if oldNick != "" && !onlyCapsChanged {
 		delete(i.nicks, oldNick)
 		for _, c := range i.channels {
 			// Check ok to ensure we never assign the default value (<nil>).
 			if modes, ok := c.nicks[oldNick]; ok {
-				c.nicks[NickToLower(s.Nick)] = modes
+				c.nicks[i.NickToLower(s.Nick)] = modes
 			}
 			delete(c.nicks, oldNick)
 		}
@@ -311,6 +471,18 @@ func (i *IRCServer) cmdNick(s *Session, reply *Replyctx, msg *irc.Message) {
 					Command:  irc.NICK,
 					Trailing: nick,
 				})))
+		if loggedIn {
+			i.addWhowas(oldPrefix, s.Realname, reply.msgid)
+			if !onlyCapsChanged {
+				i.notifyMonitors(reply, oldPrefix, false)
+				i.notifyMonitors(reply, s.ircPrefix, true)
+			}
+			i.sendSnotice(reply, snoNicks, fmt.Sprintf("Nick change: From %s to %s [%s@%s]",
+				oldPrefix.Name, nick, s.ircPrefix.User, s.ircPrefix.Host))
+			if !onlyCapsChanged {
+				i.checkNickFlood(s, reply)
+			}
+		}
 		return
 	}
 
@@ -332,8 +504,185 @@ func (i *IRCServer) cmdUser(s *Session, reply *Replyctx, msg *irc.Message) {
 	}
 }
 
+// capability is an IRCv3 capability which clients can enable using CAP REQ.
+type capability struct {
+	name string
+
+	// value is only advertised to clients which speak CAP version 302 or
+	// newer, e.g. the supported mechanisms of “sasl”.
+	value string
+}
+
+// supportedCapabilities lists all capabilities in the order in which they are
+// advertised in CAP LS.
+var supportedCapabilities = []capability{
+	{name: "account-notify"},
+	{name: "account-tag"},
+	{name: "away-notify"},
+	{name: "batch"},
+	{name: "cap-notify"},
+	{name: "draft/chathistory"},
+	{name: "draft/message-redaction"},
+	{name: "echo-message"},
+	{name: "extended-join"},
+	{name: "labeled-response"},
+	{name: "message-tags"},
+	{name: "multi-prefix"},
+	{name: "sasl", value: strings.Join(saslMechanisms, ",")},
+	{name: "server-time"},
+	{name: "userhost-in-names"},
+}
+
+func isSupportedCapability(name string) bool {
+	for _, c := range supportedCapabilities {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// capList sends |caps| as one or more CAP |subcommand| messages, using the
+// multi-line format of CAP version 302 when the list gets too long.
+func (i *IRCServer) capList(s *Session, reply *Replyctx, nick, subcommand string, caps []string) {
+	// Leave enough room for the prefix, nickname and subcommand within the
+	// 512 byte limit of an IRC message.
+	const maxLen = 400
+	var line string
+	for _, c := range caps {
+		if line != "" && len(line)+1+len(c) > maxLen {
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   i.ServerPrefix,
+				Command:  irc.CAP,
+				Params:   []string{nick, subcommand, "*"},
+				Trailing: line,
+			})
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += c
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:        i.ServerPrefix,
+		Command:       irc.CAP,
+		Params:        []string{nick, subcommand},
+		Trailing:      line,
+		EmptyTrailing: true,
+	})
+}
+
+func (i *IRCServer) cmdCap(s *Session, reply *Replyctx, msg *irc.Message) {
+	nick := "*"
+	if s.Nick != "" {
+		nick = s.Nick
+	}
+
+	subcommand := strings.ToUpper(msg.Params[0])
+	switch subcommand {
+	case irc.CAP_LS:
+		if !s.loggedIn() {
+			s.capNegotiating = true
+		}
+		var version int
+		if len(msg.Params) > 1 {
+			version, _ = strconv.Atoi(msg.Params[1])
+		}
+		// Clients which speak CAP version 302 implicitly enable cap-notify.
+		if version >= 302 {
+			s.capabilities["cap-notify"] = true
+		}
+		caps := make([]string, 0, len(supportedCapabilities))
+		for _, c := range supportedCapabilities {
+			if version >= 302 && c.value != "" {
+				caps = append(caps, c.name+"="+c.value)
+			} else {
+				caps = append(caps, c.name)
+			}
+		}
+		i.capList(s, reply, nick, irc.CAP_LS, caps)
+
+	case irc.CAP_LIST:
+		caps := make([]string, 0, len(s.capabilities))
+		for _, c := range supportedCapabilities {
+			if s.capabilities[c.name] {
+				caps = append(caps, c.name)
+			}
+		}
+		i.capList(s, reply, nick, irc.CAP_LIST, caps)
+
+	case irc.CAP_REQ:
+		if !s.loggedIn() {
+			s.capNegotiating = true
+		}
+		requested := msg.Trailing
+		if len(msg.Params) > 1 {
+			requested = strings.Join(msg.Params[1:], " ")
+		}
+		fields := strings.Fields(requested)
+		// Requests are atomic: either all capabilities are changed or none.
+		ack := len(fields) > 0
+		for _, c := range fields {
+			if !isSupportedCapability(strings.TrimPrefix(c, "-")) {
+				ack = false
+				break
+			}
+		}
+		if !ack {
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:        i.ServerPrefix,
+				Command:       irc.CAP,
+				Params:        []string{nick, irc.CAP_NAK},
+				Trailing:      requested,
+				EmptyTrailing: true,
+			})
+			return
+		}
+		for _, c := range fields {
+			if strings.HasPrefix(c, "-") {
+				delete(s.capabilities, c[1:])
+			} else {
+				s.capabilities[c] = true
+			}
+		}
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.CAP,
+			Params:   []string{nick, irc.CAP_ACK},
+			Trailing: strings.Join(fields, " "),
+		})
+
+	case irc.CAP_END:
+		if !s.capNegotiating {
+			return
+		}
+		s.capNegotiating = false
+		if s.loggedIn() {
+			i.login(s, reply, msg)
+		}
+
+	default:
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  "410", // ERR_INVALIDCAPCMD
+			Params:   []string{nick, msg.Params[0]},
+			Trailing: "Invalid CAP command",
+		})
+	}
+}
+
 func (i *IRCServer) cmdJoin(s *Session, reply *Replyctx, msg *irc.Message) {
-	for _, channelname := range strings.Split(msg.Params[0], ",") {
+	var keys []string
+	if len(msg.Params) > 1 {
+		keys = strings.Split(msg.Params[1], ",")
+	}
+	for idx, channelname := range strings.Split(msg.Params[0], ",") {
+		var key string
+		if idx < len(keys) {
+			key = keys[idx]
+		}
+		invited := s.invitedTo[i.ChanToLower(channelname)]
 		if !IsValidChannel(channelname) {
 			i.sendUser(s, reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
@@ -343,14 +692,17 @@ func (i *IRCServer) cmdJoin(s *Session, reply *Replyctx, msg *irc.Message) {
 			})
 			continue
 		}
-		c, ok := i.channels[ChanToLower(channelname)]
+		c, ok := i.channels[i.ChanToLower(channelname)]
+		if ok {
+			i.liftFloodLock(c, reply)
+		}
 		if !ok {
 			c = &channel{
 				name:  channelname,
 				nicks: make(map[lcNick]*[maxChanMemberStatus]bool),
 			}
-			i.channels[ChanToLower(channelname)] = c
-		} else if c.modes['i'] && !s.invitedTo[ChanToLower(channelname)] {
+			i.channels[i.ChanToLower(channelname)] = c
+		} else if c.modes['i'] && !invited && !matchesMaskList(c.inviteExceptions, s) {
 			i.sendUser(s, reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
 				Command:  irc.ERR_INVITEONLYCHAN,
@@ -358,27 +710,57 @@ func (i *IRCServer) cmdJoin(s *Session, reply *Replyctx, msg *irc.Message) {
 				Trailing: "Cannot join channel (+i)",
 			})
 			continue
+		} else if c.isBanned(s) {
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   i.ServerPrefix,
+				Command:  irc.ERR_BANNEDFROMCHAN,
+				Params:   []string{s.Nick, c.name},
+				Trailing: "Cannot join channel (+b)",
+			})
+			continue
+		} else if c.modes['k'] && key != c.key && !invited {
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   i.ServerPrefix,
+				Command:  irc.ERR_BADCHANNELKEY,
+				Params:   []string{s.Nick, c.name},
+				Trailing: "Cannot join channel (+k)",
+			})
+			continue
+		} else if c.modes['l'] && len(c.nicks) >= c.limit && !invited {
+			if _, ok := c.nicks[i.NickToLower(s.Nick)]; !ok {
+				i.sendUser(s, reply, &irc.Message{
+					Prefix:   i.ServerPrefix,
+					Command:  irc.ERR_CHANNELISFULL,
+					Params:   []string{s.Nick, c.name},
+					Trailing: "Cannot join channel (+l)",
+				})
+				continue
+			}
 		}
-		if _, ok := c.nicks[NickToLower(s.Nick)]; ok {
+		if _, ok := c.nicks[i.NickToLower(s.Nick)]; ok {
 			continue
 		}
-		c.nicks[NickToLower(s.Nick)] = &[maxChanMemberStatus]bool{}
+		c.nicks[i.NickToLower(s.Nick)] = &[maxChanMemberStatus]bool{}
 		// If the channel did not exist before, the first joining user becomes a
 		// channel operator.
 		if !ok {
-			c.nicks[NickToLower(s.Nick)][chanop] = true
+			c.nicks[i.NickToLower(s.Nick)][chanop] = true
 		}
-		s.Channels[ChanToLower(channelname)] = true
+		s.Channels[i.ChanToLower(channelname)] = true
 
 		i.sendChannel(c, reply, &irc.Message{
 			Prefix:   &s.ircPrefix,
 			Command:  irc.JOIN,
 			Trailing: channelname,
 		})
-		var prefix string
-		if c.nicks[NickToLower(s.Nick)][chanop] {
-			prefix = prefix + string('@')
+		if s.AwayMsg != "" {
+			i.sendChannel(c, reply, &irc.Message{
+				Prefix:   &s.ircPrefix,
+				Command:  irc.AWAY,
+				Trailing: s.AwayMsg,
+			})
 		}
+		prefix := memberPrefix(c.nicks[i.NickToLower(s.Nick)])
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  "SJOIN",
@@ -388,12 +770,13 @@ func (i *IRCServer) cmdJoin(s *Session, reply *Replyctx, msg *irc.Message) {
 		// Integrate the topic response by simulating a TOPIC command.
 		i.cmdTopic(s, reply, &irc.Message{Command: irc.TOPIC, Params: []string{channelname}})
 		i.cmdNames(s, reply, &irc.Message{Command: irc.NAMES, Params: []string{channelname}})
+		i.checkFlood(c, s, reply, floodJoins)
 	}
 }
 
 func (i *IRCServer) cmdKick(s *Session, reply *Replyctx, msg *irc.Message) {
 	channelname := msg.Params[0]
-	c, ok := i.channels[ChanToLower(channelname)]
+	c, ok := i.channels[i.ChanToLower(channelname)]
 	if !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -404,7 +787,7 @@ func (i *IRCServer) cmdKick(s *Session, reply *Replyctx, msg *irc.Message) {
 		return
 	}
 
-	perms, ok := c.nicks[NickToLower(s.Nick)]
+	perms, ok := c.nicks[i.NickToLower(s.Nick)]
 	if !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -425,7 +808,7 @@ func (i *IRCServer) cmdKick(s *Session, reply *Replyctx, msg *irc.Message) {
 		return
 	}
 
-	if _, ok := c.nicks[NickToLower(msg.Params[1])]; !ok {
+	if _, ok := c.nicks[i.NickToLower(msg.Params[1])]; !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_USERNOTINCHANNEL,
@@ -436,7 +819,7 @@ func (i *IRCServer) cmdKick(s *Session, reply *Replyctx, msg *irc.Message) {
 	}
 
 	// Must exist since c.nicks contains the nick.
-	session, _ := i.nicks[NickToLower(msg.Params[1])]
+	session, _ := i.nicks[i.NickToLower(msg.Params[1])]
 
 	i.sendServices(reply,
 		i.sendChannel(c, reply, &irc.Message{
@@ -448,15 +831,15 @@ func (i *IRCServer) cmdKick(s *Session, reply *Replyctx, msg *irc.Message) {
 		}))
 
 	// TODO(secure): reduce code duplication with cmdPart()
-	delete(c.nicks, NickToLower(msg.Params[1]))
+	delete(c.nicks, i.NickToLower(msg.Params[1]))
 	i.maybeDeleteChannel(c)
-	delete(session.Channels, ChanToLower(channelname))
+	delete(session.Channels, i.ChanToLower(channelname))
 
 }
 
 func (i *IRCServer) cmdPart(s *Session, reply *Replyctx, msg *irc.Message) {
 	for _, channelname := range strings.Split(msg.Params[0], ",") {
-		c, ok := i.channels[ChanToLower(channelname)]
+		c, ok := i.channels[i.ChanToLower(channelname)]
 		if !ok {
 			i.sendUser(s, reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
@@ -467,7 +850,7 @@ func (i *IRCServer) cmdPart(s *Session, reply *Replyctx, msg *irc.Message) {
 			continue
 		}
 
-		if _, ok := c.nicks[NickToLower(s.Nick)]; !ok {
+		if _, ok := c.nicks[i.NickToLower(s.Nick)]; !ok {
 			i.sendUser(s, reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
 				Command:  irc.ERR_NOTONCHANNEL,
@@ -484,31 +867,50 @@ func (i *IRCServer) cmdPart(s *Session, reply *Replyctx, msg *irc.Message) {
 				Params:  []string{channelname},
 			}))
 
-		delete(c.nicks, NickToLower(s.Nick))
+		delete(c.nicks, i.NickToLower(s.Nick))
 		i.maybeDeleteChannel(c)
-		delete(s.Channels, ChanToLower(channelname))
+		delete(s.Channels, i.ChanToLower(channelname))
 
 	}
 }
 
 func (i *IRCServer) cmdQuit(s *Session, reply *Replyctx, msg *irc.Message) {
-	i.DeleteSession(s, reply.msgid)
+	quitmsg := msg.Trailing
+	f, filtered := i.matchSpamFilter(s, reply, config.SpamFilterQuit, quitmsg)
+	if filtered && f.Action != config.SpamFilterNotice {
+		// The session is leaving anyway, so all other actions drop the quit
+		// message.
+		quitmsg = ""
+	}
+	i.DeleteSession(s, reply)
+	if filtered && f.Action == config.SpamFilterBan {
+		i.spamFilterBan(s, reply, f)
+	}
 	if s.loggedIn() {
 		i.sendServices(reply,
 			i.sendCommonChannels(s, reply, &irc.Message{
 				Prefix:        &s.ircPrefix,
 				Command:       irc.QUIT,
-				Trailing:      msg.Trailing,
+				Trailing:      quitmsg,
 				EmptyTrailing: true,
 			}))
 		i.sendUser(s, reply, &irc.Message{
 			Command:  irc.ERROR,
-			Trailing: fmt.Sprintf("Closing Link: %s[%s] (%s)", s.Nick, s.ircPrefix.Host, msg.Trailing),
+			Trailing: fmt.Sprintf("Closing Link: %s[%s] (%s)", s.Nick, s.ircPrefix.Host, quitmsg),
 		})
 	}
 
 }
 
+// echo sends |msg|, which |s| sent, back to |s| if |s| negotiated the
+// echo-message capability. |msg| must be the message which was sent last, so
+// that the echo shares its RobustMessage (and hence its msgid).
+func (i *IRCServer) echo(s *Session, reply *Replyctx, msg *irc.Message) {
+	if s.capabilities["echo-message"] {
+		i.sendUser(s, reply, msg)
+	}
+}
+
 func (i *IRCServer) cmdPrivmsg(s *Session, reply *Replyctx, msg *irc.Message) {
 	if len(msg.Params) < 1 {
 		i.sendUser(s, reply, &irc.Message{
@@ -520,7 +922,17 @@ func (i *IRCServer) cmdPrivmsg(s *Session, reply *Replyctx, msg *irc.Message) {
 		return
 	}
 
-	if msg.Trailing == "" {
+	// TAGMSG carries only client-only tags (e.g. typing notifications), see
+	// http://ircv3.net/specs/extensions/message-tags.html
+	tagmsg := strings.ToUpper(msg.Command) == "TAGMSG"
+	if tagmsg {
+		msg = &irc.Message{
+			Command: "TAGMSG",
+			Params:  msg.Params,
+		}
+	}
+
+	if msg.Trailing == "" && !tagmsg {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_NOTEXTTOSEND,
@@ -530,18 +942,47 @@ func (i *IRCServer) cmdPrivmsg(s *Session, reply *Replyctx, msg *irc.Message) {
 		return
 	}
 
-	if strings.HasPrefix(msg.Params[0], "#") {
-		c, ok := i.channels[ChanToLower(msg.Params[0])]
+	targets := strings.Split(msg.Params[0], ",")
+	if len(targets) > i.maxTargets() {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.ERR_TOOMANYTARGETS,
+			Params:   []string{s.Nick, msg.Params[0]},
+			Trailing: "Too many recipients",
+		})
+		return
+	}
+	for _, target := range targets {
+		i.privmsgTarget(s, reply, msg, target, tagmsg)
+		if s.deleted {
+			// The spam filter disconnected s.
+			return
+		}
+	}
+}
+
+// privmsgTarget delivers the PRIVMSG, NOTICE or TAGMSG |msg| to |target|,
+// which is a nickname, a channel or a channel with a STATUSMSG prefix (e.g.
+// “@#test” for the channel operators of #test).
+func (i *IRCServer) privmsgTarget(s *Session, reply *Replyctx, msg *irc.Message, target string, tagmsg bool) {
+	channelname := strings.TrimLeft(target, statusmsgPrefixes)
+	status := target[:len(target)-len(channelname)]
+	if strings.HasPrefix(channelname, "#") {
+		c, ok := i.channels[i.ChanToLower(channelname)]
 		if !ok {
 			i.sendUser(s, reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
 				Command:  irc.ERR_NOSUCHCHANNEL,
-				Params:   []string{s.Nick, msg.Params[0]},
+				Params:   []string{s.Nick, target},
 				Trailing: "No such channel",
 			})
 			return
 		}
-		if _, ok := c.nicks[NickToLower(s.Nick)]; !ok && c.modes['n'] {
+		i.liftFloodLock(c, reply)
+		perms, ok := c.nicks[i.NickToLower(s.Nick)]
+		if (!ok && c.modes['n']) ||
+			((!ok || !perms[chanop]) && c.isBanned(s)) ||
+			(c.modes['m'] && (!ok || (!perms[chanop] && !perms[halfop] && !perms[voice]))) {
 			i.sendUser(s, reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
 				Command:  irc.ERR_CANNOTSENDTOCHAN,
@@ -550,40 +991,65 @@ func (i *IRCServer) cmdPrivmsg(s *Session, reply *Replyctx, msg *irc.Message) {
 			})
 			return
 		}
-		i.sendChannelButOne(c, s, reply, &irc.Message{
+		if !tagmsg && i.spamFiltered(s, reply, config.SpamFilterChannel, target, msg.Trailing) {
+			return
+		}
+		if i.checkFlood(c, s, reply, floodMessages) {
+			return
+		}
+		relayed := &irc.Message{
 			Prefix:        &s.ircPrefix,
 			Command:       msg.Command,
-			Params:        []string{msg.Params[0]},
+			Params:        []string{target},
 			Trailing:      msg.Trailing,
-			EmptyTrailing: true,
-		})
+			EmptyTrailing: !tagmsg,
+		}
+		if status != "" {
+			// With multiple prefixes (e.g. “@+#test”), the lowest status
+			// applies.
+			i.sendChannelStatusButOne(c, s, reply, status[len(status)-1:], relayed)
+		} else {
+			i.sendChannelButOne(c, s, reply, relayed)
+		}
+		if !tagmsg {
+			i.recordSent(s, reply, relayed, c.name, 0)
+		}
+		i.echo(s, reply, i.relayClientTags(reply, relayed))
 		return
 	}
 
-	session, ok := i.nicks[NickToLower(msg.Params[0])]
+	session, ok := i.nicks[i.NickToLower(target)]
 	if !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_NOSUCHNICK,
-			Params:   []string{s.Nick, msg.Params[0]},
+			Params:   []string{s.Nick, target},
 			Trailing: "No such nick/channel",
 		})
 		return
 	}
 
-	i.sendUser(session, reply, &irc.Message{
+	if !tagmsg && i.spamFiltered(s, reply, config.SpamFilterPrivate, target, msg.Trailing) {
+		return
+	}
+
+	relayed := i.sendUser(session, reply, &irc.Message{
 		Prefix:        &s.ircPrefix,
 		Command:       msg.Command,
-		Params:        []string{msg.Params[0]},
+		Params:        []string{target},
 		Trailing:      msg.Trailing,
-		EmptyTrailing: true,
+		EmptyTrailing: !tagmsg,
 	})
+	if !tagmsg {
+		i.recordSent(s, reply, relayed, target, session.Id.Id)
+	}
+	i.echo(s, reply, i.relayClientTags(reply, relayed))
 
 	if session.AwayMsg != "" && msg.Command == irc.PRIVMSG {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:        i.ServerPrefix,
 			Command:       irc.RPL_AWAY,
-			Params:        []string{s.Nick, msg.Params[0]},
+			Params:        []string{s.Nick, target},
 			Trailing:      session.AwayMsg,
 			EmptyTrailing: true,
 		})
@@ -644,7 +1110,30 @@ func normalizeModes(msg *irc.Message) []modeCmd {
 		switch char {
 		case '+', '-':
 			adding = (char == '+')
-		case 'o', 'd':
+		case 'b', 'e', 'I':
+			// List modes, which are queries when used without a parameter.
+			if len(msg.Params) > modearg {
+				mode.Param = msg.Params[modearg]
+				modearg++
+			}
+			if adding {
+				mode.Mode = "+" + string(char)
+			} else {
+				mode.Mode = "-" + string(char)
+			}
+		case 'k', 'f', 'l':
+			// Modes which require a parameter when being set. The
+			// parameter is optional when removing the key.
+			if len(msg.Params) > modearg && (adding || char == 'k') {
+				mode.Param = msg.Params[modearg]
+				modearg++
+			}
+			if adding {
+				mode.Mode = "+" + string(char)
+			} else {
+				mode.Mode = "-" + string(char)
+			}
+		case 'o', 'h', 'v', 'd':
 			// Modes which require a parameter.
 			if len(msg.Params) > modearg {
 				mode.Param = msg.Params[modearg]
@@ -669,35 +1158,51 @@ func normalizeModes(msg *irc.Message) []modeCmd {
 func (i *IRCServer) cmdMode(s *Session, reply *Replyctx, msg *irc.Message) {
 	channelname := msg.Params[0]
 	// TODO(secure): properly distinguish between users and channels
-	if s.Channels[ChanToLower(channelname)] {
+	if s.Channels[i.ChanToLower(channelname)] {
 		// Channel must exist, the user is in it.
-		c := i.channels[ChanToLower(channelname)]
+		c := i.channels[i.ChanToLower(channelname)]
 		modes := normalizeModes(msg)
 		queryOnly := true
 
 		if len(modes) == 0 {
+			i.liftFloodLock(c, reply)
 			modestr := "+"
+			var params []string
 			for mode := 'A'; mode < 'z'; mode++ {
 				if c.modes[mode] {
 					modestr += string(mode)
 				}
 			}
+			if c.modes['f'] {
+				params = append(params, c.flood.String())
+			}
+			if c.modes['k'] {
+				params = append(params, c.key)
+			}
+			if c.modes['l'] {
+				params = append(params, strconv.Itoa(c.limit))
+			}
 			i.sendUser(s, reply, &irc.Message{
 				Prefix:  i.ServerPrefix,
 				Command: irc.RPL_CHANNELMODEIS,
-				Params:  []string{s.Nick, channelname, modestr},
+				Params:  append([]string{s.Nick, channelname, modestr}, params...),
 			})
 			return
 		}
 
-		isChanOp := c.nicks[NickToLower(s.Nick)][chanop] || s.Operator
+		isChanOp := c.nicks[i.NickToLower(s.Nick)][chanop] || i.hasPrivilege(s, config.PrivilegeOverride)
+		isHalfOp := c.nicks[i.NickToLower(s.Nick)][halfop]
 
-		for _, mode := range modes {
+		// applied contains the modes which are broadcast, i.e. all but
+		// queries and mask list changes which are no-ops.
+		var applied modeCmds
+		for idx, mode := range modes {
 			char := mode.Mode[1]
-			if mode.Mode != "+b" {
+			if c.maskList(char) == nil || mode.Param != "" {
 				// Non-query modes
 				queryOnly = false
-				if !isChanOp {
+				// Half operators can only give and take voice.
+				if !isChanOp && !(isHalfOp && char == 'v') {
 					i.sendUser(s, reply, &irc.Message{
 						Prefix:   i.ServerPrefix,
 						Command:  irc.ERR_CHANOPRIVSNEEDED,
@@ -710,10 +1215,14 @@ func (i *IRCServer) cmdMode(s *Session, reply *Replyctx, msg *irc.Message) {
 				switch char {
 				case 't', 's', 'i', 'n':
 					c.modes[char] = newvalue
+				case 'm':
+					c.modes[char] = newvalue
+					// An explicit +m or -m overrides flood protection.
+					c.floodLockExpires = time.Time{}
 
-				case 'o':
+				case 'o', 'h', 'v':
 					nick := mode.Param
-					perms, ok := c.nicks[NickToLower(nick)]
+					perms, ok := c.nicks[i.NickToLower(nick)]
 					if !ok {
 						i.sendUser(s, reply, &irc.Message{
 							Prefix:   i.ServerPrefix,
@@ -722,12 +1231,33 @@ func (i *IRCServer) cmdMode(s *Session, reply *Replyctx, msg *irc.Message) {
 							Trailing: "They aren't on that channel",
 						})
 					} else {
-						// If the user already is a chanop, silently do
+						// If the user already has that status, silently do
 						// nothing (like UnrealIRCd).
-						if perms[chanop] != newvalue {
-							c.nicks[NickToLower(nick)][chanop] = newvalue
-						}
+						perms[statusForMode(char)] = newvalue
+					}
+				case 'b', 'e', 'I':
+					mask, changed := i.setMaskMode(c, mode, s.ircPrefix.String(), reply)
+					if !changed {
+						continue
 					}
+					modes[idx].Param = mask
+				case 'k', 'l', 'f':
+					var param string
+					var ok bool
+					if char == 'f' {
+						param, ok = c.setFlood(mode)
+					} else {
+						param, ok = c.setKeyOrLimit(mode)
+					}
+					if !ok {
+						i.sendUser(s, reply, &irc.Message{
+							Prefix:   i.ServerPrefix,
+							Command:  irc.ERR_NEEDMOREPARAMS,
+							Params:   []string{s.Nick, irc.MODE},
+							Trailing: "Not enough parameters",
+						})
+					}
+					modes[idx].Param = param
 				default:
 					i.sendUser(s, reply, &irc.Message{
 						Prefix:   i.ServerPrefix,
@@ -736,45 +1266,36 @@ func (i *IRCServer) cmdMode(s *Session, reply *Replyctx, msg *irc.Message) {
 						Trailing: "is unknown mode char to me",
 					})
 				}
+				applied = append(applied, modes[idx])
 			} else {
 				// Query modes
-				switch char {
-				case 'b':
-					i.sendUser(s, reply, &irc.Message{
-						Prefix:   i.ServerPrefix,
-						Command:  irc.RPL_ENDOFBANLIST,
-						Params:   []string{s.Nick, channelname},
-						Trailing: "End of Channel Ban List",
-					})
-
-				default:
-					i.sendUser(s, reply, &irc.Message{
-						Prefix:   i.ServerPrefix,
-						Command:  irc.ERR_UNKNOWNMODE,
-						Params:   []string{s.Nick, string(char)},
-						Trailing: "is unknown mode char to me",
-					})
-				}
+				i.sendMaskList(s, reply, c, char)
 			}
 		}
 
-		if queryOnly {
+		if queryOnly || len(applied) == 0 {
 			return
 		}
 
-		if reply.replyid > 0 {
+		if len(reply.Messages) > 0 {
 			// TODO(secure): see how other ircds are handling mixtures of valid/invalid modes. do they sanity check the entire mode string before applying it, or do they keep valid modes while erroring for others?
 			return
 		}
+		// Only lift the flood lock now: it sends a MODE, which the check
+		// above would mistake for an error.
+		i.liftFloodLock(c, reply)
 		i.sendServices(reply,
 			i.sendChannel(c, reply, &irc.Message{
 				Prefix:  &s.ircPrefix,
 				Command: irc.MODE,
-				Params:  append([]string{channelname}, modeCmds(modes).IRCParams()...),
+				Params:  append([]string{channelname}, applied.IRCParams()...),
 			}))
 		return
 	}
-	if NickToLower(channelname) == NickToLower(s.Nick) {
+	if i.NickToLower(channelname) == i.NickToLower(s.Nick) {
+		if (len(msg.Params) > 1 || msg.Trailing != "") && i.setUserModes(s, reply, msg) {
+			return
+		}
 		modestr := "+"
 		for mode := 'A'; mode < 'z'; mode++ {
 			if s.modes[mode] {
@@ -799,55 +1320,227 @@ func (i *IRCServer) cmdMode(s *Session, reply *Replyctx, msg *irc.Message) {
 	return
 }
 
-func (i *IRCServer) cmdWho(s *Session, reply *Replyctx, msg *irc.Message) {
-	if len(msg.Params) < 1 {
-		i.sendUser(s, reply, &irc.Message{
-			Prefix:   i.ServerPrefix,
-			Command:  irc.RPL_ENDOFWHO,
-			Params:   []string{s.Nick},
-			Trailing: "End of /WHO list",
-		})
-		return
+// setUserModes changes the user modes of |s| as requested in |msg|, e.g.
+// “MODE sECuRE +iw” or “MODE sECuRE +s +ck”. Unknown modes are ignored. It
+// returns false if nothing was sent to |s|, in which case the caller reports
+// the current modes.
+func (i *IRCServer) setUserModes(s *Session, reply *Replyctx, msg *irc.Message) bool {
+	args := msg.Params[1:]
+	if msg.Trailing != "" {
+		args = append(append([]string{}, args...), msg.Trailing)
 	}
+	modestr, params := args[0], args[1:]
 
-	// TODO: support WHO on nicknames
-	channelname := msg.Params[0]
-
-	lastmsg := &irc.Message{
-		Prefix:   i.ServerPrefix,
-		Command:  irc.RPL_ENDOFWHO,
-		Params:   []string{s.Nick, channelname},
-		Trailing: "End of /WHO list",
+	oldModes := s.modes
+	oldSnomask := s.snomask
+	sent := false
+	adding := true
+	for _, char := range modestr {
+		switch char {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		case 'i', 'w':
+			s.modes[char] = adding
+		case 's':
+			if !adding {
+				s.modes['s'] = false
+				s.snomask = ""
+				continue
+			}
+			if !i.hasPrivilege(s, config.PrivilegeSnomask) {
+				i.sendNoPrivileges(s, reply, config.PrivilegeSnomask)
+				sent = true
+				continue
+			}
+			s.modes['s'] = true
+			change := snomaskCategories
+			if len(params) > 0 {
+				change, params = params[0], params[1:]
+			}
+			s.snomask = applySnomask(s.snomask, change)
+		}
 	}
 
-	c, ok := i.channels[ChanToLower(channelname)]
+	var added, removed string
+	for mode := 'A'; mode < 'z'; mode++ {
+		if s.modes[mode] && !oldModes[mode] {
+			added += string(mode)
+		}
+		if !s.modes[mode] && oldModes[mode] {
+			removed += string(mode)
+		}
+	}
+	var change string
+	if added != "" {
+		change += "+" + added
+	}
+	if removed != "" {
+		change += "-" + removed
+	}
+	if change != "" {
+		i.sendServices(reply,
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   &s.ircPrefix,
+				Command:  irc.MODE,
+				Params:   []string{s.Nick},
+				Trailing: change,
+			}))
+		sent = true
+	}
+	if s.snomask != oldSnomask && s.snomask != "" {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  "008", // RPL_SNOMASK
+			Params:   []string{s.Nick, "+" + s.snomask},
+			Trailing: "Server notice mask",
+		})
+		sent = true
+	}
+	return sent
+}
+
+// setMaskMode adds or removes the mask in |mode| to or from the
+// corresponding mask list of |c| and returns the normalized mask. It returns
+// false if the list did not change, i.e. the mask was already listed (+) or
+// not listed (-).
+func (i *IRCServer) setMaskMode(c *channel, mode modeCmd, setBy string, reply *Replyctx) (string, bool) {
+	list := c.maskList(mode.Mode[1])
+	mask := normalizeMask(mode.Param)
+	for idx, entry := range *list {
+		if i.NickToLower(entry.mask) != i.NickToLower(mask) {
+			continue
+		}
+		if mode.Mode[0] == '+' {
+			return "", false
+		}
+		*list = append((*list)[:idx], (*list)[idx+1:]...)
+		return mask, true
+	}
+	if mode.Mode[0] == '-' {
+		return "", false
+	}
+	*list = append(*list, maskEntry{
+		mask:  mask,
+		setBy: setBy,
+		setAt: time.Unix(0, reply.msgid),
+	})
+	return mask, true
+}
+
+// sendMaskList sends the mask list of |c| for the list mode |char| to |s|.
+func (i *IRCServer) sendMaskList(s *Session, reply *Replyctx, c *channel, char byte) {
+	var entryCmd, endCmd, endText string
+	switch char {
+	case 'b':
+		entryCmd, endCmd, endText = irc.RPL_BANLIST, irc.RPL_ENDOFBANLIST, "End of Channel Ban List"
+	case 'e':
+		entryCmd, endCmd, endText = irc.RPL_EXCEPTLIST, irc.RPL_ENDOFEXCEPTLIST, "End of Channel Exception List"
+	case 'I':
+		entryCmd, endCmd, endText = irc.RPL_INVITELIST, irc.RPL_ENDOFINVITELIST, "End of Channel Invite List"
+	}
+	for _, entry := range *c.maskList(char) {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:  i.ServerPrefix,
+			Command: entryCmd,
+			Params: []string{
+				s.Nick,
+				c.name,
+				entry.mask,
+				entry.setBy,
+				strconv.FormatInt(entry.setAt.Unix(), 10),
+			},
+		})
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  endCmd,
+		Params:   []string{s.Nick, c.name},
+		Trailing: endText,
+	})
+}
+
+func (i *IRCServer) cmdWho(s *Session, reply *Replyctx, msg *irc.Message) {
+	if len(msg.Params) < 1 {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.RPL_ENDOFWHO,
+			Params:   []string{s.Nick},
+			Trailing: "End of /WHO list",
+		})
+		return
+	}
+
+	// TODO: support WHO on nicknames
+	channelname := msg.Params[0]
+
+	// WHOX, e.g. “WHO #test %tnaf,42”, see
+	// https://ircv3.net/specs/extensions/whox
+	var whox bool
+	var fields, token string
+	if len(msg.Params) > 1 {
+		fields = msg.Params[1]
+	} else {
+		fields = msg.Trailing
+	}
+	if strings.HasPrefix(fields, "%") {
+		whox = true
+		fields = fields[1:]
+		if idx := strings.IndexByte(fields, ','); idx > -1 {
+			token = fields[idx+1:]
+			fields = fields[:idx]
+		}
+	}
+
+	lastmsg := &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.RPL_ENDOFWHO,
+		Params:   []string{s.Nick, channelname},
+		Trailing: "End of /WHO list",
+	}
+
+	c, ok := i.channels[i.ChanToLower(channelname)]
 	if !ok {
 		i.sendUser(s, reply, lastmsg)
 		return
 	}
 
 	if c.modes['s'] {
-		if _, ok := c.nicks[NickToLower(s.Nick)]; !ok {
+		if _, ok := c.nicks[i.NickToLower(s.Nick)]; !ok {
 			i.sendUser(s, reply, lastmsg)
 			return
 		}
 	}
 
+	// Users with user mode +i are only visible to channel members.
+	_, isMember := c.nicks[i.NickToLower(s.Nick)]
 	nicks := make([]string, 0, len(c.nicks))
 	for nick := range c.nicks {
+		if !isMember && i.nicks[nick].modes['i'] {
+			continue
+		}
 		nicks = append(nicks, i.nicks[nick].Nick)
 	}
 
 	sort.Strings(nicks)
 
 	for _, nick := range nicks {
-		session := i.nicks[NickToLower(nick)]
+		session := i.nicks[i.NickToLower(nick)]
 		prefix := session.ircPrefix
 		// TODO: also list all other usermodes
 		goneStatus := "H"
 		if session.AwayMsg != "" {
 			goneStatus = "G"
 		}
+		if session.Operator {
+			goneStatus += "*"
+		}
+		goneStatus += memberPrefixFor(s, c.nicks[i.NickToLower(nick)])
+		if whox {
+			i.sendUser(s, reply, i.whoxReply(s, session, channelname, goneStatus, fields, token))
+			continue
+		}
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.RPL_WHOREPLY,
@@ -859,14 +1552,81 @@ func (i *IRCServer) cmdWho(s *Session, reply *Replyctx, msg *irc.Message) {
 	i.sendUser(s, reply, lastmsg)
 }
 
+// whoxFields are all WHOX fields, in the order in which they are sent.
+const whoxFields = "tcuihsnfdlaor"
+
+// whoxReply returns the RPL_WHOSPCRPL message about |session| for |s|,
+// containing the requested |fields|.
+func (i *IRCServer) whoxReply(s, session *Session, channelname, flags, fields, token string) *irc.Message {
+	msg := &irc.Message{
+		Prefix:  i.ServerPrefix,
+		Command: "354", // RPL_WHOSPCRPL
+		Params:  []string{s.Nick},
+	}
+	for _, field := range whoxFields {
+		if !strings.ContainsRune(fields, field) {
+			continue
+		}
+		var value string
+		switch field {
+		case 't':
+			value = token
+			if value == "" {
+				value = "0"
+			}
+		case 'c':
+			value = channelname
+		case 'u':
+			value = session.ircPrefix.User
+		case 'i':
+			// IP addresses are never revealed.
+			value = "255.255.255.255"
+		case 'h':
+			value = session.ircPrefix.Host
+		case 's':
+			value = i.ServerPrefix.Name
+		case 'n':
+			value = session.Nick
+		case 'f':
+			value = flags
+		case 'd':
+			value = "0"
+		case 'l':
+			value = strconv.FormatInt(int64(s.LastActivity.Sub(session.LastActivity).Seconds()), 10)
+		case 'a':
+			value = session.account()
+			if value == "" {
+				value = "0"
+			}
+		case 'o':
+			value = "n/a"
+		case 'r':
+			// The realname can contain spaces and is therefore always last.
+			msg.Trailing = session.Realname
+			msg.EmptyTrailing = true
+			continue
+		}
+		msg.Params = append(msg.Params, value)
+	}
+	return msg
+}
+
 func (i *IRCServer) cmdOper(s *Session, reply *Replyctx, msg *irc.Message) {
-	name := msg.Params[0]
-	password := msg.Params[1]
+	i.oper(s, reply, msg.Params[0], reply.credentials)
+}
+
+// oper makes |s| an IRC operator if |credentials| (see VerifyCredentials)
+// authenticate the operator called |name|.
+func (i *IRCServer) oper(s *Session, reply *Replyctx, name string, credentials []string) {
 	authenticated := false
-	for _, op := range i.Config.IRC.Operators {
-		if op.Name == name && op.Password == password {
-			authenticated = true
-			break
+	if hasCredential(credentials, "oper="+name) {
+		// The operator could have been removed from the configuration
+		// since its password was verified.
+		for _, op := range i.Config.IRC.Operators {
+			if op.Name == name {
+				authenticated = true
+				break
+			}
 		}
 	}
 
@@ -881,6 +1641,7 @@ func (i *IRCServer) cmdOper(s *Session, reply *Replyctx, msg *irc.Message) {
 	}
 
 	s.Operator = true
+	s.operName = name
 	s.modes['o'] = true
 
 	modestr := "+"
@@ -903,6 +1664,48 @@ func (i *IRCServer) cmdOper(s *Session, reply *Replyctx, msg *irc.Message) {
 			Params:   []string{s.Nick},
 			Trailing: modestr,
 		}))
+
+	i.sendSnotice(reply, snoOpers, fmt.Sprintf("%s (%s@%s) is now an IRC operator",
+		s.Nick, s.ircPrefix.User, s.ircPrefix.Host))
+}
+
+// sendNoPrivileges tells |s| that it lacks the operator |privilege|.
+func (i *IRCServer) sendNoPrivileges(s *Session, reply *Replyctx, privilege string) {
+	if !s.Operator {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.ERR_NOPRIVILEGES,
+			Params:   []string{s.Nick},
+			Trailing: "Permission Denied - You're not an IRC operator",
+		})
+		return
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  "723", // ERR_NOPRIVS
+		Params:   []string{s.Nick, privilege},
+		Trailing: "Insufficient oper privileges.",
+	})
+}
+
+func (i *IRCServer) cmdPrivs(s *Session, reply *Replyctx, msg *irc.Message) {
+	if !s.Operator {
+		i.sendNoPrivileges(s, reply, "")
+		return
+	}
+	var privileges []string
+	for _, privilege := range config.Privileges {
+		if i.hasPrivilege(s, privilege) {
+			privileges = append(privileges, privilege)
+		}
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:        i.ServerPrefix,
+		Command:       "270", // RPL_PRIVS
+		Params:        []string{s.Nick, s.Nick},
+		Trailing:      strings.Join(privileges, " "),
+		EmptyTrailing: true,
+	})
 }
 
 func (i *IRCServer) cmdKill(s *Session, reply *Replyctx, msg *irc.Message) {
@@ -916,17 +1719,12 @@ func (i *IRCServer) cmdKill(s *Session, reply *Replyctx, msg *irc.Message) {
 		return
 	}
 
-	if !s.Operator {
-		i.sendUser(s, reply, &irc.Message{
-			Prefix:   i.ServerPrefix,
-			Command:  irc.ERR_NOPRIVILEGES,
-			Params:   []string{s.Nick},
-			Trailing: "Permission Denied - You're not an IRC operator",
-		})
+	if !i.hasPrivilege(s, config.PrivilegeKill) {
+		i.sendNoPrivileges(s, reply, config.PrivilegeKill)
 		return
 	}
 
-	session, ok := i.nicks[NickToLower(msg.Params[0])]
+	session, ok := i.nicks[i.NickToLower(msg.Params[0])]
 	if !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -937,7 +1735,7 @@ func (i *IRCServer) cmdKill(s *Session, reply *Replyctx, msg *irc.Message) {
 		return
 	}
 
-	i.DeleteSession(session, reply.msgid)
+	i.DeleteSession(session, reply)
 
 	i.sendServices(reply,
 		i.sendCommonChannels(session, reply, &irc.Message{
@@ -957,10 +1755,160 @@ func (i *IRCServer) cmdKill(s *Session, reply *Replyctx, msg *irc.Message) {
 		Command:  irc.ERROR,
 		Trailing: fmt.Sprintf("Closing Link: %s[%s] (Killed (%s (%s)))", session.Nick, session.ircPrefix.Host, s.Nick, msg.Trailing),
 	})
+
+	i.sendSnotice(reply, snoKills, fmt.Sprintf("Received KILL message for %s. From %s (%s)",
+		session.Nick, s.Nick, msg.Trailing))
+}
+
+func (i *IRCServer) cmdWallops(s *Session, reply *Replyctx, msg *irc.Message) {
+	if strings.TrimSpace(msg.Trailing) == "" {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.ERR_NEEDMOREPARAMS,
+			Params:   []string{s.Nick, msg.Command},
+			Trailing: "Not enough parameters",
+		})
+		return
+	}
+
+	if !i.hasPrivilege(s, config.PrivilegeWallops) {
+		i.sendNoPrivileges(s, reply, config.PrivilegeWallops)
+		return
+	}
+
+	i.sendServices(reply, i.sendWallops(reply, &s.ircPrefix, msg.Trailing))
+}
+
+// sendWallops sends a WALLOPS message with |text| from |prefix| to all
+// sessions with user mode +w and returns the message.
+func (i *IRCServer) sendWallops(reply *Replyctx, prefix *irc.Prefix, text string) *irc.Message {
+	msg := &irc.Message{
+		Prefix:   prefix,
+		Command:  irc.WALLOPS,
+		Trailing: text,
+	}
+	var nicks []string
+	for nick, session := range i.nicks {
+		if session.modes['w'] && !session.deleted {
+			nicks = append(nicks, string(nick))
+		}
+	}
+	// Sort the recipients so that the output is deterministic.
+	sort.Strings(nicks)
+	for _, nick := range nicks {
+		i.sendUser(i.nicks[lcNick(nick)], reply, msg)
+	}
+	return msg
+}
+
+func (i *IRCServer) cmdKline(s *Session, reply *Replyctx, msg *irc.Message) {
+	if !i.hasPrivilege(s, config.PrivilegeBan) {
+		i.sendNoPrivileges(s, reply, config.PrivilegeBan)
+		return
+	}
+
+	now := time.Unix(0, reply.msgid)
+	// e.g. “KLINE 60 *!*@robust/0x13b5aa0a2bcfb8ad :spamming” for a ban
+	// which expires after 60 minutes, or “KLINE foo :spamming” for a
+	// permanent ban.
+	params := msg.Params
+	var expires time.Time
+	if len(params) > 1 {
+		if minutes, err := strconv.Atoi(params[0]); err == nil {
+			if minutes > 0 {
+				expires = now.Add(time.Duration(minutes) * time.Minute)
+			}
+			params = params[1:]
+		}
+	}
+	reason := strings.TrimSpace(msg.Trailing)
+	if reason == "" {
+		reason = "No reason given"
+	}
+	k := kline{
+		mask:    normalizeMask(params[0]),
+		setBy:   s.ircPrefix.String(),
+		setAt:   now,
+		reason:  reason,
+		expires: expires,
+	}
+
+	duration := "permanent"
+	if !expires.IsZero() {
+		duration = "expires " + expires.UTC().Format(time.RFC1123)
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.NOTICE,
+		Params:   []string{s.Nick},
+		Trailing: fmt.Sprintf("Added K-line for %s (%s): %s", k.mask, duration, reason),
+	})
+	i.sendSnotice(reply, snoBans, fmt.Sprintf("%s added K-line for %s (%s): %s",
+		s.Nick, k.mask, duration, reason))
+	i.addKline(reply, k)
+}
+
+func (i *IRCServer) cmdUnkline(s *Session, reply *Replyctx, msg *irc.Message) {
+	if !i.hasPrivilege(s, config.PrivilegeBan) {
+		i.sendNoPrivileges(s, reply, config.PrivilegeBan)
+		return
+	}
+
+	mask := normalizeMask(msg.Params[0])
+	i.expireKlines(time.Unix(0, reply.msgid))
+	text := "Removed K-line for " + mask
+	if i.removeKline(mask) {
+		i.sendSnotice(reply, snoBans, fmt.Sprintf("%s removed K-line for %s", s.Nick, mask))
+	} else {
+		text = "No K-line for " + mask
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.NOTICE,
+		Params:   []string{s.Nick},
+		Trailing: text,
+	})
+}
+
+func (i *IRCServer) cmdStats(s *Session, reply *Replyctx, msg *irc.Message) {
+	query := msg.Params[0]
+	switch query {
+	case "k", "K", "g", "G":
+		if !i.hasPrivilege(s, config.PrivilegeBan) {
+			i.sendNoPrivileges(s, reply, config.PrivilegeBan)
+			return
+		}
+		i.expireKlines(time.Unix(0, reply.msgid))
+		for _, k := range i.klines {
+			var expires int64
+			if !k.expires.IsZero() {
+				expires = k.expires.Unix()
+			}
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   i.ServerPrefix,
+				Command:  irc.RPL_STATSKLINE,
+				Params:   []string{s.Nick, "K", k.mask, strconv.FormatInt(expires, 10), k.setBy},
+				Trailing: k.reason,
+			})
+		}
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.RPL_ENDOFSTATS,
+		Params:   []string{s.Nick, query},
+		Trailing: "End of /STATS report",
+	})
 }
 
 func (i *IRCServer) cmdAway(s *Session, reply *Replyctx, msg *irc.Message) {
 	s.AwayMsg = strings.TrimSpace(msg.Trailing)
+	if len(s.Channels) > 0 {
+		i.sendCommonChannels(s, reply, &irc.Message{
+			Prefix:   &s.ircPrefix,
+			Command:  irc.AWAY,
+			Trailing: s.AwayMsg,
+		})
+	}
 	if s.AwayMsg != "" {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -980,7 +1928,7 @@ func (i *IRCServer) cmdAway(s *Session, reply *Replyctx, msg *irc.Message) {
 
 func (i *IRCServer) cmdTopic(s *Session, reply *Replyctx, msg *irc.Message) {
 	channel := msg.Params[0]
-	c, ok := i.channels[ChanToLower(channel)]
+	c, ok := i.channels[i.ChanToLower(channel)]
 	if !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -1014,7 +1962,7 @@ func (i *IRCServer) cmdTopic(s *Session, reply *Replyctx, msg *irc.Message) {
 		return
 	}
 
-	if !s.Channels[ChanToLower(channel)] {
+	if !s.Channels[i.ChanToLower(channel)] {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_NOTONCHANNEL,
@@ -1054,7 +2002,7 @@ func (i *IRCServer) cmdTopic(s *Session, reply *Replyctx, msg *irc.Message) {
 		return
 	}
 
-	if c.modes['t'] && !c.nicks[NickToLower(s.Nick)][chanop] {
+	if c.modes['t'] && !c.nicks[i.NickToLower(s.Nick)][chanop] {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_CHANOPRIVSNEEDED,
@@ -1089,18 +2037,168 @@ func (i *IRCServer) cmdMotd(s *Session, reply *Replyctx, msg *irc.Message) {
 		Params:   []string{s.Nick},
 		Trailing: "- " + i.ServerPrefix.Name + " Message of the day -",
 	})
-	// TODO(secure): make motd configurable
+	var lines []string
+	if i.Config.NetworkDescription != "" {
+		lines = append(lines, i.Config.NetworkDescription)
+	}
+	if motd := strings.TrimRight(i.Config.MOTD, "\r\n"); motd != "" {
+		for _, line := range strings.Split(motd, "\n") {
+			lines = append(lines, strings.TrimSuffix(line, "\r"))
+		}
+	}
+	if len(lines) == 0 {
+		lines = []string{"No MOTD configured yet."}
+	}
+	for _, line := range lines {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.RPL_MOTD,
+			Params:   []string{s.Nick},
+			Trailing: "- " + line,
+		})
+	}
 	i.sendUser(s, reply, &irc.Message{
 		Prefix:   i.ServerPrefix,
-		Command:  irc.RPL_MOTD,
+		Command:  irc.RPL_ENDOFMOTD,
 		Params:   []string{s.Nick},
-		Trailing: "- No MOTD configured yet.",
+		Trailing: "End of MOTD command",
 	})
+}
+
+func (i *IRCServer) cmdLusers(s *Session, reply *Replyctx, msg *irc.Message) {
+	var users, invisible, operators, unknown int
+	for _, session := range i.sessions {
+		if session.Server {
+			continue
+		}
+		if !session.loggedIn() {
+			unknown++
+			continue
+		}
+		users++
+		if session.modes['i'] {
+			invisible++
+		}
+		if session.Operator {
+			operators++
+		}
+	}
 	i.sendUser(s, reply, &irc.Message{
 		Prefix:   i.ServerPrefix,
-		Command:  irc.RPL_ENDOFMOTD,
+		Command:  irc.RPL_LUSERCLIENT,
 		Params:   []string{s.Nick},
-		Trailing: "End of MOTD command",
+		Trailing: fmt.Sprintf("There are %d users and %d invisible on 1 servers", users-invisible, invisible),
+	})
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.RPL_LUSEROP,
+		Params:   []string{s.Nick, strconv.Itoa(operators)},
+		Trailing: "operator(s) online",
+	})
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.RPL_LUSERUNKNOWN,
+		Params:   []string{s.Nick, strconv.Itoa(unknown)},
+		Trailing: "unknown connection(s)",
+	})
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.RPL_LUSERCHANNELS,
+		Params:   []string{s.Nick, strconv.Itoa(len(i.channels))},
+		Trailing: "channels formed",
+	})
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.RPL_LUSERME,
+		Params:   []string{s.Nick},
+		Trailing: fmt.Sprintf("I have %d clients and 1 servers", users),
+	})
+}
+
+func (i *IRCServer) cmdVersion(s *Session, reply *Replyctx, msg *irc.Message) {
+	// The build version of the server is not included: it differs between
+	// servers (e.g. during a rolling update) and when replaying.
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.RPL_VERSION,
+		Params:   []string{s.Nick, "RobustIRC", i.ServerPrefix.Name},
+		Trailing: "https://robustirc.net/",
+	})
+	i.sendIsupport(s, reply)
+}
+
+func (i *IRCServer) cmdTime(s *Session, reply *Replyctx, msg *irc.Message) {
+	// The time is derived from the message id (instead of the wall clock) so
+	// that the reply is identical on every server and when replaying.
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.RPL_TIME,
+		Params:   []string{s.Nick, i.ServerPrefix.Name},
+		Trailing: time.Unix(0, reply.msgid).UTC().Format(time.RFC1123),
+	})
+}
+
+func (i *IRCServer) cmdAdmin(s *Session, reply *Replyctx, msg *irc.Message) {
+	admin := i.Config.Admin
+	if admin.Name == "" && admin.Location == "" && admin.Email == "" {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.ERR_NOADMININFO,
+			Params:   []string{s.Nick, i.ServerPrefix.Name},
+			Trailing: "No administrative info available",
+		})
+		return
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.RPL_ADMINME,
+		Params:   []string{s.Nick, i.ServerPrefix.Name},
+		Trailing: "Administrative info",
+	})
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:        i.ServerPrefix,
+		Command:       irc.RPL_ADMINLOC1,
+		Params:        []string{s.Nick},
+		Trailing:      admin.Location,
+		EmptyTrailing: true,
+	})
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:        i.ServerPrefix,
+		Command:       irc.RPL_ADMINLOC2,
+		Params:        []string{s.Nick},
+		Trailing:      admin.Name,
+		EmptyTrailing: true,
+	})
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:        i.ServerPrefix,
+		Command:       irc.RPL_ADMINEMAIL,
+		Params:        []string{s.Nick},
+		Trailing:      admin.Email,
+		EmptyTrailing: true,
+	})
+}
+
+func (i *IRCServer) cmdInfo(s *Session, reply *Replyctx, msg *irc.Message) {
+	lines := []string{"RobustIRC"}
+	if i.Config.NetworkDescription != "" {
+		lines = append(lines, i.Config.NetworkDescription)
+	}
+	lines = append(lines,
+		"https://robustirc.net/",
+		"This server was created "+i.ServerCreation.UTC().String())
+	for _, line := range lines {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.RPL_INFO,
+			Params:   []string{s.Nick},
+			Trailing: line,
+		})
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.RPL_ENDOFINFO,
+		Params:   []string{s.Nick},
+		Trailing: "End of /INFO list",
 	})
 }
 
@@ -1119,22 +2217,32 @@ func (i *IRCServer) cmdPass(s *Session, reply *Replyctx, msg *irc.Message) {
 	// network= for authenticating to a private network (not yet implemented)
 	// nickserv= for authenticating to services
 	// oper= for authenticating as an IRC operator
+	s.Pass = passOf(msg)
+	// The services= and oper= passwords were verified before applying the
+	// message, see VerifyCredentials.
+	s.passCredentials = reply.credentials
+}
+
+// passOf returns the password which the PASS message |msg| sets, see cmdPass.
+func passOf(msg *irc.Message) string {
+	var pass string
 	if len(msg.Params) > 0 {
-		s.Pass = strings.Join(msg.Params, " ")
+		pass = strings.Join(msg.Params, " ")
 	} else {
-		s.Pass = msg.Trailing
+		pass = msg.Trailing
 	}
-	if !strings.HasPrefix(s.Pass, "nickserv=") &&
-		!strings.HasPrefix(s.Pass, "services=") &&
-		!strings.HasPrefix(s.Pass, "network=") &&
-		!strings.HasPrefix(s.Pass, "oper=") &&
-		!strings.HasPrefix(s.Pass, "session=") {
-		s.Pass = "nickserv=" + s.Pass
+	if !strings.HasPrefix(pass, "nickserv=") &&
+		!strings.HasPrefix(pass, "services=") &&
+		!strings.HasPrefix(pass, "network=") &&
+		!strings.HasPrefix(pass, "oper=") &&
+		!strings.HasPrefix(pass, "session=") {
+		pass = "nickserv=" + pass
 	}
+	return pass
 }
 
 func (i *IRCServer) cmdWhois(s *Session, reply *Replyctx, msg *irc.Message) {
-	session, ok := i.nicks[NickToLower(msg.Params[0])]
+	session, ok := i.nicks[i.NickToLower(msg.Params[0])]
 	if !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -1155,15 +2263,11 @@ func (i *IRCServer) cmdWhois(s *Session, reply *Replyctx, msg *irc.Message) {
 
 	var channels []string
 	for channel := range session.Channels {
-		var prefix string
 		c := i.channels[channel]
-		if c.modes['s'] && !s.Operator && !s.Channels[channel] {
+		if c.modes['s'] && !i.hasPrivilege(s, config.PrivilegeSeeSecret) && !s.Channels[channel] {
 			continue
 		}
-		if c.nicks[NickToLower(session.Nick)][chanop] {
-			prefix = "@"
-		}
-		channels = append(channels, prefix+c.name)
+		channels = append(channels, memberPrefixFor(s, c.nicks[i.NickToLower(session.Nick)])+c.name)
 	}
 
 	sort.Strings(channels)
@@ -1221,11 +2325,60 @@ func (i *IRCServer) cmdWhois(s *Session, reply *Replyctx, msg *irc.Message) {
 	})
 }
 
+func (i *IRCServer) cmdWhowas(s *Session, reply *Replyctx, msg *irc.Message) {
+	var count int
+	if len(msg.Params) > 1 {
+		count, _ = strconv.Atoi(msg.Params[1])
+	}
+	entries := i.whowas.all()
+	for _, nick := range strings.Split(msg.Params[0], ",") {
+		found := 0
+		// Iterate backwards so that the most recent entries are returned first.
+		for idx := len(entries) - 1; idx >= 0; idx-- {
+			entry := entries[idx]
+			if i.NickToLower(entry.nick) != i.NickToLower(nick) {
+				continue
+			}
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:        i.ServerPrefix,
+				Command:       irc.RPL_WHOWASUSER,
+				Params:        []string{s.Nick, entry.nick, entry.username, entry.host, "*"},
+				Trailing:      entry.realname,
+				EmptyTrailing: true,
+			})
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   i.ServerPrefix,
+				Command:  irc.RPL_WHOISSERVER,
+				Params:   []string{s.Nick, entry.nick, i.ServerPrefix.Name},
+				Trailing: entry.signoff.UTC().Format(time.RFC1123),
+			})
+			found++
+			if count > 0 && found >= count {
+				break
+			}
+		}
+		if found == 0 {
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   i.ServerPrefix,
+				Command:  irc.ERR_WASNOSUCHNICK,
+				Params:   []string{s.Nick, nick},
+				Trailing: "There was no such nickname",
+			})
+		}
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.RPL_ENDOFWHOWAS,
+			Params:   []string{s.Nick, nick},
+			Trailing: "End of WHOWAS",
+		})
+	}
+}
+
 func (i *IRCServer) cmdList(s *Session, reply *Replyctx, msg *irc.Message) {
 	channels := make([]string, 0, len(i.channels))
 	if len(msg.Params) > 0 {
 		for _, channel := range strings.Split(msg.Params[0], ",") {
-			channelname := ChanToLower(strings.TrimSpace(channel))
+			channelname := i.ChanToLower(strings.TrimSpace(channel))
 			if _, ok := i.channels[channelname]; ok {
 				channels = append(channels, string(channelname))
 			}
@@ -1238,7 +2391,7 @@ func (i *IRCServer) cmdList(s *Session, reply *Replyctx, msg *irc.Message) {
 	}
 	for _, channel := range channels {
 		c := i.channels[lcChan(channel)]
-		if c.modes['s'] && !s.Operator && !s.Channels[lcChan(channel)] {
+		if c.modes['s'] && !i.hasPrivilege(s, config.PrivilegeSeeSecret) && !s.Channels[lcChan(channel)] {
 			continue
 		}
 		i.sendUser(s, reply, &irc.Message{
@@ -1261,7 +2414,7 @@ func (i *IRCServer) cmdList(s *Session, reply *Replyctx, msg *irc.Message) {
 func (i *IRCServer) cmdInvite(s *Session, reply *Replyctx, msg *irc.Message) {
 	nickname := msg.Params[0]
 	channelname := msg.Params[1]
-	c, ok := i.channels[ChanToLower(channelname)]
+	c, ok := i.channels[i.ChanToLower(channelname)]
 	if !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -1271,7 +2424,7 @@ func (i *IRCServer) cmdInvite(s *Session, reply *Replyctx, msg *irc.Message) {
 		})
 		return
 	}
-	if _, ok := c.nicks[NickToLower(s.Nick)]; !ok {
+	if _, ok := c.nicks[i.NickToLower(s.Nick)]; !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_NOTONCHANNEL,
@@ -1280,7 +2433,7 @@ func (i *IRCServer) cmdInvite(s *Session, reply *Replyctx, msg *irc.Message) {
 		})
 		return
 	}
-	session, ok := i.nicks[NickToLower(nickname)]
+	session, ok := i.nicks[i.NickToLower(nickname)]
 	if !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -1290,7 +2443,7 @@ func (i *IRCServer) cmdInvite(s *Session, reply *Replyctx, msg *irc.Message) {
 		})
 		return
 	}
-	if _, ok := c.nicks[NickToLower(nickname)]; ok {
+	if _, ok := c.nicks[i.NickToLower(nickname)]; ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_USERONCHANNEL,
@@ -1299,7 +2452,7 @@ func (i *IRCServer) cmdInvite(s *Session, reply *Replyctx, msg *irc.Message) {
 		})
 		return
 	}
-	if c.modes['i'] && !c.nicks[NickToLower(s.Nick)][chanop] {
+	if c.modes['i'] && !c.nicks[i.NickToLower(s.Nick)][chanop] {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_CHANOPRIVSNEEDED,
@@ -1308,7 +2461,7 @@ func (i *IRCServer) cmdInvite(s *Session, reply *Replyctx, msg *irc.Message) {
 		})
 		return
 	}
-	session.invitedTo[ChanToLower(channelname)] = true
+	session.invitedTo[i.ChanToLower(channelname)] = true
 	i.sendUser(s, reply, &irc.Message{
 		Prefix:  i.ServerPrefix,
 		Command: irc.RPL_INVITING,
@@ -1341,7 +2494,7 @@ func (i *IRCServer) cmdInvite(s *Session, reply *Replyctx, msg *irc.Message) {
 func (i *IRCServer) cmdUserhost(s *Session, reply *Replyctx, msg *irc.Message) {
 	var userhosts []string
 	for _, nickname := range msg.Params {
-		session, ok := i.nicks[NickToLower(nickname)]
+		session, ok := i.nicks[i.NickToLower(nickname)]
 		if !ok {
 			continue
 		}
@@ -1364,6 +2517,33 @@ func (i *IRCServer) cmdUserhost(s *Session, reply *Replyctx, msg *irc.Message) {
 	})
 }
 
+func (i *IRCServer) cmdIson(s *Session, reply *Replyctx, msg *irc.Message) {
+	// Clients send the nicknames as parameters, as trailing parameter or both.
+	nicknames := append(append([]string{}, msg.Params...), strings.Fields(msg.Trailing)...)
+	if len(nicknames) == 0 {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.ERR_NEEDMOREPARAMS,
+			Params:   []string{s.Nick, irc.ISON},
+			Trailing: "Not enough parameters",
+		})
+		return
+	}
+	var online []string
+	for _, nickname := range nicknames {
+		if session, ok := i.nicks[i.NickToLower(nickname)]; ok {
+			online = append(online, session.Nick)
+		}
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:        i.ServerPrefix,
+		Command:       irc.RPL_ISON,
+		Params:        []string{s.Nick},
+		Trailing:      strings.Join(online, " "),
+		EmptyTrailing: true,
+	})
+}
+
 func (i *IRCServer) cmdServiceAlias(s *Session, reply *Replyctx, msg *irc.Message) {
 	aliases := map[string]string{
 		"NICKSERV": "PRIVMSG NickServ :",
@@ -1391,14 +2571,19 @@ func (i *IRCServer) cmdServiceAlias(s *Session, reply *Replyctx, msg *irc.Messag
 func (i *IRCServer) cmdNames(s *Session, reply *Replyctx, msg *irc.Message) {
 	if len(msg.Params) > 0 {
 		channelname := msg.Params[0]
-		if c, ok := i.channels[ChanToLower(channelname)]; ok {
+		if c, ok := i.channels[i.ChanToLower(channelname)]; ok {
+			// Users with user mode +i are only visible to channel members.
+			_, isMember := c.nicks[i.NickToLower(s.Nick)]
 			nicks := make([]string, 0, len(c.nicks))
 			for nick, perms := range c.nicks {
-				var prefix string
-				if perms[chanop] {
-					prefix = prefix + string('@')
+				if !isMember && i.nicks[nick].modes['i'] {
+					continue
 				}
-				nicks = append(nicks, prefix+i.nicks[nick].Nick)
+				name := i.nicks[nick].Nick
+				if s.capabilities["userhost-in-names"] {
+					name = i.nicks[nick].ircPrefix.String()
+				}
+				nicks = append(nicks, memberPrefixFor(s, perms)+name)
 			}
 
 			sort.Strings(nicks)
@@ -1429,7 +2614,7 @@ func (i *IRCServer) cmdNames(s *Session, reply *Replyctx, msg *irc.Message) {
 
 func (i *IRCServer) cmdKnock(s *Session, reply *Replyctx, msg *irc.Message) {
 	channelname := msg.Params[0]
-	c, ok := i.channels[ChanToLower(channelname)]
+	c, ok := i.channels[i.ChanToLower(channelname)]
 	if !ok {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -1471,3 +2656,171 @@ func (i *IRCServer) cmdKnock(s *Session, reply *Replyctx, msg *irc.Message) {
 		Trailing: fmt.Sprintf("Knocked on %s", c.name),
 	})
 }
+
+func (i *IRCServer) cmdChathistory(s *Session, reply *Replyctx, msg *irc.Message) {
+	limit := i.Config.ChatHistoryLimit
+	if limit <= 0 {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.ERR_UNKNOWNCOMMAND,
+			Params:   []string{s.Nick, msg.Command},
+			Trailing: "Unknown command",
+		})
+		return
+	}
+
+	params := msg.Params
+	if msg.Trailing != "" {
+		params = append(params, msg.Trailing)
+	}
+	subcommand := strings.ToUpper(params[0])
+	fail := func(code string, context []string, description string) {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  "FAIL",
+			Params:   append([]string{"CHATHISTORY", code}, context...),
+			Trailing: description,
+		})
+	}
+
+	numRefs := 1
+	switch subcommand {
+	case "LATEST", "BEFORE", "AFTER", "AROUND":
+	case "BETWEEN":
+		numRefs = 2
+	default:
+		fail("UNKNOWN_COMMAND", []string{params[0]}, "Unknown command")
+		return
+	}
+	if len(params) < 3+numRefs {
+		fail("INVALID_PARAMS", []string{subcommand}, "Not enough parameters")
+		return
+	}
+
+	target := params[1]
+	if strings.HasPrefix(target, "#") {
+		// Only members can retrieve the history, since the channel might
+		// be secret, invite-only, keyed or ban |s|.
+		c, ok := i.channels[i.ChanToLower(target)]
+		if ok {
+			_, ok = c.nicks[i.NickToLower(s.Nick)]
+		}
+		if !ok {
+			fail("INVALID_TARGET", []string{subcommand, target}, "Messages could not be retrieved")
+			return
+		}
+	} else if !i.isValidNickname(target) {
+		fail("INVALID_TARGET", []string{subcommand, target}, "Messages could not be retrieved")
+		return
+	}
+
+	var refs []types.RobustId
+	for _, param := range params[2 : 2+numRefs] {
+		if subcommand == "LATEST" && param == "*" {
+			refs = append(refs, types.RobustId{})
+			continue
+		}
+		ref, ok := parseHistoryRef(param)
+		if !ok {
+			fail("INVALID_PARAMS", []string{subcommand, param}, "Invalid message reference")
+			return
+		}
+		refs = append(refs, ref)
+	}
+
+	n, err := strconv.Atoi(params[2+numRefs])
+	if err != nil || n < 1 {
+		fail("INVALID_PARAMS", []string{subcommand, params[2+numRefs]}, "Invalid limit")
+		return
+	}
+	if n > limit {
+		n = limit
+	}
+
+	// The response depends on the outputstream, which differs between
+	// servers, so it must not be part of the replicated output. Instead, a
+	// placeholder with the normalized request is sent, which ExpandHistory
+	// replaces when delivering it to |s|.
+	request := []string{subcommand, target}
+	for idx, ref := range refs {
+		if ref == (types.RobustId{}) && params[2+idx] == "*" {
+			request = append(request, "*")
+		} else {
+			request = append(request, "msgid="+ref.String())
+		}
+	}
+	robustmsg := i.send(reply, &irc.Message{
+		Command: "CHATHISTORY",
+		Params:  append(request, strconv.Itoa(n)),
+	})
+	robustmsg.InterestingFor[s.Id.Id] = true
+	robustmsg.History = true
+}
+
+func (i *IRCServer) cmdMonitor(s *Session, reply *Replyctx, msg *irc.Message) {
+	// The targets are usually sent as trailing parameter, e.g.
+	// “MONITOR + :sECuRE,mero”.
+	var targets []string
+	if len(msg.Params) > 1 {
+		targets = strings.Split(msg.Params[1], ",")
+	} else if msg.Trailing != "" {
+		targets = strings.Split(msg.Trailing, ",")
+	}
+
+	switch msg.Params[0] {
+	case "+":
+		var added []string
+		for idx, target := range targets {
+			if _, ok := s.monitored[i.NickToLower(target)]; ok || !i.isValidNickname(target) {
+				continue
+			}
+			if len(s.monitored) >= maxMonitorTargets {
+				i.sendUser(s, reply, &irc.Message{
+					Prefix:   i.ServerPrefix,
+					Command:  "734", // ERR_MONLISTFULL
+					Params:   []string{s.Nick, strconv.Itoa(maxMonitorTargets), strings.Join(targets[idx:], ",")},
+					Trailing: "Monitor list is full.",
+				})
+				break
+			}
+			s.monitored[i.NickToLower(target)] = target
+			added = append(added, target)
+		}
+		i.sendMonitorStatus(s, reply, added)
+
+	case "-":
+		for _, target := range targets {
+			delete(s.monitored, i.NickToLower(target))
+		}
+
+	case "C", "c":
+		s.monitored = make(map[lcNick]string)
+
+	case "L", "l":
+		if targets := monitorTargets(s); len(targets) > 0 {
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   i.ServerPrefix,
+				Command:  "732", // RPL_MONLIST
+				Params:   []string{s.Nick},
+				Trailing: strings.Join(targets, ","),
+			})
+		}
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  "733", // RPL_ENDOFMONLIST
+			Params:   []string{s.Nick},
+			Trailing: "End of MONITOR list",
+		})
+
+	case "S", "s":
+		i.sendMonitorStatus(s, reply, monitorTargets(s))
+
+	default:
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.ERR_NEEDMOREPARAMS,
+			Params:   []string{s.Nick, "MONITOR"},
+			Trailing: "Not enough parameters",
+		})
+	}
+}
@@ -44,6 +44,35 @@ func TestNormalizeModes(t *testing.T) {
 				{Mode: "+b", Param: ""},
 			},
 		},
+		{
+			Input: irc.ParseMessage("MODE #chan +b-e foo!*@* bar"),
+			Want: []modeCmd{
+				{Mode: "+b", Param: "foo!*@*"},
+				{Mode: "-e", Param: "bar"},
+			},
+		},
+		{
+			Input: irc.ParseMessage("MODE #chan +kl secret 5"),
+			Want: []modeCmd{
+				{Mode: "+k", Param: "secret"},
+				{Mode: "+l", Param: "5"},
+			},
+		},
+		{
+			Input: irc.ParseMessage("MODE #chan +mhv foo bar"),
+			Want: []modeCmd{
+				{Mode: "+m", Param: ""},
+				{Mode: "+h", Param: "foo"},
+				{Mode: "+v", Param: "bar"},
+			},
+		},
+		{
+			Input: irc.ParseMessage("MODE #chan -lk secret"),
+			Want: []modeCmd{
+				{Mode: "-l", Param: ""},
+				{Mode: "-k", Param: "secret"},
+			},
+		},
 		{
 			Input: irc.ParseMessage("MODE #chan +x"),
 			Want: []modeCmd{
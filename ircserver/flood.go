@@ -0,0 +1,318 @@
+package ircserver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// Kinds of floods which channel mode +f protects against.
+const (
+	floodJoins    = 'j' // joins into the channel, counted for the channel
+	floodMessages = 'm' // messages to the channel, counted per user
+	floodNicks    = 'n' // nick changes, counted per user
+)
+
+// floodKinds contains all kinds of floods, in the order in which they appear
+// in the parameter of channel mode +f.
+const floodKinds = "jmn"
+
+// Actions which are taken once a flood limit is exceeded.
+const (
+	floodActionBan      = 'b' // temporary quiet ban (+b *!*@host) on the offending user
+	floodActionKick     = 'k' // kick the offending user
+	floodActionModerate = 'm' // temporarily moderate the channel (+m)
+)
+
+// defaultFloodActions maps each kind of flood to the action which is taken if
+// the parameter of +f does not specify one.
+var defaultFloodActions = map[byte]byte{
+	floodJoins:    floodActionModerate,
+	floodMessages: floodActionKick,
+	floodNicks:    floodActionKick,
+}
+
+// floodLockDuration is how long a channel stays moderated after flood
+// protection set +m, and how long a ban which flood protection set stays in
+// place. Since session hosts are unique, the ban only affects the offending
+// session, so it does not need to stay longer.
+const floodLockDuration = 1 * time.Minute
+
+// Bounds for the parameter of channel mode +f.
+const (
+	maxFloodLimit  = 1000
+	maxFloodWindow = 3600 // seconds
+)
+
+type floodRule struct {
+	limit  int
+	action byte
+}
+
+// floodSettings is the parsed parameter of channel mode +f, e.g.
+// “5j#m,10m#k,3n#b:15”: at most 5 joins, 10 messages per user and 3 nick
+// changes per user within 15 seconds.
+type floodSettings struct {
+	rules  map[byte]floodRule
+	window time.Duration
+}
+
+// parseFloodSettings parses |param|, which has the format
+// “<limit><kind>[#<action>][,…]:<seconds>”. It returns false if |param| is
+// invalid.
+func parseFloodSettings(param string) (floodSettings, bool) {
+	var settings floodSettings
+	idx := strings.LastIndexByte(param, ':')
+	if idx == -1 {
+		return settings, false
+	}
+	seconds, err := strconv.Atoi(param[idx+1:])
+	if err != nil || seconds < 1 || seconds > maxFloodWindow {
+		return settings, false
+	}
+	settings.window = time.Duration(seconds) * time.Second
+	settings.rules = make(map[byte]floodRule)
+	for _, entry := range strings.Split(param[:idx], ",") {
+		var action byte
+		if hash := strings.IndexByte(entry, '#'); hash > -1 {
+			if len(entry) != hash+2 {
+				return settings, false
+			}
+			action = entry[hash+1]
+			entry = entry[:hash]
+		}
+		if len(entry) < 2 {
+			return settings, false
+		}
+		kind := entry[len(entry)-1]
+		limit, err := strconv.Atoi(entry[:len(entry)-1])
+		if err != nil || limit < 1 || limit > maxFloodLimit {
+			return settings, false
+		}
+		if !strings.ContainsRune(floodKinds, rune(kind)) {
+			return settings, false
+		}
+		if _, ok := settings.rules[kind]; ok {
+			return settings, false
+		}
+		switch action {
+		case 0:
+			action = defaultFloodActions[kind]
+		case floodActionBan, floodActionKick, floodActionModerate:
+		default:
+			return settings, false
+		}
+		settings.rules[kind] = floodRule{limit: limit, action: action}
+	}
+	return settings, true
+}
+
+// String returns the canonical parameter of channel mode +f for |f|.
+func (f floodSettings) String() string {
+	var rules []string
+	for _, kind := range []byte(floodKinds) {
+		if rule, ok := f.rules[kind]; ok {
+			rules = append(rules, fmt.Sprintf("%d%c#%c", rule.limit, kind, rule.action))
+		}
+	}
+	return fmt.Sprintf("%s:%d", strings.Join(rules, ","), int(f.window/time.Second))
+}
+
+// floodKey identifies a floodCounter of a channel. session is 0 for kinds of
+// floods which are counted for the channel as a whole.
+type floodKey struct {
+	kind    byte
+	session int64
+}
+
+// floodCounter counts the events of one floodKey within the window which
+// started at |start|.
+type floodCounter struct {
+	start time.Time
+	count int
+}
+
+// setFlood applies the +f |mode| to |c| and returns the parameter which should
+// be broadcast. It returns false if the parameter is missing or invalid, in
+// which case |c| is not modified.
+func (c *channel) setFlood(mode modeCmd) (string, bool) {
+	if mode.Mode[0] == '-' {
+		c.modes['f'] = false
+		c.flood = floodSettings{}
+		c.floodCounters = nil
+		return "", true
+	}
+	settings, ok := parseFloodSettings(mode.Param)
+	if !ok {
+		return "", false
+	}
+	c.flood = settings
+	c.floodCounters = nil
+	c.modes['f'] = true
+	return settings.String(), true
+}
+
+// countFlood counts an event of |kind| by |s| in |c| at |now| and returns the
+// action to take, or 0 if the flood limit of |c| was not exceeded. Channel
+// operators and half operators are exempt.
+//
+// The counters use fixed windows which start at the first counted event.
+// Since |now| is derived from the message id, the result is the same on every
+// server and when replaying the raft log.
+func (c *channel) countFlood(kind byte, s *Session, perms *[maxChanMemberStatus]bool, now time.Time) byte {
+	rule, ok := c.flood.rules[kind]
+	if !c.modes['f'] || !ok || hasStatus(perms, "%") {
+		return 0
+	}
+	// Drop expired counters so that the map does not grow unbounded.
+	for key, counter := range c.floodCounters {
+		if !now.Before(counter.start.Add(c.flood.window)) {
+			delete(c.floodCounters, key)
+		}
+	}
+	key := floodKey{kind: kind}
+	if kind != floodJoins {
+		key.session = s.Id.Id
+	}
+	if c.floodCounters == nil {
+		c.floodCounters = make(map[floodKey]*floodCounter)
+	}
+	counter, ok := c.floodCounters[key]
+	if !ok {
+		counter = &floodCounter{start: now}
+		c.floodCounters[key] = counter
+	}
+	counter.count++
+	if counter.count <= rule.limit {
+		return 0
+	}
+	delete(c.floodCounters, key)
+	return rule.action
+}
+
+// floodKindNames are used in server notices and kick messages.
+var floodKindNames = map[byte]string{
+	floodJoins:    "joins",
+	floodMessages: "messages",
+	floodNicks:    "nick changes",
+}
+
+// checkFlood counts an event of |kind| by |s| in |c| and takes the configured
+// action if the flood limit is exceeded. It returns true if |s| was kicked or
+// banned, in which case the event (e.g. a message) should be dropped.
+func (i *IRCServer) checkFlood(c *channel, s *Session, reply *Replyctx, kind byte) bool {
+	perms := c.nicks[i.NickToLower(s.Nick)]
+	now := time.Unix(0, reply.msgid)
+	action := c.countFlood(kind, s, perms, now)
+	if action == 0 {
+		return false
+	}
+	rule := c.flood.rules[kind]
+	reason := fmt.Sprintf("Flood protection: more than %d %s in %d seconds",
+		rule.limit, floodKindNames[kind], int(c.flood.window/time.Second))
+
+	switch action {
+	case floodActionModerate:
+		if !c.modes['m'] {
+			c.modes['m'] = true
+			c.floodLockExpires = now.Add(floodLockDuration)
+			i.sendServices(reply,
+				i.sendChannel(c, reply, &irc.Message{
+					Prefix:  i.ServerPrefix,
+					Command: irc.MODE,
+					Params:  []string{c.name, "+m"},
+				}))
+		}
+		i.sendSnotice(reply, snoFlood, fmt.Sprintf("%s triggered flood protection in %s (%s), channel moderated",
+			s.Nick, c.name, floodKindNames[kind]))
+		return false
+
+	case floodActionBan:
+		mask := "*!*@" + s.ircPrefix.Host
+		if _, changed := i.setMaskMode(c, modeCmd{Mode: "+b", Param: mask}, i.ServerPrefix.Name, reply); changed {
+			// setMaskMode appended the ban, which liftFloodLock removes
+			// again. A ban which was already set stays in place.
+			c.bans[len(c.bans)-1].expires = now.Add(floodLockDuration)
+			i.sendServices(reply,
+				i.sendChannel(c, reply, &irc.Message{
+					Prefix:  i.ServerPrefix,
+					Command: irc.MODE,
+					Params:  []string{c.name, "+b", mask},
+				}))
+		}
+		i.sendSnotice(reply, snoFlood, fmt.Sprintf("%s triggered flood protection in %s (%s), banned %s",
+			s.Nick, c.name, floodKindNames[kind], mask))
+		return true
+
+	case floodActionKick:
+		if perms != nil {
+			i.sendServices(reply,
+				i.sendChannel(c, reply, &irc.Message{
+					Prefix:   i.ServerPrefix,
+					Command:  irc.KICK,
+					Params:   []string{c.name, s.Nick},
+					Trailing: reason,
+				}))
+			delete(c.nicks, i.NickToLower(s.Nick))
+			delete(s.Channels, i.ChanToLower(c.name))
+			i.maybeDeleteChannel(c)
+		}
+		i.sendSnotice(reply, snoFlood, fmt.Sprintf("%s triggered flood protection in %s (%s), kicked",
+			s.Nick, c.name, floodKindNames[kind]))
+		return true
+	}
+	return false
+}
+
+// liftFloodLock removes the +m and the bans which flood protection set on |c|
+// once floodLockDuration has passed. It is called whenever |c| is used, so that
+// the time of the current message decides, which keeps the result
+// deterministic.
+func (i *IRCServer) liftFloodLock(c *channel, reply *Replyctx) {
+	now := time.Unix(0, reply.msgid)
+	var lifted modeCmds
+	if !c.floodLockExpires.IsZero() && !now.Before(c.floodLockExpires) {
+		c.floodLockExpires = time.Time{}
+		if c.modes['m'] {
+			c.modes['m'] = false
+			lifted = append(lifted, modeCmd{Mode: "-m"})
+		}
+	}
+	bans := c.bans[:0]
+	for _, entry := range c.bans {
+		if !entry.expires.IsZero() && !now.Before(entry.expires) {
+			lifted = append(lifted, modeCmd{Mode: "-b", Param: entry.mask})
+			continue
+		}
+		bans = append(bans, entry)
+	}
+	c.bans = bans
+	if len(lifted) == 0 {
+		return
+	}
+	i.sendServices(reply,
+		i.sendChannel(c, reply, &irc.Message{
+			Prefix:  i.ServerPrefix,
+			Command: irc.MODE,
+			Params:  append([]string{c.name}, lifted.IRCParams()...),
+		}))
+}
+
+// checkNickFlood applies flood protection for the nick change of |s| in all
+// channels |s| is in, in sorted order.
+func (i *IRCServer) checkNickFlood(s *Session, reply *Replyctx) {
+	channelnames := make([]string, 0, len(s.Channels))
+	for channelname := range s.Channels {
+		channelnames = append(channelnames, string(channelname))
+	}
+	sort.Strings(channelnames)
+	for _, channelname := range channelnames {
+		if c, ok := i.channels[lcChan(channelname)]; ok {
+			i.checkFlood(c, s, reply, floodNicks)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"log"
 	"math"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -66,19 +67,29 @@ var (
 		},
 		[]string{"command"},
 	)
+
+	spamFilterMatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "irc",
+			Name:      "spam_filter_matches",
+			Help:      "Number of spam filter matches by rule, target and action",
+		},
+		[]string{"rule", "target", "action"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(messagesProcessed)
+	prometheus.MustRegister(spamFilterMatches)
 }
 
 // lcChan is a lower-case channel name, e.g. “#chaos-hd”, even when the user
-// sent “JOIN #Chaos-HD”. It is used to enforce using ChanToLower() on keys of
+// sent “JOIN #Chaos-HD”. It is used to enforce using i.ChanToLower() on keys of
 // various maps.
 type lcChan string
 
 // lcNick is a lower-case nickname, e.g. “secure”, even when the user sent
-// “NICK sECuRE”. It is used to enforce using NickToLower() on keys of various
+// “NICK sECuRE”. It is used to enforce using i.NickToLower() on keys of various
 // maps.
 type lcNick string
 
@@ -93,6 +104,14 @@ type Session struct {
 	Operator     bool
 	AwayMsg      string
 
+	// operName is the name of the config.IRCOp which the session used in
+	// OPER. It determines the operator privileges, see hasPrivilege.
+	operName string
+
+	// passCredentials are the credentials which the PASS message of the
+	// session contained, see VerifyCredentials.
+	passCredentials []string
+
 	// throttlingExponent starts at 0 and is increased on every
 	// subsequent message until 2^throttlingExponent ≥
 	// ircServer.Config.PostMessageCooloff.  It will be reset once the
@@ -106,10 +125,19 @@ type Session struct {
 	// access modes by using their letter as an index).
 	modes ['z']bool
 
+	// snomask contains the server notice categories (e.g. “ck”) which the
+	// session subscribed to using user mode +s, see sendSnotice.
+	snomask string
+
 	// svid is an identifier set by the services. It starts out as 0 and gets
-	// set to something >0 once the nickname identified itself.
+	// set to something >0 once the nickname identified itself, or to the
+	// account name after SASL authentication (see cmdServerSvslogin).
 	svid string
 
+	// saslMechanism is the SASL mechanism (e.g. “PLAIN”) of the
+	// authentication which is in progress, if any. See cmdAuthenticate.
+	saslMechanism string
+
 	// The (raw) password from a PASS command.
 	Pass string
 
@@ -123,13 +151,90 @@ type Session struct {
 	lastClientMessageId uint64
 
 	ircPrefix irc.Prefix
+
+	// capabilities contains the IRCv3 capabilities which the client enabled
+	// using CAP REQ, e.g. “cap-notify”.
+	capabilities map[string]bool
+
+	// capNegotiating is true while the client negotiates capabilities, i.e.
+	// after CAP LS or CAP REQ and before CAP END. Registration is held until
+	// negotiation has finished.
+	capNegotiating bool
+
+	// monitored contains the nicknames (as specified by the client) which
+	// the client monitors using MONITOR, keyed by their lower-case form.
+	monitored map[lcNick]string
+
 	// deleted gets set by DeleteSession and used by SendMessages. Refer to the
 	// DeleteSession comment.
 	deleted bool
 }
 
+// hasPrivilege returns true if |s| is an IRC operator whose operator class
+// grants |privilege| (e.g. config.PrivilegeKill).
+func (i *IRCServer) hasPrivilege(s *Session, privilege string) bool {
+	if !s.Operator {
+		return false
+	}
+	// Sessions which became operators before operator classes were introduced
+	// do not have an operName and are in config.DefaultOperatorClass.
+	var className string
+	if s.operName != "" {
+		found := false
+		for _, op := range i.Config.IRC.Operators {
+			if op.Name == s.operName {
+				className = op.Class
+				found = true
+				break
+			}
+		}
+		if !found {
+			// The operator was removed from the configuration.
+			return false
+		}
+	}
+	class, _ := i.Config.IRC.Class(className)
+	for _, p := range class.Privileges {
+		if p == privilege {
+			return true
+		}
+	}
+	return false
+}
+
+// account returns the services account which |s| is logged into, or the empty
+// string. Services which do not set the account name as svid (see
+// cmdServerSvsmode) set a numeric timestamp instead, which does not reveal the
+// account name.
+func (s *Session) account() string {
+	if strings.Trim(s.svid, "0123456789") == "" {
+		return ""
+	}
+	return s.svid
+}
+
+// setSvid changes the svid of |s| and, if that changes the account which |s| is
+// logged into, sends ACCOUNT to all users in common channels (which is only
+// delivered to clients which negotiated account-notify, see tagMessages).
+func (i *IRCServer) setSvid(s *Session, reply *Replyctx, svid string) {
+	oldAccount := s.account()
+	s.svid = svid
+	account := s.account()
+	if account == oldAccount || !s.loggedIn() || len(s.Channels) == 0 {
+		return
+	}
+	if account == "" {
+		account = "*"
+	}
+	i.sendCommonChannels(s, reply, &irc.Message{
+		Prefix:  &s.ircPrefix,
+		Command: "ACCOUNT",
+		Params:  []string{account},
+	})
+}
+
 func (s *Session) loggedIn() bool {
-	return s.Nick != "" && s.Username != ""
+	return s.Nick != "" && s.Username != "" && !s.capNegotiating
 }
 
 // updateIrcPrefix MUST be called whenever the Nick field changes.
@@ -143,12 +248,97 @@ func (s *Session) updateIrcPrefix() {
 	}
 }
 
+// The channel member statuses are used as indexes into channel.nicks and
+// persisted in snapshots, so new statuses must be added at the end.
 const (
 	chanop = iota
 	voice
+	halfop
 	maxChanMemberStatus
 )
 
+// memberStatuses lists the channel member statuses from highest to lowest,
+// along with their channel mode and NAMES prefix.
+var memberStatuses = []struct {
+	status int
+	mode   byte
+	prefix string
+}{
+	{chanop, 'o', "@"},
+	{halfop, 'h', "%"},
+	{voice, 'v', "+"},
+}
+
+// statusmsgPrefixes are the prefixes which restrict a message to channel
+// members with at least the corresponding status (STATUSMSG).
+const statusmsgPrefixes = "@%+"
+
+// hasStatus returns true if |perms| contains the status with |prefix| or a
+// higher status.
+func hasStatus(perms *[maxChanMemberStatus]bool, prefix string) bool {
+	if perms == nil {
+		return false
+	}
+	for _, s := range memberStatuses {
+		if perms[s.status] {
+			return true
+		}
+		if s.prefix == prefix {
+			break
+		}
+	}
+	return false
+}
+
+// statusForMode returns the channel member status which corresponds to the
+// channel mode |mode| (e.g. chanop for 'o'), or -1.
+func statusForMode(mode byte) int {
+	for _, s := range memberStatuses {
+		if s.mode == mode {
+			return s.status
+		}
+	}
+	return -1
+}
+
+// memberPrefix returns the prefix of the highest status in |perms|, e.g. “@”
+// for channel operators, or the empty string.
+func memberPrefix(perms *[maxChanMemberStatus]bool) string {
+	if perms == nil {
+		return ""
+	}
+	for _, s := range memberStatuses {
+		if perms[s.status] {
+			return s.prefix
+		}
+	}
+	return ""
+}
+
+// memberPrefixes returns the prefixes of all statuses in |perms|, highest
+// first, e.g. “@+” for channel operators with voice.
+func memberPrefixes(perms *[maxChanMemberStatus]bool) string {
+	if perms == nil {
+		return ""
+	}
+	var prefixes string
+	for _, s := range memberStatuses {
+		if perms[s.status] {
+			prefixes += s.prefix
+		}
+	}
+	return prefixes
+}
+
+// memberPrefixFor returns the prefix (or, if |s| negotiated the multi-prefix
+// capability, all prefixes) of |perms| to display to |s|.
+func memberPrefixFor(s *Session, perms *[maxChanMemberStatus]bool) string {
+	if s.capabilities["multi-prefix"] {
+		return memberPrefixes(perms)
+	}
+	return memberPrefix(perms)
+}
+
 type channel struct {
 	// name is the (case-sensitive!) original name this channel had when it was
 	// first created.
@@ -163,6 +353,147 @@ type channel struct {
 	// We waste 65 bytes per channel for clearer code (being able to directly
 	// access modes by using their letter as an index).
 	modes ['z']bool
+
+	// key is the channel key (+k), limit is the user limit (+l). They are
+	// only relevant while the corresponding mode is set.
+	key   string
+	limit int
+
+	// flood contains the settings of the +f mode, floodCounters the
+	// corresponding counters (see countFlood) and floodLockExpires the time
+	// at which the +m which flood protection set is lifted again (zero if
+	// there is no such +m).
+	flood            floodSettings
+	floodCounters    map[floodKey]*floodCounter
+	floodLockExpires time.Time
+
+	// bans, banExceptions and inviteExceptions contain the masks of the +b,
+	// +e and +I channel modes, in the order in which they were added.
+	bans             []maskEntry
+	banExceptions    []maskEntry
+	inviteExceptions []maskEntry
+}
+
+// setKeyOrLimit applies the +k or +l |mode| to |c| and returns the parameter
+// which should be broadcast. It returns false if the parameter is missing or
+// invalid, in which case |c| is not modified.
+func (c *channel) setKeyOrLimit(mode modeCmd) (string, bool) {
+	char := mode.Mode[1]
+	if mode.Mode[0] == '-' {
+		c.modes[char] = false
+		if char == 'k' {
+			c.key = ""
+			return "*", true
+		}
+		c.limit = 0
+		return "", true
+	}
+	if char == 'k' {
+		if mode.Param == "" || strings.ContainsAny(mode.Param, ", ") {
+			return "", false
+		}
+		c.key = mode.Param
+		c.modes[char] = true
+		return c.key, true
+	}
+	limit, err := strconv.Atoi(mode.Param)
+	if err != nil || limit < 1 {
+		return "", false
+	}
+	c.limit = limit
+	c.modes[char] = true
+	return strconv.Itoa(limit), true
+}
+
+// maskEntry is an entry of a channel’s ban, ban exception or invite exception
+// list.
+type maskEntry struct {
+	// mask is a nick!user@host mask, possibly containing the wildcards * and ?.
+	mask  string
+	setBy string
+	setAt time.Time
+	// expires is the time at which liftFloodLock removes the entry, or the
+	// zero time for entries which do not expire (i.e. all but the bans
+	// which flood protection set).
+	expires time.Time
+}
+
+// maskList returns a pointer to the mask list of |c| for the list mode
+// |mode| (one of 'b', 'e' or 'I'), or nil if |mode| is not a list mode.
+func (c *channel) maskList(mode byte) *[]maskEntry {
+	switch mode {
+	case 'b':
+		return &c.bans
+	case 'e':
+		return &c.banExceptions
+	case 'I':
+		return &c.inviteExceptions
+	}
+	return nil
+}
+
+// matchesMaskList returns true if any mask in |list| matches |s|.
+func matchesMaskList(list []maskEntry, s *Session) bool {
+	prefix := s.ircPrefix.String()
+	for _, entry := range list {
+		if matchMask(entry.mask, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBanned returns true if |s| matches a ban of |c| and no ban exception.
+func (c *channel) isBanned(s *Session) bool {
+	return matchesMaskList(c.bans, s) && !matchesMaskList(c.banExceptions, s)
+}
+
+// normalizeMask completes partial masks, e.g. “foo” becomes “foo!*@*” and
+// “*@example.net” becomes “*!*@example.net”.
+func normalizeMask(mask string) string {
+	if !strings.Contains(mask, "!") {
+		if strings.Contains(mask, "@") {
+			return "*!" + mask
+		}
+		return mask + "!*@*"
+	}
+	if !strings.Contains(mask, "@") {
+		return mask + "@*"
+	}
+	return mask
+}
+
+// matchMask returns true if |name| (e.g. “nick!user@host”) matches |mask|,
+// which may contain the wildcards * (any number of characters) and ? (exactly
+// one character). The comparison is case-insensitive, regardless of the
+// network’s case mapping, so that masks never match less than intended.
+func matchMask(mask, name string) bool {
+	m := rfc1459Replacer.Replace(strings.ToLower(mask))
+	n := rfc1459Replacer.Replace(strings.ToLower(name))
+	// Iterative wildcard matching with backtracking to the last *.
+	mi, ni := 0, 0
+	star, match := -1, 0
+	for ni < len(n) {
+		switch {
+		case mi < len(m) && (m[mi] == '?' || m[mi] == n[ni]):
+			mi++
+			ni++
+		case mi < len(m) && m[mi] == '*':
+			star = mi
+			match = ni
+			mi++
+		case star != -1:
+			mi = star + 1
+			match++
+			ni = match
+		default:
+			return false
+		}
+	}
+	for mi < len(m) && m[mi] == '*' {
+		mi++
+	}
+	return mi == len(m)
 }
 
 // svshold stores nickname reservations set by services, e.g. for reserving the
@@ -185,18 +516,34 @@ type IRCServer struct {
 	// added in e.g. interestJoin.
 	serverSessions []int64
 
-	// nicks maps from nicknames in lower-case (e.g. NickToLower("sECuRE")) to
+	// nicks maps from nicknames in lower-case (e.g. i.NickToLower("sECuRE")) to
 	// session pointers. Being able to quickly look up sessions based on their
 	// nickname is handy to implement IRC commands efficiently.
 	nicks map[lcNick]*Session
 
 	// channels is a map containing the properties of every known channel (e.g.
 	// topic or modes), keyed by the lower-case channel name (e.g.
-	// ChanToLower(“#robustirc”)).
+	// i.ChanToLower(“#robustirc”)).
 	channels map[lcChan]*channel
 
 	svsholds map[lcNick]svshold
 
+	// whowas contains the most recently used nicknames, see cmdWhowas.
+	whowas whowasHistory
+
+	// klines contains the network-wide bans, see cmdKline.
+	klines []kline
+
+	// redacted contains the ids of the output messages which were retracted
+	// using REDACT. Their content is no longer served, see cmdRedact.
+	// Snapshots only contain the redactions of the last redactWindow, see
+	// Marshal.
+	redacted map[types.RobustId]bool
+
+	// sentMessages contains the PRIVMSGs and NOTICEs of the last
+	// redactWindow, in chronological order (see recordSent).
+	sentMessages []sentMessage
+
 	// output is filled in SendMessages with messages that were generated by
 	// ProcessMessage. These messages are not specific to any IRC client; the
 	// InterestedIn function is used to figure out which IRC client(s) are
@@ -218,6 +565,14 @@ type IRCServer struct {
 	// Config contains the network configuration.
 	Config   config.Network
 	ConfigMu *sync.RWMutex
+
+	// caseMapping is the case mapping which NickToLower and ChanToLower
+	// currently use, see UpdateCaseMapping.
+	caseMapping string
+
+	// spamFilterRegexps caches the compiled regular expressions of
+	// Config.SpamFilters, keyed by config.SpamFilter.Expr().
+	spamFilterRegexps map[string]*regexp.Regexp
 }
 
 // NewIRCServer returns a new IRC server.
@@ -229,6 +584,7 @@ func NewIRCServer(raftdir, networkname string, serverCreation time.Time) *IRCSer
 	return &IRCServer{
 		channels:        make(map[lcChan]*channel),
 		svsholds:        make(map[lcNick]svshold),
+		redacted:        make(map[types.RobustId]bool),
 		nicks:           make(map[lcNick]*Session),
 		sessions:        make(map[types.RobustId]*Session),
 		sessionsMu:      &sync.RWMutex{},
@@ -238,6 +594,7 @@ func NewIRCServer(raftdir, networkname string, serverCreation time.Time) *IRCSer
 		ServerCreation:  serverCreation,
 		Config:          config.DefaultConfig,
 		ConfigMu:        &sync.RWMutex{},
+		caseMapping:     caseMappingOf(config.DefaultConfig),
 	}
 }
 
@@ -295,24 +652,35 @@ func (i *IRCServer) CreateSession(id types.RobustId, auth string) {
 		invitedTo:    make(map[lcChan]bool),
 		LastActivity: time.Unix(0, id.Id),
 		svid:         "0",
+		capabilities: make(map[string]bool),
+		monitored:    make(map[lcNick]string),
 	}
 }
 
 // DeleteSession deletes the specified session. Called from the IRC server
 // itself (when processing QUIT or KILL) or from the API (DELETE request coming
 // from the bridge).
-func (i *IRCServer) DeleteSession(s *Session, msgid int64) {
+func (i *IRCServer) DeleteSession(s *Session, reply *Replyctx) {
+	wasLoggedIn := s.loggedIn() && !s.Server && !s.deleted
+	if wasLoggedIn {
+		i.addWhowas(s.ircPrefix, s.Realname, reply.msgid)
+		i.notifyMonitors(reply, s.ircPrefix, false)
+	}
 	for _, c := range i.channels {
-		delete(c.nicks, NickToLower(s.Nick))
+		delete(c.nicks, i.NickToLower(s.Nick))
 
 		i.maybeDeleteChannel(c)
 	}
-	delete(i.nicks, NickToLower(s.Nick))
+	delete(i.nicks, i.NickToLower(s.Nick))
 	// Instead of deleting the session here, we defer that to SendMessages, as
 	// SendMessages calls the Interesting function of each reply (such as a
 	// QUIT reply) and that function might still need access to the session to
 	// determine where the reply should be sent to.
 	s.deleted = true
+	if wasLoggedIn && s.Id.Reply == 0 {
+		i.sendSnotice(reply, snoConnects, fmt.Sprintf("Client exiting: %s (%s@%s)",
+			s.Nick, s.ircPrefix.User, s.ircPrefix.Host))
+	}
 }
 
 // ExpireSessions returns RobustDeleteSession RobustMessages for all sessions
@@ -357,22 +725,6 @@ func IsValidChannel(channel string) bool {
 	return validChannelRe.MatchString(channel)
 }
 
-// NickToLower converts a nickname to lower case, following RFC2812:
-//
-// Because of IRC's scandanavian origin, the characters {}| are
-// considered to be the lower case equivalents of the characters []\,
-// respectively. This is a critical issue when determining the
-// equivalence of two nicknames.
-func NickToLower(nick string) lcNick {
-	r := strings.NewReplacer("[", "{", "]", "}", "\\", "|")
-	return lcNick(r.Replace(strings.ToLower(nick)))
-}
-
-// ChanToLower converts a channel to lower case.
-func ChanToLower(channelname string) lcChan {
-	return lcChan(strings.ToLower(channelname))
-}
-
 func extractPassword(password, prefix string) string {
 	var extracted string
 	for _, part := range strings.Split(password, ":") {
@@ -394,11 +746,78 @@ func extractPassword(password, prefix string) string {
 	return extracted
 }
 
+// VerifyCredentials returns the credentials in the PASS or OPER message |data|
+// (as sent by the client) which match the configuration: “services” for the
+// services password (PASS services=…) and “oper=<name>” for the password of an
+// IRC operator (OPER <name> <password> or PASS oper=<name> <password>).
+//
+// Verifying a password hash is deliberately slow. Therefore, the server which
+// accepts a message verifies its credentials once, before applying the message
+// (see types.RobustMessage.Credentials), instead of every server doing so
+// whenever the message is applied or replayed.
+func (i *IRCServer) VerifyCredentials(data string) []string {
+	_, data = types.SplitTags(data)
+	msg := irc.ParseMessage(data)
+	if msg == nil {
+		return nil
+	}
+	i.ConfigMu.RLock()
+	defer i.ConfigMu.RUnlock()
+	return i.verifyCredentials(msg)
+}
+
+func (i *IRCServer) verifyCredentials(msg *irc.Message) []string {
+	var credentials []string
+	switch strings.ToUpper(msg.Command) {
+	case irc.OPER:
+		if len(msg.Params) > 1 && i.verifyOper(msg.Params[0], msg.Params[1]) {
+			credentials = append(credentials, "oper="+msg.Params[0])
+		}
+	case irc.PASS:
+		pass := passOf(msg)
+		if strings.HasPrefix(pass, "services=") {
+			password := strings.TrimPrefix(pass, "services=")
+			for _, service := range i.Config.IRC.Services {
+				if config.VerifyPassword(service.Password, password) {
+					credentials = append(credentials, "services")
+					break
+				}
+			}
+		}
+		if oper := irc.ParseMessage("OPER " + extractPassword(pass, "oper")); oper != nil &&
+			len(oper.Params) > 1 && i.verifyOper(oper.Params[0], oper.Params[1]) {
+			credentials = append(credentials, "oper="+oper.Params[0])
+		}
+	}
+	return credentials
+}
+
+// verifyOper returns true if |password| is the password of the operator
+// called |name|.
+func (i *IRCServer) verifyOper(name, password string) bool {
+	for _, op := range i.Config.IRC.Operators {
+		if op.Name == name {
+			return config.VerifyPassword(op.Password, password)
+		}
+	}
+	return false
+}
+
+// hasCredential returns true if |credentials| contain |credential|.
+func hasCredential(credentials []string, credential string) bool {
+	for _, c := range credentials {
+		if c == credential {
+			return true
+		}
+	}
+	return false
+}
+
 func (i *IRCServer) maybeDeleteChannel(c *channel) {
 	if len(c.nicks) > 0 {
 		return
 	}
-	lc := ChanToLower(c.name)
+	lc := i.ChanToLower(c.name)
 	delete(i.channels, lc)
 	for _, s := range i.sessions {
 		delete(s.invitedTo, lc)
@@ -408,13 +827,47 @@ func (i *IRCServer) maybeDeleteChannel(c *channel) {
 // ProcessMessage modifies state in response to 'message' and returns zero or
 // more IRC messages in response to 'message'. These messages can then be
 // stored for eventual retrieval by the clients by calling SendMessages.
+//
+// ProcessMessage verifies the credentials in 'message' itself (see
+// VerifyCredentials). Messages which clients sent must be processed using
+// ProcessTaggedMessage instead, passing the credentials which were verified
+// before applying them.
 func (i *IRCServer) ProcessMessage(id types.RobustId, session types.RobustId, message *irc.Message) *Replyctx {
+	var credentials []string
+	if message != nil {
+		i.ConfigMu.RLock()
+		credentials = i.verifyCredentials(message)
+		i.ConfigMu.RUnlock()
+	}
+	return i.ProcessTaggedMessage(id, session, "", credentials, message)
+}
+
+// ProcessTaggedMessage is like ProcessMessage, but additionally takes the
+// IRCv3 message tags which the client sent along with 'message', as returned
+// by types.SplitTags, and the credentials which were verified before applying
+// 'message', see VerifyCredentials.
+func (i *IRCServer) ProcessTaggedMessage(id types.RobustId, session types.RobustId, tags string, credentials []string, message *irc.Message) *Replyctx {
 	i.sessionsMu.Lock()
 	defer i.sessionsMu.Unlock()
 
 	// alias for convenience
 	s := i.sessions[session]
-	reply := &Replyctx{msgid: id.Id, session: s}
+	reply := &Replyctx{msgid: id.Id, session: s, credentials: credentials}
+	if parsed := parseTags(tags); parsed != nil {
+		if s.capabilities["labeled-response"] {
+			reply.label = parsed["label"]
+		}
+		if reply.label != "" && s.capabilities["batch"] {
+			// Reserve the first reply id for the start of the
+			// labeled-response BATCH, see labelMessages.
+			reply.replyid++
+			reply.labelBatchId = reply.replyid
+		}
+		if s.capabilities["message-tags"] {
+			reply.clientTags = i.clientTags(parsed)
+		}
+	}
+	defer i.tagMessages(reply)
 
 	if message == nil {
 		i.sendUser(s, reply, &irc.Message{
@@ -435,7 +888,9 @@ func (i *IRCServer) ProcessMessage(id types.RobustId, session types.RobustId, me
 		command != irc.USER &&
 		command != irc.PASS &&
 		command != irc.QUIT &&
-		command != irc.SERVER {
+		command != irc.SERVER &&
+		command != irc.CAP &&
+		command != irc.AUTHENTICATE {
 		i.sendUser(s, reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_NOTREGISTERED,
@@ -447,7 +902,7 @@ func (i *IRCServer) ProcessMessage(id types.RobustId, session types.RobustId, me
 				Command:  irc.ERROR,
 				Trailing: "Closing Link: You have not registered within 10 minutes",
 			})
-			i.DeleteSession(s, reply.msgid)
+			i.DeleteSession(s, reply)
 		}
 		return reply
 	}
@@ -520,6 +975,7 @@ func (i *IRCServer) SendMessages(reply *Replyctx, session types.RobustId, id int
 			Id:             msg.Id,
 			Data:           msg.Data,
 			InterestingFor: msg.InterestingFor,
+			History:        msg.History,
 		})
 	}
 	if err := i.output.Add(converted); err != nil {
@@ -646,11 +1102,18 @@ func (i *IRCServer) NumSessions() int {
 func (i *IRCServer) outputToRobustMessages(msgs []outputstream.Message) []*types.RobustMessage {
 	result := make([]*types.RobustMessage, 0, len(msgs))
 	for _, msg := range msgs {
+		if i.isRedacted(msg.Id) {
+			// Keep the message so that clients still advance past it in
+			// GetNext, but without any content or recipients.
+			msg.Data = ""
+			msg.InterestingFor = nil
+		}
 		result = append(result, &types.RobustMessage{
 			Id:             msg.Id,
 			Type:           types.RobustIRCToClient,
 			Data:           msg.Data,
 			InterestingFor: msg.InterestingFor,
+			History:        msg.History,
 		})
 	}
 	return result
@@ -695,6 +1158,24 @@ type Replyctx struct {
 	// lastmsg tracks the last sent message, so that send() can return the same
 	// message multiple times when being called in a continuation.
 	lastmsg *irc.Message
+
+	// label is the labeled-response label which the client sent along with
+	// the message, see labelMessages.
+	label string
+
+	// labelBatchId is the reply id which is reserved for the start of the
+	// labeled-response BATCH, see labelMessages.
+	labelBatchId int64
+
+	// credentials are the credentials which were verified before applying
+	// the message, see VerifyCredentials.
+	credentials []string
+
+	// clientTags are the client-only tags which the client sent along with
+	// the message. They are relayed on the messages in relayed, see
+	// relayClientTags.
+	clientTags string
+	relayed    map[*types.RobustMessage]bool
 }
 
 // send converts |msg| into a RobustMessage and appends it to |reply|.
@@ -766,6 +1247,21 @@ func (i *IRCServer) sendChannelButOne(c *channel, user *Session, reply *Replyctx
 	return msg
 }
 
+// sendChannelStatusButOne sends |msg| to all users who are in |c| and have at
+// least the status with |prefix| (e.g. “+” for voiced users, see hasStatus),
+// except for |user|.
+func (i *IRCServer) sendChannelStatusButOne(c *channel, user *Session, reply *Replyctx, prefix string, msg *irc.Message) *irc.Message {
+	robustmsg := i.send(reply, msg)
+	for nick, perms := range c.nicks {
+		session := i.nicks[nick]
+		if session == user || !hasStatus(perms, prefix) {
+			continue
+		}
+		robustmsg.InterestingFor[session.Id.Id] = true
+	}
+	return msg
+}
+
 // sendServices sends |msg| to the IRC services.
 func (i *IRCServer) sendServices(reply *Replyctx, msg *irc.Message) *irc.Message {
 	robustmsg := i.send(reply, msg)
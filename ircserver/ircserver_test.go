@@ -1,15 +1,21 @@
 package ircserver
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/robustirc/robustirc/config"
 	"github.com/robustirc/robustirc/types"
 
 	"github.com/sorcix/irc"
+
+	pb "github.com/robustirc/robustirc/proto"
 )
 
 func stdIRCServer() (*IRCServer, map[string]types.RobustId) {
@@ -17,8 +23,11 @@ func stdIRCServer() (*IRCServer, map[string]types.RobustId) {
 	i.Config = config.Network{
 		IRC: config.IRC{
 			Operators: []config.IRCOp{
-				{Name: "mero", Password: "foo"},
-				{Name: "xeen", Password: "foo"},
+				{Name: "mero", Password: "foo", Class: "admin"},
+				{Name: "xeen", Password: "foo", Class: "admin"},
+			},
+			OperatorClasses: []config.OperatorClass{
+				{Name: "admin", Privileges: config.Privileges},
 			},
 		},
 	}
@@ -441,6 +450,143 @@ func TestInterestedInInvite(t *testing.T) {
 		[]bool{true, true, false})
 }
 
+func TestOperHashedPassword(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	scryptHash, err := config.HashPassword("scrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypted"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Config.IRC.Operators = []config.IRCOp{
+		{Name: "mero", Password: scryptHash},
+		{Name: "xeen", Password: string(bcryptHash)},
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("OPER mero "+scryptHash)),
+		":robustirc.net 464 mero :Password incorrect")
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("OPER mero scrypted")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 381 mero :You are now an IRC operator"),
+			irc.ParseMessage(":robustirc.net MODE mero :+o"),
+		})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("OPER xeen scrypted")),
+		":robustirc.net 464 xeen :Password incorrect")
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("OPER xeen bcrypted")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 381 xeen :You are now an IRC operator"),
+			irc.ParseMessage(":robustirc.net MODE xeen :+o"),
+		})
+
+	if got, want := i.VerifyCredentials("@label=1 OPER mero scrypted"), []string{"oper=mero"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("VerifyCredentials(OPER): got %v, want %v", got, want)
+	}
+	if got, want := i.VerifyCredentials("PASS :nickserv=x:oper=mero wrong"), []string(nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("VerifyCredentials(PASS): got %v, want %v", got, want)
+	}
+
+	// Messages from raft are authenticated by the credentials which were
+	// verified before applying them, not by the password they contain.
+	mustMatchMsg(t,
+		i.ProcessTaggedMessage(types.RobustId{}, ids["secure"], "", nil, irc.ParseMessage("OPER mero scrypted")),
+		":robustirc.net 464 sECuRE :Password incorrect")
+
+	mustMatchIrcmsgs(t,
+		i.ProcessTaggedMessage(types.RobustId{}, ids["secure"], "", []string{"oper=mero"}, irc.ParseMessage("OPER mero *")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 381 sECuRE :You are now an IRC operator"),
+			irc.ParseMessage(":robustirc.net MODE sECuRE :+o"),
+		})
+}
+
+func TestOperatorClasses(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.Config.IRC.OperatorClasses = append(i.Config.IRC.OperatorClasses,
+		config.OperatorClass{Name: "moderator", Privileges: []string{config.PrivilegeKill}})
+	i.Config.IRC.Operators[0].Class = "moderator"
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVS")),
+		":robustirc.net 481 mero :Permission Denied - You're not an IRC operator")
+
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("OPER mero foo"))
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("OPER xeen foo"))
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVS")),
+		":robustirc.net 270 mero mero :kill")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("PRIVS")),
+		":robustirc.net 270 xeen xeen :kill ban override see-secret wallops snomask")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WALLOPS :hey")),
+		":robustirc.net 723 mero wallops :Insufficient oper privileges.")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE mero +s")),
+		":robustirc.net 723 mero snomask :Insufficient oper privileges.")
+
+	// Operators without a class are in the default class, which grants all
+	// privileges unless it is configured.
+	i.Config.IRC.Operators[1].Class = ""
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("PRIVS")),
+		":robustirc.net 270 xeen xeen :kill ban override see-secret wallops snomask")
+
+	classes := i.Config.IRC.OperatorClasses
+	i.Config.IRC.OperatorClasses = append(classes[:len(classes):len(classes)],
+		config.OperatorClass{Name: config.DefaultOperatorClass, Privileges: []string{config.PrivilegeWallops}})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("PRIVS")),
+		":robustirc.net 270 xeen xeen :wallops")
+
+	i.Config.IRC.OperatorClasses = classes
+	i.Config.IRC.Operators[1].Class = "admin"
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("KLINE secure :spamming")),
+		":robustirc.net 723 mero ban :Insufficient oper privileges.")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE #test +s")),
+		":robustirc.net 482 mero #test :You're not channel operator")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MODE #test +s")),
+		":xeen!baz@robust/0x13b5aa0a2bcfb8af MODE #test +s")
+
+	// Removing the operator from the configuration revokes all privileges.
+	i.Config.IRC.Operators = i.Config.IRC.Operators[:1]
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("PRIVS")),
+		":robustirc.net 270 xeen xeen :")
+
+	got := i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("KILL secure :bye"))
+	if len(got.Messages) == 0 || irc.ParseMessage(got.Messages[0].Data).Command != irc.QUIT {
+		t.Fatalf("KILL with the kill privilege did not work: %v", got.Messages)
+	}
+}
+
 func TestInterestedInKill(t *testing.T) {
 	i, ids := stdIRCServer()
 
@@ -838,6 +984,19 @@ func TestMotd(t *testing.T) {
 	if !motdFound {
 		t.Fatalf("got %v, did not find MOTDSTART, MOTD, ENDOFMOTD in order", got)
 	}
+
+	i.Config.NetworkDescription = "RobustIRC, the network without netsplits"
+	i.Config.MOTD = "Be nice.\r\nHave fun!\n"
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, idSecure, irc.ParseMessage("MOTD")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 375 s[E]CuRE :- robustirc.net Message of the day -"),
+			irc.ParseMessage(":robustirc.net 372 s[E]CuRE :- RobustIRC, the network without netsplits"),
+			irc.ParseMessage(":robustirc.net 372 s[E]CuRE :- Be nice."),
+			irc.ParseMessage(":robustirc.net 372 s[E]CuRE :- Have fun!"),
+			irc.ParseMessage(":robustirc.net 376 s[E]CuRE :End of MOTD command"),
+		})
 }
 
 func TestChannelMode(t *testing.T) {
@@ -904,180 +1063,603 @@ func TestChannelMode(t *testing.T) {
 func TestUserMode(t *testing.T) {
 	i, ids := stdIRCServer()
 
-	// User modes are not yet implemented.
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE sECuRE +i")),
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE sECuRE")),
 		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE sECuRE :+")
-}
 
-func TestBans(t *testing.T) {
-	i, ids := stdIRCServer()
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE sECuRE +iwx")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE sECuRE :+iw")
 
-	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE sECuRE")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE sECuRE :+iw")
 
-	// Bans are not yet implemented.
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test b")),
-		":robustirc.net 368 sECuRE #test :End of Channel Ban List")
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE sECuRE -w+i")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE sECuRE :-w")
+
+	// Changing nothing just reports the current modes.
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +b")),
-		":robustirc.net 368 sECuRE #test :End of Channel Ban List")
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE sECuRE +i")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE sECuRE :+i")
 }
 
-func TestChannelMemberStatus(t *testing.T) {
+func TestInvisible(t *testing.T) {
 	i, ids := stdIRCServer()
 
-	sSecure, _ := i.GetSession(ids["secure"])
-
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
 	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE mero +i"))
+
+	// xeen does not share a channel with mero, so mero is hidden.
 	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test")),
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("NAMES #test")),
 		[]*irc.Message{
-			{Prefix: &sSecure.ircPrefix, Command: irc.JOIN, Trailing: "#test"},
-			irc.ParseMessage(":robustirc.net SJOIN 1 #test :sECuRE"),
-			irc.ParseMessage(":robustirc.net 331 sECuRE #test :No topic is set"),
-			irc.ParseMessage(":robustirc.net 353 sECuRE = #test :@mero sECuRE"),
+			irc.ParseMessage(":robustirc.net 353 xeen = #test :@sECuRE"),
+			irc.ParseMessage(":robustirc.net 366 xeen #test :End of /NAMES list."),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("WHO #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 352 xeen #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H@ :0 Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 315 xeen #test :End of /WHO list"),
+		})
+
+	// Channel members still see mero.
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("NAMES #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 353 sECuRE = #test :@sECuRE mero"),
 			irc.ParseMessage(":robustirc.net 366 sECuRE #test :End of /NAMES list."),
 		})
+}
 
-	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+func TestWallops(t *testing.T) {
+	i, ids := stdIRCServerWithServices()
 
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE #test +t")),
-		":mero!foo@robust/0x13b5aa0a2bcfb8ae MODE #test +t")
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("WALLOPS :hi")),
+		":robustirc.net 481 sECuRE :Permission Denied - You're not an IRC operator")
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE sECuRE +w"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("OPER mero foo"))
+
+	reply := i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WALLOPS :maintenance in 5 minutes"))
+	mustMatchMsg(t, reply, ":mero!foo@robust/0x13b5aa0a2bcfb8ae WALLOPS :maintenance in 5 minutes")
+	if got, want := reply.Messages[0].InterestingFor, map[int64]bool{
+		ids["secure"].Id:   true,
+		ids["services"].Id: true,
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("WALLOPS sent to %v, want %v", got, want)
+	}
 
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE #test +o xeen")),
-		":mero!foo@robust/0x13b5aa0a2bcfb8ae MODE #test +o xeen")
+		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":OperServ GLOBOPS :services restarting")),
+		":OperServ!services@services WALLOPS :services restarting")
+}
+
+func TestBans(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
 
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MODE #test -o+o xeen sECuRE")),
-		":xeen!baz@robust/0x13b5aa0a2bcfb8af MODE #test +o-o sECuRE xeen")
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test b")),
+		":robustirc.net 368 sECuRE #test :End of Channel Ban List")
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +b")),
+		":robustirc.net 368 sECuRE #test :End of Channel Ban List")
 
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MODE #test +o xeen")),
-		":robustirc.net 482 xeen #test :You're not channel operator")
+		i.ProcessMessage(types.RobustId{Id: 1420228218166687920}, ids["secure"], irc.ParseMessage("MODE #test +bb mero xeen!*@*")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test +bb mero!*@* xeen!*@*")
 
 	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("TOPIC #test :finally")),
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +b")),
 		[]*irc.Message{
-			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad TOPIC #test :finally"),
-			irc.ParseMessage(":sECuRE TOPIC #test sECuRE 1420228218 :finally"),
+			irc.ParseMessage(":robustirc.net 367 sECuRE #test mero!*@* sECuRE!blah@robust/0x13b5aa0a2bcfb8ad 1420228218"),
+			irc.ParseMessage(":robustirc.net 367 sECuRE #test xeen!*@* sECuRE!blah@robust/0x13b5aa0a2bcfb8ad 1420228218"),
+			irc.ParseMessage(":robustirc.net 368 sECuRE #test :End of Channel Ban List"),
 		})
 
+	// Masks which are already listed are not broadcast again.
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("TOPIC #test :nooo")),
-		":robustirc.net 482 xeen #test :You're not channel operator")
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +bb MERO!*@* nobody")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test +b nobody!*@*")
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test -bb nobody unknown")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test -b nobody!*@*")
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test -b unknown")),
+		[]*irc.Message{})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test")),
+		":robustirc.net 474 mero #test :Cannot join channel (+b)")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +e *!foo@*")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test +e *!foo@*")
 
 	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("OPER xeen foo")),
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test e")),
 		[]*irc.Message{
-			irc.ParseMessage(":robustirc.net 381 xeen :You are now an IRC operator"),
-			irc.ParseMessage(":robustirc.net MODE xeen :+o"),
+			irc.ParseMessage(":robustirc.net 348 sECuRE #test *!foo@* sECuRE!blah@robust/0x13b5aa0a2bcfb8ad 0"),
+			irc.ParseMessage(":robustirc.net 349 sECuRE #test :End of Channel Exception List"),
 		})
 
+	// mero matches the ban exception now.
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	if _, ok := i.channels[i.ChanToLower("#test")].nicks[i.NickToLower("mero")]; !ok {
+		t.Fatalf("mero could not join #test despite the ban exception")
+	}
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test -e *!foo@*"))
+
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MODE xeen")),
-		":xeen!baz@robust/0x13b5aa0a2bcfb8af MODE xeen :+o")
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVMSG #test :hey")),
+		":robustirc.net 404 mero #test :Cannot send to channel")
 
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MODE #test +o xeen")),
-		":xeen!baz@robust/0x13b5aa0a2bcfb8af MODE #test +o xeen")
-}
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("NICK mero_")),
+		":robustirc.net 435 mero mero_ #test :Cannot change nickname while banned on channel")
 
-func TestWho(t *testing.T) {
-	i, ids := stdIRCServer()
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test -b mero")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test -b mero!*@*")
 
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("WHO")),
-		":robustirc.net 315 sECuRE :End of /WHO list")
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVMSG #test :hey")),
+		":mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG #test :hey")
 
+	// Invite exceptions allow joining invite-only channels.
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +i"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test -b xeen!*@*"))
 	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("WHO #nonexistant")),
-		":robustirc.net 315 sECuRE #nonexistant :End of /WHO list")
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test")),
+		":robustirc.net 473 xeen #test :Cannot join channel (+i)")
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +I xeen"))
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+	if _, ok := i.channels[i.ChanToLower("#test")].nicks[i.NickToLower("xeen")]; !ok {
+		t.Fatalf("xeen could not join #test despite the invite exception")
+	}
+}
+
+func TestChannelKeyLimit(t *testing.T) {
+	i, ids := stdIRCServer()
 
 	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
-	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("WHO #test")),
-		[]*irc.Message{
-			irc.ParseMessage(":robustirc.net 352 sECuRE #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H :0 Michael Stapelberg"),
-			irc.ParseMessage(":robustirc.net 315 sECuRE #test :End of /WHO list"),
-		})
 
-	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
-		[]*irc.Message{
-			irc.ParseMessage(":robustirc.net 352 mero #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H :0 Michael Stapelberg"),
-			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
-		})
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +kl secret 1")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test +kl secret 1")
 
-	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +s"))
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test")),
+		":robustirc.net 324 sECuRE #test +kl secret 1")
 
-	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
-		[]*irc.Message{
-			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
-		})
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +l foo")),
+		":robustirc.net 461 sECuRE MODE :Not enough parameters")
 
-	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
-	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("AWAY :afk"))
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test")),
+		":robustirc.net 475 mero #test :Cannot join channel (+k)")
 
-	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
-		[]*irc.Message{
-			irc.ParseMessage(":robustirc.net 352 mero #test foo robust/0x13b5aa0a2bcfb8ae robustirc.net mero H :0 Axel Wagner"),
-			irc.ParseMessage(":robustirc.net 352 mero #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE G :0 Michael Stapelberg"),
-			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
-		})
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test wrong")),
+		":robustirc.net 475 mero #test :Cannot join channel (+k)")
 
-	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("NICK secore"))
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test secret")),
+		":robustirc.net 471 mero #test :Cannot join channel (+l)")
 
-	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
-		[]*irc.Message{
-			irc.ParseMessage(":robustirc.net 352 mero #test foo robust/0x13b5aa0a2bcfb8ae robustirc.net mero H :0 Axel Wagner"),
-			irc.ParseMessage(":robustirc.net 352 mero #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net secore G :0 Michael Stapelberg"),
-			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
-		})
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +l 2")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test +l 2")
 
-	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("join #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #foo,#test bar,secret"))
+	if _, ok := i.channels[i.ChanToLower("#test")].nicks[i.NickToLower("mero")]; !ok {
+		t.Fatalf("mero could not join #test with the correct key")
+	}
 
-	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
-		[]*irc.Message{
-			irc.ParseMessage(":robustirc.net 352 mero #test foo robust/0x13b5aa0a2bcfb8ae robustirc.net mero H :0 Axel Wagner"),
-			irc.ParseMessage(":robustirc.net 352 mero #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net secore G :0 Michael Stapelberg"),
-			irc.ParseMessage(":robustirc.net 352 mero #test baz robust/0x13b5aa0a2bcfb8af robustirc.net xeen H :0 Iks Enn"),
-			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
-		})
+	// An invitation overrides both, the key and the limit.
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test secret")),
+		":robustirc.net 471 xeen #test :Cannot join channel (+l)")
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("INVITE xeen #test"))
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+	if _, ok := i.channels[i.ChanToLower("#test")].nicks[i.NickToLower("xeen")]; !ok {
+		t.Fatalf("xeen could not join #test despite the invitation")
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test -kl")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test -kl *")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test")),
+		":robustirc.net 324 sECuRE #test +")
 }
 
-func TestQuit(t *testing.T) {
+func TestModerated(t *testing.T) {
 	i, ids := stdIRCServer()
 
 	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
 	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
 	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
 
-	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
-		[]*irc.Message{
-			irc.ParseMessage(":robustirc.net 352 mero #test foo robust/0x13b5aa0a2bcfb8ae robustirc.net mero H :0 Axel Wagner"),
-			irc.ParseMessage(":robustirc.net 352 mero #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H :0 Michael Stapelberg"),
-			irc.ParseMessage(":robustirc.net 352 mero #test baz robust/0x13b5aa0a2bcfb8af robustirc.net xeen H :0 Iks Enn"),
-			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
-		})
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +m")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test +m")
 
-	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("quit :bye bye")),
-		[]*irc.Message{
-			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad QUIT :bye bye"),
-			irc.ParseMessage("ERROR :Closing Link: sECuRE[robust/0x13b5aa0a2bcfb8ad] (bye bye)"),
-		})
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVMSG #test :hey")),
+		":robustirc.net 404 mero #test :Cannot send to channel")
 
-	mustMatchIrcmsgs(t,
-		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
-		[]*irc.Message{
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE #test +v mero")),
+		":robustirc.net 482 mero #test :You're not channel operator")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +h mero")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test +h mero")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVMSG #test :hey")),
+		":mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG #test :hey")
+
+	// Half operators can give voice, but nothing else.
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE #test +o xeen")),
+		":robustirc.net 482 mero #test :You're not channel operator")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE #test -m")),
+		":robustirc.net 482 mero #test :You're not channel operator")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE #test +v xeen")),
+		":mero!foo@robust/0x13b5aa0a2bcfb8ae MODE #test +v xeen")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("PRIVMSG #test :hey")),
+		":xeen!baz@robust/0x13b5aa0a2bcfb8af PRIVMSG #test :hey")
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("NAMES #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 353 sECuRE = #test :%mero +xeen @sECuRE"),
+			irc.ParseMessage(":robustirc.net 366 sECuRE #test :End of /NAMES list."),
+		})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test -v xeen")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test -v xeen")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("PRIVMSG #test :hey")),
+		":robustirc.net 404 xeen #test :Cannot send to channel")
+}
+
+func TestFloodProtection(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	// at returns a message id whose timestamp is |offset| after an arbitrary
+	// point in time. Flood protection only looks at these timestamps.
+	at := func(offset time.Duration) types.RobustId {
+		return types.RobustId{Id: 1420228218166687917 + int64(offset)}
+	}
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +f 2x:10")),
+		":robustirc.net 461 sECuRE MODE :Not enough parameters")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +f 2n#b,2m,2j:10")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test +f 2j#m,2m#k,2n#b:10")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test")),
+		":robustirc.net 324 sECuRE #test +f 2j#m,2m#k,2n#b:10")
+
+	i.ProcessMessage(at(0), ids["mero"], irc.ParseMessage("PRIVMSG #test :one"))
+	i.ProcessMessage(at(1*time.Second), ids["mero"], irc.ParseMessage("PRIVMSG #test :two"))
+	mustMatchMsg(t,
+		i.ProcessMessage(at(2*time.Second), ids["mero"], irc.ParseMessage("PRIVMSG #test :three")),
+		":robustirc.net KICK #test mero :Flood protection: more than 2 messages in 10 seconds")
+
+	// Channel operators are exempt.
+	i.ProcessMessage(at(3*time.Second), ids["secure"], irc.ParseMessage("PRIVMSG #test :one"))
+	i.ProcessMessage(at(4*time.Second), ids["secure"], irc.ParseMessage("PRIVMSG #test :two"))
+	mustMatchMsg(t,
+		i.ProcessMessage(at(5*time.Second), ids["secure"], irc.ParseMessage("PRIVMSG #test :three")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :three")
+
+	// Messages in different windows do not add up.
+	i.ProcessMessage(at(0), ids["xeen"], irc.ParseMessage("PRIVMSG #test :one"))
+	i.ProcessMessage(at(1*time.Second), ids["xeen"], irc.ParseMessage("PRIVMSG #test :two"))
+	mustMatchMsg(t,
+		i.ProcessMessage(at(11*time.Second), ids["xeen"], irc.ParseMessage("PRIVMSG #test :three")),
+		":xeen!baz@robust/0x13b5aa0a2bcfb8af PRIVMSG #test :three")
+
+	i.ProcessMessage(at(12*time.Second), ids["xeen"], irc.ParseMessage("NICK xeen_"))
+	i.ProcessMessage(at(13*time.Second), ids["xeen"], irc.ParseMessage("NICK xeen"))
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(at(14*time.Second), ids["xeen"], irc.ParseMessage("NICK xeen_")),
+		[]*irc.Message{
+			irc.ParseMessage(":xeen!baz@robust/0x13b5aa0a2bcfb8af NICK :xeen_"),
+			irc.ParseMessage(":robustirc.net MODE #test +b *!*@robust/0x13b5aa0a2bcfb8af"),
+		})
+
+	i.ProcessMessage(at(20*time.Second), ids["mero"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(at(21*time.Second), ids["mero"], irc.ParseMessage("PART #test"))
+	i.ProcessMessage(at(22*time.Second), ids["mero"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(at(23*time.Second), ids["mero"], irc.ParseMessage("PART #test"))
+	reply := i.ProcessMessage(at(24*time.Second), ids["mero"], irc.ParseMessage("JOIN #test"))
+	if got, want := reply.Messages[len(reply.Messages)-1].Data, ":robustirc.net MODE #test +m"; got != want {
+		t.Fatalf("join flood: got %q, want %q", got, want)
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(at(25*time.Second), ids["mero"], irc.ParseMessage("PRIVMSG #test :hey")),
+		":robustirc.net 404 mero #test :Cannot send to channel")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(at(25*time.Second), ids["xeen"], irc.ParseMessage("PRIVMSG #test :hey")),
+		":robustirc.net 404 xeen_ #test :Cannot send to channel")
+
+	// The +m and the ban are lifted once the next message arrives after
+	// floodLockDuration, without affecting the mode change of that message.
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(at(24*time.Second+floodLockDuration), ids["secure"], irc.ParseMessage("MODE #test +t")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net MODE #test -mb *!*@robust/0x13b5aa0a2bcfb8af"),
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test +t"),
+		})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(at(25*time.Second+floodLockDuration), ids["mero"], irc.ParseMessage("PRIVMSG #test :hey")),
+		":mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG #test :hey")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test -f")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE #test -f")
+}
+
+func TestMatchMask(t *testing.T) {
+	table := []struct {
+		mask string
+		name string
+		want bool
+	}{
+		{"*!*@*", "secure!blah@robust/0x1", true},
+		{"secure!*@*", "sECuRE!blah@robust/0x1", true},
+		{"s?cure!*@*", "secure!blah@robust/0x1", true},
+		{"s?cure!*@*", "scure!blah@robust/0x1", false},
+		{"*!*@robust/0x1", "secure!blah@robust/0x12", false},
+		{"*!*@robust/0x1*", "secure!blah@robust/0x12", true},
+		{"[foo]!*@*", "{foo}!blah@robust/0x1", true},
+		{"mero!*@*", "secure!blah@robust/0x1", false},
+	}
+	for _, entry := range table {
+		if got := matchMask(entry.mask, entry.name); got != entry.want {
+			t.Errorf("matchMask(%q, %q) = %v, want %v", entry.mask, entry.name, got, entry.want)
+		}
+	}
+}
+
+func TestChannelMemberStatus(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	sSecure, _ := i.GetSession(ids["secure"])
+
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test")),
+		[]*irc.Message{
+			{Prefix: &sSecure.ircPrefix, Command: irc.JOIN, Trailing: "#test"},
+			irc.ParseMessage(":robustirc.net SJOIN 1 #test :sECuRE"),
+			irc.ParseMessage(":robustirc.net 331 sECuRE #test :No topic is set"),
+			irc.ParseMessage(":robustirc.net 353 sECuRE = #test :@mero sECuRE"),
+			irc.ParseMessage(":robustirc.net 366 sECuRE #test :End of /NAMES list."),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE #test +t")),
+		":mero!foo@robust/0x13b5aa0a2bcfb8ae MODE #test +t")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE #test +o xeen")),
+		":mero!foo@robust/0x13b5aa0a2bcfb8ae MODE #test +o xeen")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MODE #test -o+o xeen sECuRE")),
+		":xeen!baz@robust/0x13b5aa0a2bcfb8af MODE #test +o-o sECuRE xeen")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MODE #test +o xeen")),
+		":robustirc.net 482 xeen #test :You're not channel operator")
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("TOPIC #test :finally")),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad TOPIC #test :finally"),
+			irc.ParseMessage(":sECuRE TOPIC #test sECuRE 1420228218 :finally"),
+		})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("TOPIC #test :nooo")),
+		":robustirc.net 482 xeen #test :You're not channel operator")
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("OPER xeen foo")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 381 xeen :You are now an IRC operator"),
+			irc.ParseMessage(":robustirc.net MODE xeen :+o"),
+		})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MODE xeen")),
+		":xeen!baz@robust/0x13b5aa0a2bcfb8af MODE xeen :+o")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MODE #test +o xeen")),
+		":xeen!baz@robust/0x13b5aa0a2bcfb8af MODE #test +o xeen")
+}
+
+func TestWho(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("WHO")),
+		":robustirc.net 315 sECuRE :End of /WHO list")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("WHO #nonexistant")),
+		":robustirc.net 315 sECuRE #nonexistant :End of /WHO list")
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("WHO #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 352 sECuRE #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H@ :0 Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 315 sECuRE #test :End of /WHO list"),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 352 mero #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H@ :0 Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +s"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("AWAY :afk"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 352 mero #test foo robust/0x13b5aa0a2bcfb8ae robustirc.net mero H :0 Axel Wagner"),
+			irc.ParseMessage(":robustirc.net 352 mero #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE G@ :0 Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("NICK secore"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 352 mero #test foo robust/0x13b5aa0a2bcfb8ae robustirc.net mero H :0 Axel Wagner"),
+			irc.ParseMessage(":robustirc.net 352 mero #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net secore G@ :0 Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("join #test"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 352 mero #test foo robust/0x13b5aa0a2bcfb8ae robustirc.net mero H :0 Axel Wagner"),
+			irc.ParseMessage(":robustirc.net 352 mero #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net secore G@ :0 Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 352 mero #test baz robust/0x13b5aa0a2bcfb8af robustirc.net xeen H :0 Iks Enn"),
+			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
+		})
+}
+
+func TestWhox(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +v sECuRE"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("OPER mero foo"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("AWAY :lunch"))
+	i.sessions[ids["secure"]].svid = "secure"
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("WHO #test %tnfar,42")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 354 xeen 42 mero G* 0 :Axel Wagner"),
+			irc.ParseMessage(":robustirc.net 354 xeen 42 sECuRE H@ secure :Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 315 xeen #test :End of /WHO list"),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("WHO #test :%cuhsn")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 354 xeen #test foo robust/0x13b5aa0a2bcfb8ae robustirc.net mero"),
+			irc.ParseMessage(":robustirc.net 354 xeen #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE"),
+			irc.ParseMessage(":robustirc.net 315 xeen #test :End of /WHO list"),
+		})
+
+	// multi-prefix lists all prefixes in WHO, NAMES and WHOIS.
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("CAP REQ :multi-prefix"))
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("WHO #test %nf")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 354 xeen mero G*"),
+			irc.ParseMessage(":robustirc.net 354 xeen sECuRE H@+"),
+			irc.ParseMessage(":robustirc.net 315 xeen #test :End of /WHO list"),
+		})
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("NAMES #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 353 xeen = #test :@+sECuRE mero"),
+			irc.ParseMessage(":robustirc.net 366 xeen #test :End of /NAMES list."),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("CAP REQ :userhost-in-names"))
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("NAMES #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 353 xeen = #test :@+sECuRE!blah@robust/0x13b5aa0a2bcfb8ad mero!foo@robust/0x13b5aa0a2bcfb8ae"),
+			irc.ParseMessage(":robustirc.net 366 xeen #test :End of /NAMES list."),
+		})
+}
+
+func TestQuit(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 352 mero #test foo robust/0x13b5aa0a2bcfb8ae robustirc.net mero H :0 Axel Wagner"),
+			irc.ParseMessage(":robustirc.net 352 mero #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H@ :0 Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 352 mero #test baz robust/0x13b5aa0a2bcfb8af robustirc.net xeen H :0 Iks Enn"),
+			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("quit :bye bye")),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad QUIT :bye bye"),
+			irc.ParseMessage("ERROR :Closing Link: sECuRE[robust/0x13b5aa0a2bcfb8ad] (bye bye)"),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("WHO #test")),
+		[]*irc.Message{
 			irc.ParseMessage(":robustirc.net 352 mero #test foo robust/0x13b5aa0a2bcfb8ae robustirc.net mero H :0 Axel Wagner"),
 			irc.ParseMessage(":robustirc.net 352 mero #test baz robust/0x13b5aa0a2bcfb8af robustirc.net xeen H :0 Iks Enn"),
 			irc.ParseMessage(":robustirc.net 315 mero #test :End of /WHO list"),
@@ -1534,18 +2116,404 @@ func TestNames(t *testing.T) {
 		})
 }
 
-func TestKnock(t *testing.T) {
+func TestInformationalCommands(t *testing.T) {
 	i, ids := stdIRCServer()
 
 	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
-	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test2"))
-	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +i"))
-
-	mustMatchMsg(t,
-		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("KNOCK")),
-		":robustirc.net 461 xeen KNOCK :Not enough parameters")
+	i.CreateSession(types.RobustId{Id: 1420228218166687920}, "auth-unknown")
 
-	mustMatchMsg(t,
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("LUSERS")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 251 sECuRE :There are 3 users and 0 invisible on 1 servers"),
+			irc.ParseMessage(":robustirc.net 252 sECuRE 0 :operator(s) online"),
+			irc.ParseMessage(":robustirc.net 253 sECuRE 1 :unknown connection(s)"),
+			irc.ParseMessage(":robustirc.net 254 sECuRE 1 :channels formed"),
+			irc.ParseMessage(":robustirc.net 255 sECuRE :I have 3 clients and 1 servers"),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE mero +i"))
+	reply := i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("LUSERS"))
+	if got, want := reply.Messages[0].Data, ":robustirc.net 251 sECuRE :There are 2 users and 1 invisible on 1 servers"; got != want {
+		t.Fatalf("LUSERS: got %q, want %q", got, want)
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{Id: 1420228218166687921}, ids["secure"], irc.ParseMessage("TIME")),
+		":robustirc.net 391 sECuRE robustirc.net :Fri, 02 Jan 2015 19:50:18 UTC")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("ADMIN")),
+		":robustirc.net 423 sECuRE robustirc.net :No administrative info available")
+
+	i.Config.Admin = config.Admin{
+		Name:     "RobustIRC",
+		Location: "Zürich, Switzerland",
+		Email:    "admin@robustirc.net",
+	}
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("ADMIN")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 256 sECuRE robustirc.net :Administrative info"),
+			irc.ParseMessage(":robustirc.net 257 sECuRE :Zürich, Switzerland"),
+			irc.ParseMessage(":robustirc.net 258 sECuRE :RobustIRC"),
+			irc.ParseMessage(":robustirc.net 259 sECuRE :admin@robustirc.net"),
+		})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("ISON MERO nobody :xeen")),
+		":robustirc.net 303 sECuRE :mero xeen")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("ISON")),
+		":robustirc.net 461 sECuRE ISON :Not enough parameters")
+
+	got := i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("VERSION"))
+	// RPL_VERSION is followed by RPL_ISUPPORT, split into two messages.
+	if len(got.Messages) != 3 {
+		t.Fatalf("VERSION: got %d messages, want 3", len(got.Messages))
+	}
+	if want := ":robustirc.net 351 sECuRE RobustIRC robustirc.net :https://robustirc.net/"; got.Messages[0].Data != want {
+		t.Fatalf("VERSION: got %q, want %q", got.Messages[0].Data, want)
+	}
+}
+
+func TestWhowas(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.ProcessMessage(types.RobustId{Id: 1420228218166687920}, ids["secure"], irc.ParseMessage("NICK secore"))
+	i.ProcessMessage(types.RobustId{Id: 1420228218166687921}, ids["mero"], irc.ParseMessage("QUIT :bye"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("WHOWAS SECURE")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 314 xeen sECuRE blah robust/0x13b5aa0a2bcfb8ad * :Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 312 xeen sECuRE robustirc.net :Fri, 02 Jan 2015 19:50:18 UTC"),
+			irc.ParseMessage(":robustirc.net 369 xeen SECURE :End of WHOWAS"),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("WHOWAS mero,nobody")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 314 xeen mero foo robust/0x13b5aa0a2bcfb8ae * :Axel Wagner"),
+			irc.ParseMessage(":robustirc.net 312 xeen mero robustirc.net :Fri, 02 Jan 2015 19:50:18 UTC"),
+			irc.ParseMessage(":robustirc.net 369 xeen mero :End of WHOWAS"),
+			irc.ParseMessage(":robustirc.net 406 xeen nobody :There was no such nickname"),
+			irc.ParseMessage(":robustirc.net 369 xeen nobody :End of WHOWAS"),
+		})
+
+	for n := 0; n < maxWhowasEntries+2; n++ {
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage(fmt.Sprintf("NICK xeen%d", n)))
+	}
+	entries := i.whowas.all()
+	if got, want := len(entries), maxWhowasEntries; got != want {
+		t.Fatalf("len(whowas) = %d, want %d", got, want)
+	}
+	if got, want := entries[0].nick, "xeen1"; got != want {
+		t.Fatalf("oldest whowas entry = %q, want %q", got, want)
+	}
+	if got, want := entries[len(entries)-1].nick, fmt.Sprintf("xeen%d", maxWhowasEntries); got != want {
+		t.Fatalf("newest whowas entry = %q, want %q", got, want)
+	}
+
+	snapshot, err := i.Marshal(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewIRCServer("", "robustirc.net", time.Now())
+	if _, err := restored.Unmarshal(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.whowas.all(), entries) {
+		t.Fatalf("whowas entries not restored from snapshot")
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MONITOR + :MERO,nobody,mero")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 730 sECuRE :mero!foo@robust/0x13b5aa0a2bcfb8ae"),
+			irc.ParseMessage(":robustirc.net 731 sECuRE :nobody"),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MONITOR + mero"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MONITOR L")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 732 sECuRE :MERO,nobody"),
+			irc.ParseMessage(":robustirc.net 733 sECuRE :End of MONITOR list"),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("NICK nobody")),
+		[]*irc.Message{
+			irc.ParseMessage(":mero!foo@robust/0x13b5aa0a2bcfb8ae NICK :nobody"),
+			irc.ParseMessage(":robustirc.net 731 sECuRE :mero"),
+			irc.ParseMessage(":robustirc.net 731 xeen :mero"),
+			irc.ParseMessage(":robustirc.net 730 sECuRE :nobody!foo@robust/0x13b5aa0a2bcfb8ae"),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MONITOR - mero"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MONITOR S")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 730 sECuRE :nobody!foo@robust/0x13b5aa0a2bcfb8ae"),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("QUIT")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 731 sECuRE :nobody"),
+			irc.ParseMessage(":nobody!foo@robust/0x13b5aa0a2bcfb8ae QUIT :"),
+			irc.ParseMessage("ERROR :Closing Link: nobody[robust/0x13b5aa0a2bcfb8ae] ()"),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MONITOR C"))
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MONITOR L")),
+		":robustirc.net 733 sECuRE :End of MONITOR list")
+}
+
+func TestKline(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("KLINE xeen :spamming")),
+		":robustirc.net 481 sECuRE :Permission Denied - You're not an IRC operator")
+
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("OPER mero foo"))
+
+	// 2015-01-02T19:50:18Z
+	now := int64(1420228218166687930)
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{Id: now}, ids["mero"], irc.ParseMessage("KLINE 60 xeen :spamming")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net NOTICE mero :Added K-line for xeen!*@* (expires Fri, 02 Jan 2015 20:50:18 UTC): spamming"),
+			irc.ParseMessage(":xeen!baz@robust/0x13b5aa0a2bcfb8af QUIT :K-lined"),
+			irc.ParseMessage(":robustirc.net 465 xeen :You are banned from this network: spamming"),
+			irc.ParseMessage("ERROR :Closing Link: xeen[robust/0x13b5aa0a2bcfb8af] (K-lined: spamming)"),
+		})
+
+	if _, ok := i.nicks[i.NickToLower("xeen")]; ok {
+		t.Fatalf("xeen still connected after being K-lined")
+	}
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{Id: now}, ids["mero"], irc.ParseMessage("STATS k")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 216 mero K xeen!*@* 1420231818 mero!foo@robust/0x13b5aa0a2bcfb8ae :spamming"),
+			irc.ParseMessage(":robustirc.net 219 mero k :End of /STATS report"),
+		})
+
+	newSession := func(id int64) types.RobustId {
+		sid := types.RobustId{Id: id}
+		i.CreateSession(sid, "auth-xeen")
+		i.ProcessMessage(types.RobustId{Id: id}, sid, irc.ParseMessage("NICK xeen"))
+		return sid
+	}
+
+	sid := newSession(now + 1)
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{Id: now + 2}, sid, irc.ParseMessage("USER baz 0 * :Iks Enn")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 465 xeen :You are banned from this network: spamming"),
+			irc.ParseMessage("ERROR :Closing Link: xeen[robust/0x13b5aa0a2bcfb8bb] (K-lined: spamming)"),
+		})
+
+	// After 60 minutes, the K-line expires.
+	later := now + int64(61*time.Minute)
+	sid = newSession(later)
+	i.ProcessMessage(types.RobustId{Id: later}, sid, irc.ParseMessage("USER baz 0 * :Iks Enn"))
+	if _, ok := i.nicks[i.NickToLower("xeen")]; !ok {
+		t.Fatalf("xeen could not log in after the K-line expired")
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{Id: later}, ids["mero"], irc.ParseMessage("STATS k")),
+		":robustirc.net 219 mero k :End of /STATS report")
+
+	i.ProcessMessage(types.RobustId{Id: later}, ids["mero"], irc.ParseMessage("GLINE *!baz@* :spamming"))
+	if _, ok := i.nicks[i.NickToLower("xeen")]; ok {
+		t.Fatalf("xeen still connected after being G-lined")
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{Id: later}, ids["mero"], irc.ParseMessage("UNKLINE *!baz@*")),
+		":robustirc.net NOTICE mero :Removed K-line for *!baz@*")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{Id: later}, ids["mero"], irc.ParseMessage("UNKLINE *!baz@*")),
+		":robustirc.net NOTICE mero :No K-line for *!baz@*")
+}
+
+func TestSpamFilter(t *testing.T) {
+	i, ids := stdIRCServer()
+	i.Config.MaxTargets = 2
+	i.Config.SpamFilters = []config.SpamFilter{
+		{
+			Name:    "links",
+			Pattern: `https?://spam\.example`,
+			Targets: []string{config.SpamFilterChannel, config.SpamFilterPrivate},
+			Action:  config.SpamFilterBlock,
+			Reason:  "No spam",
+		},
+		{
+			Name:    "bots",
+			Pattern: "spambot*",
+			Glob:    true,
+			Targets: []string{config.SpamFilterNick, config.SpamFilterRealname},
+			Action:  config.SpamFilterBlock,
+		},
+		{
+			Name:    "shop",
+			Pattern: "*buy now*",
+			Glob:    true,
+			Targets: []string{config.SpamFilterQuit},
+			Action:  config.SpamFilterBlock,
+		},
+		{
+			Name:        "ban",
+			Pattern:     "^banme$",
+			Targets:     []string{config.SpamFilterPrivate},
+			Action:      config.SpamFilterBan,
+			BanDuration: config.Duration(10 * time.Minute),
+		},
+		{
+			Name:    "kill",
+			Pattern: "^killme$",
+			Targets: []string{config.SpamFilterChannel},
+			Action:  config.SpamFilterKill,
+		},
+	}
+
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("OPER mero foo"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE mero +s s"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("PRIVMSG #test :see http://spam.example/")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net NOTICE mero :*** Notice -- Spam filter links matched channel of sECuRE (blah@robust/0x13b5aa0a2bcfb8ad), action: block"),
+			irc.ParseMessage(":robustirc.net 404 sECuRE #test :Message blocked by spam filter: No spam"),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("PRIVMSG xeen :HTTPS://SPAM.EXAMPLE")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net NOTICE mero :*** Notice -- Spam filter links matched private of sECuRE (blah@robust/0x13b5aa0a2bcfb8ad), action: block"),
+			irc.ParseMessage(":robustirc.net 404 sECuRE xeen :Message blocked by spam filter: No spam"),
+		})
+
+	// IRC operators are exempt.
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVMSG xeen :http://spam.example/")),
+		":mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG xeen :http://spam.example/")
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("NICK SpamBot42")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net NOTICE mero :*** Notice -- Spam filter bots matched nick of sECuRE (blah@robust/0x13b5aa0a2bcfb8ad), action: block"),
+			irc.ParseMessage(":robustirc.net 432 sECuRE SpamBot42 :Erroneous Nickname: Spam"),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("QUIT :Buy now!")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net NOTICE mero :*** Notice -- Spam filter shop matched quit of xeen (baz@robust/0x13b5aa0a2bcfb8af), action: block"),
+			irc.ParseMessage(":xeen!baz@robust/0x13b5aa0a2bcfb8af QUIT :"),
+			irc.ParseMessage("ERROR :Closing Link: xeen[robust/0x13b5aa0a2bcfb8af] ()"),
+		})
+
+	ids["spambot"] = types.RobustId{Id: 1420228218166687920}
+	i.CreateSession(ids["spambot"], "auth-spambot")
+	i.ProcessMessage(types.RobustId{}, ids["spambot"], irc.ParseMessage("NICK bob"))
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["spambot"], irc.ParseMessage("USER bob 0 * :SpamBot 2000")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net NOTICE mero :*** Notice -- Spam filter bots matched realname of bob (bob@robust/0x13b5aa0a2bcfb8b0), action: block"),
+			irc.ParseMessage("ERROR :Closing Link: bob[robust/0x13b5aa0a2bcfb8b0] (Killed by spam filter: Spam)"),
+		})
+
+	ids["alice"] = types.RobustId{Id: 1420228218166687921}
+	i.CreateSession(ids["alice"], "auth-alice")
+	i.ProcessMessage(types.RobustId{}, ids["alice"], irc.ParseMessage("NICK alice"))
+	i.ProcessMessage(types.RobustId{}, ids["alice"], irc.ParseMessage("USER alice 0 * :Alice"))
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{Id: 1420228218166687930}, ids["alice"], irc.ParseMessage("PRIVMSG sECuRE :banme")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net NOTICE mero :*** Notice -- Spam filter ban matched private of alice (alice@robust/0x13b5aa0a2bcfb8b1), action: ban"),
+			irc.ParseMessage(":alice!alice@robust/0x13b5aa0a2bcfb8b1 QUIT :Killed by spam filter: Spam"),
+			irc.ParseMessage("ERROR :Closing Link: alice[robust/0x13b5aa0a2bcfb8b1] (Killed by spam filter: Spam)"),
+		})
+	want := kline{
+		mask:    "alice!*@*",
+		setBy:   "robustirc.net",
+		setAt:   time.Unix(0, 1420228218166687930),
+		reason:  "Spam",
+		expires: time.Unix(0, 1420228218166687930).Add(10 * time.Minute),
+	}
+	if got := i.klines; len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Fatalf("unexpected K-lines: got %+v, want [%+v]", got, want)
+	}
+
+	// Reconnecting with the same nickname is rejected.
+	ids["alice2"] = types.RobustId{Id: 1420228218166687931}
+	i.CreateSession(ids["alice2"], "auth-alice2")
+	i.ProcessMessage(types.RobustId{Id: 1420228218166687932}, ids["alice2"], irc.ParseMessage("NICK alice"))
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{Id: 1420228218166687933}, ids["alice2"], irc.ParseMessage("USER alice 0 * :Alice")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 465 alice :You are banned from this network: Spam"),
+			irc.ParseMessage("ERROR :Closing Link: alice[robust/0x13b5aa0a2bcfb8bb] (K-lined: Spam)"),
+		})
+
+	// The message is not delivered to any of the targets.
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("PRIVMSG #test,mero :KILLME")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net NOTICE mero :*** Notice -- Spam filter kill matched channel of sECuRE (blah@robust/0x13b5aa0a2bcfb8ad), action: kill"),
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad QUIT :Killed by spam filter: Spam"),
+			irc.ParseMessage("ERROR :Closing Link: sECuRE[robust/0x13b5aa0a2bcfb8ad] (Killed by spam filter: Spam)"),
+		})
+
+	snapshot, err := i.Marshal(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewIRCServer("", "robustirc.net", time.Now())
+	if _, err := restored.Unmarshal(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.Config.SpamFilters, i.Config.SpamFilters) {
+		t.Fatalf("spam filters not restored from snapshot: got %+v, want %+v",
+			restored.Config.SpamFilters, i.Config.SpamFilters)
+	}
+}
+
+func TestKnock(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test2"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +i"))
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("KNOCK")),
+		":robustirc.net 461 xeen KNOCK :Not enough parameters")
+
+	mustMatchMsg(t,
 		i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("KNOCK #test3")),
 		":robustirc.net 480 xeen :Cannot knock on #test3 (Channel does not exist)")
 
@@ -1574,3 +2542,727 @@ func TestKnock(t *testing.T) {
 			irc.ParseMessage(":robustirc.net NOTICE xeen :Knocked on #test"),
 		})
 }
+
+func TestCapabilityNegotiation(t *testing.T) {
+	i := NewIRCServer("", "robustirc.net", time.Now())
+
+	id := types.RobustId{Id: time.Now().UnixNano()}
+	i.CreateSession(id, "authbytes")
+
+	s, err := i.GetSession(id)
+	if err != nil {
+		t.Fatalf("GetSession(%v) did not return a session", id)
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("CAP LS")),
+		":robustirc.net CAP * LS :account-notify account-tag away-notify batch cap-notify draft/chathistory draft/message-redaction echo-message extended-join labeled-response message-tags multi-prefix sasl server-time userhost-in-names")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("CAP LS 302")),
+		":robustirc.net CAP * LS :account-notify account-tag away-notify batch cap-notify draft/chathistory draft/message-redaction echo-message extended-join labeled-response message-tags multi-prefix sasl=PLAIN,EXTERNAL server-time userhost-in-names")
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("NICK secure")),
+		[]*irc.Message{})
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("USER blah 0 * :Michael Stapelberg")),
+		[]*irc.Message{})
+
+	if s.loggedIn() {
+		t.Fatalf("session.loggedIn() true before sending CAP END")
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("CAP REQ :cap-notify foobar")),
+		":robustirc.net CAP secure NAK :cap-notify foobar")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("CAP REQ :cap-notify")),
+		":robustirc.net CAP secure ACK :cap-notify")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("CAP LIST")),
+		":robustirc.net CAP secure LIST :cap-notify")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("CAP FOO")),
+		":robustirc.net 410 secure FOO :Invalid CAP command")
+
+	got := i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("CAP END"))
+	if len(got.Messages) < 1 || irc.ParseMessage(got.Messages[0].Data).Command != irc.RPL_WELCOME {
+		t.Fatalf("got %v, want irc.RPL_WELCOME", got)
+	}
+
+	if !s.loggedIn() {
+		t.Fatalf("session.loggedIn() still false after sending CAP END")
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("CAP REQ :-cap-notify")),
+		":robustirc.net CAP secure ACK :-cap-notify")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("CAP LIST")),
+		":robustirc.net CAP secure LIST :")
+
+	// CAP END after registration must not trigger another login.
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, id, irc.ParseMessage("CAP END")),
+		[]*irc.Message{})
+}
+
+func TestMessageTags(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("CAP REQ :server-time message-tags"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+
+	id := types.RobustId{Id: 1420228218166687920}
+	got := i.ProcessMessage(id, ids["mero"], irc.ParseMessage("PRIVMSG #test :foobar"))
+	if len(got.Messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(got.Messages))
+	}
+	if want := "@time=2015-01-02T19:50:18.166Z;msgid=1420228218166687920.1 :mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG #test :foobar"; got.Messages[0].Data != want {
+		t.Fatalf("got %q, want %q", got.Messages[0].Data, want)
+	}
+
+	got = i.ProcessMessage(id, ids["secure"], irc.ParseMessage("PRIVMSG #test :foobar"))
+	if len(got.Messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(got.Messages))
+	}
+	if want := ":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :foobar"; got.Messages[0].Data != want {
+		t.Fatalf("got %q, want %q", got.Messages[0].Data, want)
+	}
+
+	// The TOPIC message is split into two variants, followed by the message to
+	// the services.
+	got = i.ProcessMessage(id, ids["mero"], irc.ParseMessage("TOPIC #test :yeah"))
+	if len(got.Messages) != 3 {
+		t.Fatalf("got %d messages, want 3", len(got.Messages))
+	}
+	if want := ":mero!foo@robust/0x13b5aa0a2bcfb8ae TOPIC #test :yeah"; got.Messages[0].Data != want {
+		t.Fatalf("got %q, want %q", got.Messages[0].Data, want)
+	}
+	if !got.Messages[0].InterestingFor[ids["mero"].Id] || got.Messages[0].InterestingFor[ids["secure"].Id] {
+		t.Fatalf("untagged message sent to the wrong sessions: %v", got.Messages[0].InterestingFor)
+	}
+	if want := "@time=2015-01-02T19:50:18.166Z;msgid=1420228218166687920.1 :mero!foo@robust/0x13b5aa0a2bcfb8ae TOPIC #test :yeah"; got.Messages[1].Data != want {
+		t.Fatalf("got %q, want %q", got.Messages[1].Data, want)
+	}
+	if !got.Messages[1].InterestingFor[ids["secure"].Id] || got.Messages[1].InterestingFor[ids["mero"].Id] {
+		t.Fatalf("tagged message sent to the wrong sessions: %v", got.Messages[1].InterestingFor)
+	}
+	// Both variants are the same message, so they share the same id.
+	if got.Messages[0].Id != got.Messages[1].Id {
+		t.Fatalf("variants have different ids: %v, %v", got.Messages[0].Id, got.Messages[1].Id)
+	}
+}
+
+func TestPrivmsgTargets(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test +v mero"))
+
+	// An unset MaxTargets selects the default of 4.
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("PRIVMSG mero,xeen,#test,nobody,mero :hey")),
+		":robustirc.net 407 sECuRE mero,xeen,#test,nobody,mero :Too many recipients")
+
+	i.Config.MaxTargets = 1
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("PRIVMSG mero,xeen :hey")),
+		":robustirc.net 407 sECuRE mero,xeen :Too many recipients")
+
+	i.Config.MaxTargets = 3
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("PRIVMSG mero,#test,nobody :hey")),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG mero :hey"),
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :hey"),
+			irc.ParseMessage(":robustirc.net 401 sECuRE nobody :No such nick/channel"),
+		})
+
+	// STATUSMSG: only voiced users (or higher) receive the message.
+	got := i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("NOTICE +#test :ops and voices only"))
+	mustMatchMsg(t, got, ":xeen!baz@robust/0x13b5aa0a2bcfb8af NOTICE +#test :ops and voices only")
+	if want := map[int64]bool{ids["secure"].Id: true, ids["mero"].Id: true}; !reflect.DeepEqual(got.Messages[0].InterestingFor, want) {
+		t.Fatalf("got InterestingFor %v, want %v", got.Messages[0].InterestingFor, want)
+	}
+
+	got = i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVMSG @#test :ops only"))
+	mustMatchMsg(t, got, ":mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG @#test :ops only")
+	if want := map[int64]bool{ids["secure"].Id: true}; !reflect.DeepEqual(got.Messages[0].InterestingFor, want) {
+		t.Fatalf("got InterestingFor %v, want %v", got.Messages[0].InterestingFor, want)
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVMSG @#toast :ops only")),
+		":robustirc.net 403 mero @#toast :No such channel")
+}
+
+func TestEchoMessage(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("CAP REQ :echo-message"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+
+	got := i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("PRIVMSG #test :foobar"))
+	mustMatchMsg(t, got, ":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :foobar")
+	if !got.Messages[0].InterestingFor[ids["secure"].Id] || !got.Messages[0].InterestingFor[ids["mero"].Id] {
+		t.Fatalf("message not echoed: InterestingFor = %v", got.Messages[0].InterestingFor)
+	}
+
+	got = i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("NOTICE mero :hey"))
+	mustMatchMsg(t, got, ":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad NOTICE mero :hey")
+	if !got.Messages[0].InterestingFor[ids["secure"].Id] {
+		t.Fatalf("message not echoed: InterestingFor = %v", got.Messages[0].InterestingFor)
+	}
+
+	got = i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVMSG #test :foobar"))
+	if got.Messages[0].InterestingFor[ids["mero"].Id] {
+		t.Fatalf("message echoed without echo-message: InterestingFor = %v", got.Messages[0].InterestingFor)
+	}
+}
+
+func TestLabeledResponse(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("CAP REQ :batch labeled-response"))
+
+	// A single reply carries the label.
+	got := i.ProcessTaggedMessage(types.RobustId{Id: 1420228218166687920}, ids["secure"], "@label=a\\sb ", nil, irc.ParseMessage("MODE secure"))
+	if want := []string{"@label=a\\sb :sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE sECuRE :+"}; !reflect.DeepEqual(dataFor(got, ids["secure"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+
+	// No reply at all results in an ACK.
+	got = i.ProcessTaggedMessage(types.RobustId{Id: 1420228218166687921}, ids["secure"], "@label=1 ", nil, irc.ParseMessage("PRIVMSG mero :hey"))
+	if want := []string{
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG mero :hey",
+		"@label=1 :robustirc.net ACK",
+	}; !reflect.DeepEqual(dataFor(got, ids["mero"]), want[:1]) || !reflect.DeepEqual(dataFor(got, ids["secure"]), want[1:]) {
+		t.Fatalf("got %q and %q, want %q", dataFor(got, ids["mero"]), dataFor(got, ids["secure"]), want)
+	}
+
+	// Multiple replies are wrapped in a BATCH. The JOIN, which is also
+	// sent to mero, is only labeled for sECuRE.
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	got = i.ProcessTaggedMessage(types.RobustId{Id: 1420228218166687922}, ids["secure"], "@label=2 ", nil, irc.ParseMessage("JOIN #test"))
+	if want := []string{
+		"@label=2 :robustirc.net BATCH +13b5aa0a2bcfb8b2.1 labeled-response",
+		"@batch=13b5aa0a2bcfb8b2.1 :sECuRE!blah@robust/0x13b5aa0a2bcfb8ad JOIN :#test",
+		"@batch=13b5aa0a2bcfb8b2.1 :robustirc.net 331 sECuRE #test :No topic is set",
+		"@batch=13b5aa0a2bcfb8b2.1 :robustirc.net 353 sECuRE = #test :@mero sECuRE",
+		"@batch=13b5aa0a2bcfb8b2.1 :robustirc.net 366 sECuRE #test :End of /NAMES list.",
+		":robustirc.net BATCH -13b5aa0a2bcfb8b2.1",
+	}; !reflect.DeepEqual(dataFor(got, ids["secure"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+	if want := []string{":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad JOIN :#test"}; !reflect.DeepEqual(dataFor(got, ids["mero"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["mero"]), want)
+	}
+	// Clients resume after the last reply id they saw, so the ids must not
+	// decrease.
+	for idx := 1; idx < len(got.Messages); idx++ {
+		if prev, cur := got.Messages[idx-1].Id.Reply, got.Messages[idx].Id.Reply; cur < prev {
+			t.Fatalf("reply id %d follows %d", cur, prev)
+		}
+	}
+
+	// Labels are ignored for clients which did not negotiate labeled-response.
+	got = i.ProcessTaggedMessage(types.RobustId{Id: 1420228218166687923}, ids["mero"], "@label=3 ", nil, irc.ParseMessage("MODE mero"))
+	mustMatchMsg(t, got, ":mero!foo@robust/0x13b5aa0a2bcfb8ae MODE mero :+")
+}
+
+func TestClientTags(t *testing.T) {
+	i, ids := stdIRCServer()
+	i.Config.ClientTagDeny = []string{"*", "-typing", "-draft/react"}
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("CAP REQ :message-tags"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("CAP REQ :message-tags"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+
+	id := types.RobustId{Id: 1420228218166687920}
+	got := i.ProcessTaggedMessage(id, ids["secure"], "@+typing=active;+secret=1;label=x ", nil, irc.ParseMessage("TAGMSG #test"))
+	if want := []string{"@msgid=1420228218166687920.1;+typing=active :sECuRE!blah@robust/0x13b5aa0a2bcfb8ad TAGMSG #test"}; !reflect.DeepEqual(dataFor(got, ids["mero"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["mero"]), want)
+	}
+	// xeen did not negotiate message-tags.
+	if data := dataFor(got, ids["xeen"]); len(data) != 0 {
+		t.Fatalf("got %q, want no messages", data)
+	}
+
+	got = i.ProcessTaggedMessage(id, ids["secure"], "@+draft/react=\\s👍;+draft/reply=1420228218166687919.1 ", nil, irc.ParseMessage("PRIVMSG #test :nice"))
+	if want := []string{"@msgid=1420228218166687920.1;+draft/react=\\s👍 :sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :nice"}; !reflect.DeepEqual(dataFor(got, ids["mero"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["mero"]), want)
+	}
+	if want := []string{":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :nice"}; !reflect.DeepEqual(dataFor(got, ids["xeen"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["xeen"]), want)
+	}
+
+	// Client-only tags are ignored for clients which did not negotiate
+	// message-tags.
+	got = i.ProcessTaggedMessage(id, ids["xeen"], "@+typing=active ", nil, irc.ParseMessage("TAGMSG mero"))
+	if want := []string{"@msgid=1420228218166687920.1 :xeen!baz@robust/0x13b5aa0a2bcfb8af TAGMSG mero"}; !reflect.DeepEqual(dataFor(got, ids["mero"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["mero"]), want)
+	}
+}
+
+func TestChatHistory(t *testing.T) {
+	i, ids := stdIRCServer()
+	i.Config.ChatHistoryLimit = 10
+
+	var id int64 = 1420228218166687920
+	process := func(session types.RobustId, message string) *Replyctx {
+		id++
+		reply := i.ProcessMessage(types.RobustId{Id: id}, session, irc.ParseMessage(message))
+		i.SendMessages(reply, session, id)
+		return reply
+	}
+	// history processes the CHATHISTORY request |message| and expands the
+	// placeholder it results in, like the API does when delivering it.
+	history := func(session types.RobustId, message string) *Replyctx {
+		reply := process(session, message)
+		expanded := &Replyctx{}
+		for _, msg := range reply.Messages {
+			if !msg.History {
+				t.Fatalf("%q: got %q, want a CHATHISTORY placeholder", message, msg.Data)
+			}
+			expanded.Messages = append(expanded.Messages, i.ExpandHistory(session, msg)...)
+		}
+		return expanded
+	}
+
+	process(ids["secure"], "JOIN #test")
+	process(ids["mero"], "JOIN #test")
+	process(ids["secure"], "PRIVMSG #test :one")
+	process(ids["secure"], "PRIVMSG #test :two")
+	process(ids["mero"], "PRIVMSG #test :three")
+	process(ids["secure"], "PRIVMSG mero :psst")
+	process(ids["xeen"], "PRIVMSG secure :hey")
+
+	mustMatchIrcmsgs(t,
+		history(ids["mero"], "CHATHISTORY LATEST #test * 10"),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :one"),
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :two"),
+			irc.ParseMessage(":mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG #test :three"),
+		})
+
+	mustMatchIrcmsgs(t,
+		history(ids["mero"], "CHATHISTORY LATEST #test * 2"),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :two"),
+			irc.ParseMessage(":mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG #test :three"),
+		})
+
+	mustMatchIrcmsgs(t,
+		history(ids["mero"], "CHATHISTORY BEFORE #test msgid=1420228218166687925.1 10"),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :one"),
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :two"),
+		})
+
+	mustMatchIrcmsgs(t,
+		history(ids["mero"], "CHATHISTORY AFTER #test msgid=1420228218166687923.1 1"),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :two"),
+		})
+
+	mustMatchIrcmsgs(t,
+		history(ids["mero"], "CHATHISTORY AROUND #test msgid=1420228218166687924.1 3"),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :one"),
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :two"),
+			irc.ParseMessage(":mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG #test :three"),
+		})
+
+	mustMatchIrcmsgs(t,
+		history(ids["mero"], "CHATHISTORY BETWEEN #test msgid=1420228218166687925.1 timestamp=2015-01-02T19:50:18.000Z 10"),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :one"),
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :two"),
+		})
+
+	// Private queries contain messages in both directions.
+	mustMatchIrcmsgs(t,
+		history(ids["secure"], "CHATHISTORY LATEST mero * 10"),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG mero :psst"),
+		})
+	mustMatchIrcmsgs(t,
+		history(ids["secure"], "CHATHISTORY LATEST xeen * 10"),
+		[]*irc.Message{
+			irc.ParseMessage(":xeen!baz@robust/0x13b5aa0a2bcfb8af PRIVMSG secure :hey"),
+		})
+	mustMatchIrcmsgs(t,
+		history(ids["mero"], "CHATHISTORY LATEST xeen * 10"),
+		[]*irc.Message{})
+
+	// Tags and batches are sent when the capabilities were negotiated.
+	process(ids["mero"], "CAP REQ :batch server-time message-tags")
+	got := history(ids["mero"], "CHATHISTORY LATEST #test * 1")
+	want := []string{
+		":robustirc.net BATCH +13b5aa0a2bcfb8c2.1 chathistory #test",
+		"@batch=13b5aa0a2bcfb8c2.1;time=2015-01-02T19:50:18.166Z;msgid=1420228218166687925.1 :mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG #test :three",
+		":robustirc.net BATCH -13b5aa0a2bcfb8c2.1",
+	}
+	if len(got.Messages) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got.Messages), len(want))
+	}
+	for idx, msg := range got.Messages {
+		if msg.Data != want[idx] {
+			t.Fatalf("message %d: got %q, want %q", idx, msg.Data, want[idx])
+		}
+	}
+
+	// Labels of the request apply to its response.
+	process(ids["secure"], "CAP REQ :labeled-response")
+	id++
+	placeholder := i.ProcessTaggedMessage(types.RobustId{Id: id}, ids["secure"], "@label=x ", nil, irc.ParseMessage("CHATHISTORY LATEST mero * 10")).Messages[0]
+	if got, want := i.ExpandHistory(ids["secure"], placeholder), "@label=x :sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG mero :psst"; len(got) != 1 || got[0].Data != want {
+		t.Fatalf("got %v, want %q", got, want)
+	}
+
+	// The replicated output only contains the normalized request, so that
+	// it does not depend on the outputstream of any server.
+	got = process(ids["mero"], "CHATHISTORY BETWEEN #test msgid=1420228218166687925.1 timestamp=2015-01-02T19:50:18.000Z 10")
+	if want := []string{"CHATHISTORY BETWEEN #test msgid=1420228218166687925.1 msgid=1420228218000000000.0 10"}; !reflect.DeepEqual(dataFor(got, ids["mero"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["mero"]), want)
+	}
+
+	// Only members can retrieve the history of a channel.
+	mustMatchMsg(t,
+		process(ids["xeen"], "CHATHISTORY LATEST #test * 10"),
+		":robustirc.net FAIL CHATHISTORY INVALID_TARGET LATEST #test :Messages could not be retrieved")
+
+	mustMatchMsg(t,
+		process(ids["secure"], "CHATHISTORY LATEST #test * foo"),
+		":robustirc.net FAIL CHATHISTORY INVALID_PARAMS LATEST foo :Invalid limit")
+
+	mustMatchMsg(t,
+		process(ids["secure"], "CHATHISTORY FOO #test"),
+		":robustirc.net FAIL CHATHISTORY UNKNOWN_COMMAND FOO :Unknown command")
+}
+
+func TestChatHistoryLimitSnapshot(t *testing.T) {
+	i, _ := stdIRCServer()
+	// restore returns the ChatHistoryLimit after restoring a snapshot of |i|.
+	// If |unset| is true, the snapshot does not specify the limit.
+	restore := func(unset bool) int {
+		data, err := i.Marshal(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var snapshot pb.Snapshot
+		if err := proto.Unmarshal(data, &snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if unset {
+			snapshot.Config.ChatHistoryLimit = 0
+		}
+		if data, err = proto.Marshal(&snapshot); err != nil {
+			t.Fatal(err)
+		}
+		restored := NewIRCServer("", "robustirc.net", time.Now())
+		if _, err := restored.Unmarshal(data); err != nil {
+			t.Fatal(err)
+		}
+		return restored.Config.ChatHistoryLimit
+	}
+
+	// Snapshots which predate CHATHISTORY use the default limit, like a
+	// server which replays the log.
+	if got, want := restore(true), config.DefaultConfig.ChatHistoryLimit; got != want {
+		t.Fatalf("ChatHistoryLimit = %d, want %d", got, want)
+	}
+
+	i.Config.ChatHistoryLimit = 0
+	if got, want := restore(false), 0; got != want {
+		t.Fatalf("disabled ChatHistoryLimit restored as %d, want %d", got, want)
+	}
+
+	i.Config.ChatHistoryLimit = 25
+	if got, want := restore(false), 25; got != want {
+		t.Fatalf("ChatHistoryLimit = %d, want %d", got, want)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	i, ids := stdIRCServer()
+	i.Config.ChatHistoryLimit = 10
+
+	var id int64 = 1420228218166687920
+	process := func(session types.RobustId, message string) *Replyctx {
+		id++
+		reply := i.ProcessMessage(types.RobustId{Id: id}, session, irc.ParseMessage(message))
+		i.SendMessages(reply, session, id)
+		return reply
+	}
+
+	process(ids["secure"], "JOIN #test")
+	process(ids["mero"], "JOIN #test")
+	process(ids["secure"], "PRIVMSG #test :one")
+	process(ids["secure"], "PRIVMSG #test :my password is hunter2")
+	process(ids["mero"], "PRIVMSG #test :three")
+	process(ids["xeen"], "PRIVMSG secure :hey")
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("CAP REQ :draft/message-redaction"))
+
+	mustMatchMsg(t,
+		process(ids["mero"], "REDACT #test 1420228218166687924.1"),
+		":robustirc.net FAIL REDACT REDACT_FORBIDDEN #test 1420228218166687924.1 :You are not authorized to redact this message")
+
+	mustMatchMsg(t,
+		process(ids["mero"], "REDACT #test 1420228218166687999.1"),
+		":robustirc.net FAIL REDACT UNKNOWN_MSGID #test 1420228218166687999.1 :This message does not exist or is too old")
+
+	// Authors can redact their own messages. mero did not negotiate
+	// draft/message-redaction.
+	got := process(ids["mero"], "REDACT #test 1420228218166687925.1")
+	if want := []string{":mero!foo@robust/0x13b5aa0a2bcfb8ae REDACT #test 1420228218166687925.1"}; !reflect.DeepEqual(dataFor(got, ids["secure"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+	if data := dataFor(got, ids["mero"]); len(data) != 0 {
+		t.Fatalf("got %q, want no messages", data)
+	}
+
+	// Channel operators can redact any message in their channel.
+	got = process(ids["secure"], "REDACT #test 1420228218166687924.1 :oops")
+	if want := []string{":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad REDACT #test 1420228218166687924.1 :oops"}; !reflect.DeepEqual(dataFor(got, ids["secure"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+
+	mustMatchMsg(t,
+		process(ids["secure"], "REDACT #test 1420228218166687924.1"),
+		":robustirc.net FAIL REDACT UNKNOWN_MSGID #test 1420228218166687924.1 :This message does not exist or is too old")
+
+	placeholder := process(ids["mero"], "CHATHISTORY LATEST #test * 10").Messages[0]
+	mustMatchIrcmsgs(t,
+		&Replyctx{Messages: i.ExpandHistory(ids["mero"], placeholder)},
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad PRIVMSG #test :one"),
+		})
+
+	// Redacted messages are no longer served to clients.
+	msgs, _ := i.Get(types.RobustId{Id: 1420228218166687924})
+	if len(msgs) != 1 || msgs[0].Data != "" || len(msgs[0].InterestingFor) != 0 {
+		t.Fatalf("redacted message still served: %v", msgs)
+	}
+
+	got = process(ids["xeen"], "REDACT secure 1420228218166687926.1")
+	if want := []string{":xeen!baz@robust/0x13b5aa0a2bcfb8af REDACT secure 1420228218166687926.1"}; !reflect.DeepEqual(dataFor(got, ids["secure"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+
+	// Only the author can redact private messages.
+	mustMatchMsg(t,
+		process(ids["secure"], "REDACT xeen 1420228218166687926.1"),
+		":robustirc.net FAIL REDACT UNKNOWN_MSGID xeen 1420228218166687926.1 :This message does not exist or is too old")
+
+	// Whether a message can be redacted does not depend on the outputstream,
+	// which is empty after restoring a snapshot.
+	snapshot, err := i.Marshal(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewIRCServer("", "robustirc.net", time.Now())
+	if _, err := restored.Unmarshal(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.sentMessages, i.sentMessages) {
+		t.Fatalf("sent messages not restored from snapshot: got %v, want %v", restored.sentMessages, i.sentMessages)
+	}
+	got = restored.ProcessMessage(types.RobustId{Id: id + 1}, ids["secure"], irc.ParseMessage("REDACT #test 1420228218166687923.1"))
+	if want := []string{":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad REDACT #test 1420228218166687923.1"}; !reflect.DeepEqual(dataFor(got, ids["secure"]), want) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+
+	// Snapshots only contain the redactions of the last redactWindow.
+	i.lastProcessed = types.RobustId{Id: 1420228218166687924 + int64(redactWindow)}
+	if snapshot, err = i.Marshal(0); err != nil {
+		t.Fatal(err)
+	}
+	restored = NewIRCServer("", "robustirc.net", time.Now())
+	if _, err := restored.Unmarshal(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[types.RobustId]bool{{Id: 1420228218166687925, Reply: 1}: true, {Id: 1420228218166687926, Reply: 1}: true}; !reflect.DeepEqual(restored.redacted, want) {
+		t.Fatalf("redacted = %v after restoring the snapshot, want %v", restored.redacted, want)
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{Id: 1420228218166687923 + int64(redactWindow)}, ids["secure"], irc.ParseMessage("REDACT #test 1420228218166687923.1")),
+		":robustirc.net FAIL REDACT UNKNOWN_MSGID #test 1420228218166687923.1 :This message does not exist or is too old")
+}
+
+func TestSnomask(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE sECuRE +s")),
+		":robustirc.net 481 sECuRE :Permission Denied - You're not an IRC operator")
+
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("OPER mero foo"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE mero +s +ckx")),
+		[]*irc.Message{
+			irc.ParseMessage(":mero!foo@robust/0x13b5aa0a2bcfb8ae MODE mero :+s"),
+			irc.ParseMessage(":robustirc.net 008 mero +ck :Server notice mask"),
+		})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE mero +s +n-c")),
+		":robustirc.net 008 mero +kn :Server notice mask")
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("NICK secure_")),
+		[]*irc.Message{
+			irc.ParseMessage(":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad NICK :secure_"),
+			irc.ParseMessage(":robustirc.net NOTICE mero :*** Notice -- Nick change: From sECuRE to secure_ [blah@robust/0x13b5aa0a2bcfb8ad]"),
+		})
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("KILL xeen :spamming")),
+		[]*irc.Message{
+			irc.ParseMessage(":xeen!baz@robust/0x13b5aa0a2bcfb8af QUIT :Killed by mero: spamming"),
+			irc.ParseMessage(":mero!foo@robust/0x13b5aa0a2bcfb8ae KILL xeen :ircd!robust/0x13b5aa0a2bcfb8ae!mero (spamming)"),
+			irc.ParseMessage("ERROR :Closing Link: xeen[robust/0x13b5aa0a2bcfb8af] (Killed (mero (spamming)))"),
+			irc.ParseMessage(":robustirc.net NOTICE mero :*** Notice -- Received KILL message for xeen. From mero (spamming)"),
+		})
+
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE mero +s c"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("QUIT :bye")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net NOTICE mero :*** Notice -- Client exiting: secure_ (blah@robust/0x13b5aa0a2bcfb8ad)"),
+			irc.ParseMessage(":secure_!blah@robust/0x13b5aa0a2bcfb8ad QUIT :bye"),
+			irc.ParseMessage("ERROR :Closing Link: secure_[robust/0x13b5aa0a2bcfb8ad] (bye)"),
+		})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("MODE mero -s")),
+		":mero!foo@robust/0x13b5aa0a2bcfb8ae MODE mero :-s")
+
+	if got := i.nicks[i.NickToLower("mero")].snomask; got != "" {
+		t.Fatalf("snomask not cleared by -s: got %q", got)
+	}
+}
+
+func TestCaseMapping(t *testing.T) {
+	i, ids := stdIRCServer()
+
+	// Without a configured case mapping, the legacy case mapping is kept, so
+	// upgrading does not merge channels: [ and { are different in channel
+	// names.
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #legacy[1]"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #legacy{1}"))
+	snapshot, err := i.Marshal(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewIRCServer("", "robustirc.net", time.Now())
+	if _, err := restored.Unmarshal(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := restored.caseMapping, caseMappingLegacy; got != want {
+		t.Fatalf("restored case mapping = %q, want %q", got, want)
+	}
+	if got, want := len(restored.channels), 2; got != want {
+		t.Fatalf("len(channels) = %d after restoring the snapshot, want %d", got, want)
+	}
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("PART #legacy[1]"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PART #legacy{1}"))
+
+	// rfc1459 considers [ the upper case equivalent of {.
+	i.Config.CaseMapping = config.CaseMappingRFC1459
+	mustMatchIrcmsgs(t, i.UpdateCaseMapping(types.RobustId{}), []*irc.Message{})
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("NICK xeen{"))
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("NICK XEEN[")),
+		":robustirc.net 433 mero XEEN[ :Nickname is already in use")
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test[1]~"))
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #TEST{1}^"))
+	if got, want := len(i.channels), 1; got != want {
+		t.Fatalf("len(channels) = %d, want %d", got, want)
+	}
+
+	i.Config.CaseMapping = config.CaseMappingASCII
+	mustMatchIrcmsgs(t, i.UpdateCaseMapping(types.RobustId{}), []*irc.Message{})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("NICK XEEN[")),
+		":mero!foo@robust/0x13b5aa0a2bcfb8ae NICK :XEEN[")
+	if _, ok := i.channels[i.ChanToLower("#TEST[1]~")]; !ok {
+		t.Fatalf("channel #test[1]~ not found after switching case mappings")
+	}
+	if !i.sessions[ids["secure"]].Channels[i.ChanToLower("#Test[1]~")] {
+		t.Fatalf("sECuRE not in #test[1]~ after switching case mappings")
+	}
+
+	// xeen{ and XEEN[ collide when switching back to rfc1459. The session
+	// of XEEN[ (formerly mero) was created first, so xeen{ is renamed. Of
+	// the channels #test[1]~ and #test{1}^, the former is kept.
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test{1}^"))
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("MODE #test{1}^ +b spammer"))
+	snapshot, err = i.Marshal(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored = NewIRCServer("", "robustirc.net", time.Now())
+	if _, err := restored.Unmarshal(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := restored.caseMapping, config.CaseMappingASCII; got != want {
+		t.Fatalf("restored case mapping = %q, want %q", got, want)
+	}
+	restored.Config.CaseMapping = config.CaseMappingRFC1459
+	mustMatchIrcmsgs(t,
+		restored.UpdateCaseMapping(types.RobustId{Id: 1420228218166687920}),
+		[]*irc.Message{
+			irc.ParseMessage(":xeen{!baz@robust/0x13b5aa0a2bcfb8af NICK :Guest87919"),
+			irc.ParseMessage(":robustirc.net KICK #test{1}^ Guest87919 :Channel name collides with #test[1]~ after changing the case mapping"),
+		})
+
+	if got, want := restored.sessions[ids["mero"]].Nick, "XEEN["; got != want {
+		t.Fatalf("XEEN[ renamed to %q, want %q", got, want)
+	}
+	if got, want := restored.sessions[ids["xeen"]].Nick, "Guest87919"; got != want {
+		t.Fatalf("xeen{ renamed to %q, want %q", got, want)
+	}
+	c, ok := restored.channels[restored.ChanToLower("#test{1}^")]
+	if !ok || len(restored.channels) != 1 {
+		t.Fatalf("#test[1]~ and #test{1}^ not merged: %v", restored.channels)
+	}
+	if got, want := c.name, "#test[1]~"; got != want {
+		t.Fatalf("merged channel is %q, want %q", got, want)
+	}
+	if got, want := len(c.nicks), 2; got != want {
+		t.Fatalf("len(#test[1]~ members) = %d, want %d", got, want)
+	}
+	if got := len(restored.sessions[ids["xeen"]].Channels); got != 0 {
+		t.Fatalf("kicked session still in %d channels", got)
+	}
+	if len(c.bans) != 1 || c.bans[0].mask != "spammer!*@*" {
+		t.Fatalf("bans of #test{1}^ not merged into #test[1]~: %v", c.bans)
+	}
+
+	i.Config.CaseMapping = config.CaseMappingRFC7613
+	i.UpdateCaseMapping(types.RobustId{})
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("NICK Ünicode")),
+		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad NICK :Ünicode")
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("NICK üNICODE")),
+		":robustirc.net 433 XEEN[ üNICODE :Nickname is already in use")
+}
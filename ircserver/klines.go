@@ -0,0 +1,109 @@
+package ircserver
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// kline is a network-wide ban, set by an IRC operator using KLINE (or its
+// alias GLINE). Sessions matching a kline cannot log in.
+type kline struct {
+	mask   string
+	setBy  string
+	setAt  time.Time
+	reason string
+
+	// expires is the zero time for permanent klines.
+	expires time.Time
+}
+
+// expired returns true if |k| is no longer in effect at |now|. |now| must be
+// derived from a message id (not the wall clock) so that all servers agree.
+func (k kline) expired(now time.Time) bool {
+	return !k.expires.IsZero() && !now.Before(k.expires)
+}
+
+// expireKlines removes all klines which expired at |now|.
+func (i *IRCServer) expireKlines(now time.Time) {
+	active := i.klines[:0]
+	for _, k := range i.klines {
+		if !k.expired(now) {
+			active = append(active, k)
+		}
+	}
+	i.klines = active
+}
+
+// matchingKline returns the kline which |s| matches at |now|, if any.
+func (i *IRCServer) matchingKline(s *Session, now time.Time) (kline, bool) {
+	i.expireKlines(now)
+	prefix := s.ircPrefix.String()
+	for _, k := range i.klines {
+		if matchMask(k.mask, prefix) {
+			return k, true
+		}
+	}
+	return kline{}, false
+}
+
+// addKline adds |k| (replacing any kline with the same mask) and disconnects
+// all sessions which match it.
+func (i *IRCServer) addKline(reply *Replyctx, k kline) {
+	i.removeKline(k.mask)
+	i.klines = append(i.klines, k)
+
+	// Sort the matching sessions so that the output is deterministic.
+	var nicks []string
+	for nick, session := range i.nicks {
+		if session.Server || session.Id.Reply != 0 {
+			// Never disconnect services.
+			continue
+		}
+		if matchMask(k.mask, session.ircPrefix.String()) {
+			nicks = append(nicks, string(nick))
+		}
+	}
+	sort.Strings(nicks)
+	for _, nick := range nicks {
+		session := i.nicks[lcNick(nick)]
+		i.DeleteSession(session, reply)
+		i.sendServices(reply,
+			i.sendCommonChannels(session, reply, &irc.Message{
+				Prefix:   &session.ircPrefix,
+				Command:  irc.QUIT,
+				Trailing: "K-lined",
+			}))
+		i.sendKlined(session, reply, k)
+		i.sendSnotice(reply, snoKills, fmt.Sprintf("K-lined %s (%s@%s): %s",
+			session.Nick, session.ircPrefix.User, session.ircPrefix.Host, k.reason))
+	}
+}
+
+// removeKline removes the kline with |mask| and returns whether it existed.
+func (i *IRCServer) removeKline(mask string) bool {
+	for idx, k := range i.klines {
+		if i.NickToLower(k.mask) == i.NickToLower(mask) {
+			i.klines = append(i.klines[:idx], i.klines[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// sendKlined tells |s| that it is being disconnected because it matches |k|.
+func (i *IRCServer) sendKlined(s *Session, reply *Replyctx, k kline) {
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.ERR_YOUREBANNEDCREEP,
+		Params:   []string{s.Nick},
+		Trailing: "You are banned from this network: " + k.reason,
+	})
+
+	i.sendUser(s, reply, &irc.Message{
+		Command:  irc.ERROR,
+		Trailing: fmt.Sprintf("Closing Link: %s[%s] (K-lined: %s)", s.Nick, s.ircPrefix.Host, k.reason),
+	})
+}
@@ -0,0 +1,84 @@
+package ircserver
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// maxMonitorTargets is the maximum number of nicknames a session can monitor
+// using MONITOR, advertised in RPL_ISUPPORT.
+const maxMonitorTargets = 100
+
+// monitorTargets returns the nicknames monitored by |s|, sorted by their
+// lower-case form so that the output is deterministic.
+func monitorTargets(s *Session) []string {
+	keys := make([]string, 0, len(s.monitored))
+	for nick := range s.monitored {
+		keys = append(keys, string(nick))
+	}
+	sort.Strings(keys)
+	targets := make([]string, 0, len(keys))
+	for _, nick := range keys {
+		targets = append(targets, s.monitored[lcNick(nick)])
+	}
+	return targets
+}
+
+// sendMonitorStatus sends RPL_MONONLINE and RPL_MONOFFLINE to |s| for each
+// nickname in |targets|.
+func (i *IRCServer) sendMonitorStatus(s *Session, reply *Replyctx, targets []string) {
+	var online, offline []string
+	for _, target := range targets {
+		if session, ok := i.nicks[i.NickToLower(target)]; ok && session.loggedIn() {
+			online = append(online, session.ircPrefix.String())
+		} else {
+			offline = append(offline, target)
+		}
+	}
+	if len(online) > 0 {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  "730", // RPL_MONONLINE
+			Params:   []string{s.Nick},
+			Trailing: strings.Join(online, ","),
+		})
+	}
+	if len(offline) > 0 {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  "731", // RPL_MONOFFLINE
+			Params:   []string{s.Nick},
+			Trailing: strings.Join(offline, ","),
+		})
+	}
+}
+
+// notifyMonitors sends RPL_MONONLINE (if |online| is true) or RPL_MONOFFLINE
+// to all sessions which monitor the nickname of |prefix|.
+func (i *IRCServer) notifyMonitors(reply *Replyctx, prefix irc.Prefix, online bool) {
+	nick := i.NickToLower(prefix.Name)
+	var watchers []string
+	for watcherNick, session := range i.nicks {
+		if _, ok := session.monitored[nick]; ok && !session.deleted {
+			watchers = append(watchers, string(watcherNick))
+		}
+	}
+	// Sort the watchers so that the output is deterministic.
+	sort.Strings(watchers)
+	for _, watcherNick := range watchers {
+		watcher := i.nicks[lcNick(watcherNick)]
+		msg := &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  "731", // RPL_MONOFFLINE
+			Params:   []string{watcher.Nick},
+			Trailing: prefix.Name,
+		}
+		if online {
+			msg.Command = "730" // RPL_MONONLINE
+			msg.Trailing = prefix.String()
+		}
+		i.sendUser(watcher, reply, msg)
+	}
+}
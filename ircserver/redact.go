@@ -0,0 +1,145 @@
+package ircserver
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robustirc/robustirc/config"
+	"github.com/robustirc/robustirc/types"
+	"github.com/sorcix/irc"
+)
+
+// isRedacted returns true if the output message |id| was retracted using
+// REDACT. It can be called without holding sessionsMu.
+func (i *IRCServer) isRedacted(id types.RobustId) bool {
+	i.sessionsMu.RLock()
+	defer i.sessionsMu.RUnlock()
+	return i.redacted[id]
+}
+
+// redactWindow is how long after sending a PRIVMSG or NOTICE it can be
+// retracted using REDACT.
+const redactWindow = 1 * time.Hour
+
+// sentMessage is a PRIVMSG or NOTICE which can be retracted using REDACT. The
+// outputstream differs between servers, so REDACT must only rely on these
+// entries to decide whether a message can be retracted.
+type sentMessage struct {
+	id     types.RobustId
+	author int64 // session id
+
+	// recipient is the session id which a private message was sent to, or 0
+	// for channel messages.
+	recipient int64
+
+	// target is the channel name or, for private messages, the nickname
+	// which the message was sent to.
+	target string
+}
+
+// recordSent remembers |relayed|, which |s| sent to |target|, so that it can be
+// retracted using REDACT. |relayed| must be the message which was sent last.
+// Entries older than redactWindow are dropped.
+func (i *IRCServer) recordSent(s *Session, reply *Replyctx, relayed *irc.Message, target string, recipient int64) {
+	now := time.Unix(0, reply.msgid)
+	var expired int
+	for expired < len(i.sentMessages) && !now.Before(time.Unix(0, i.sentMessages[expired].id.Id).Add(redactWindow)) {
+		expired++
+	}
+	i.sentMessages = append(i.sentMessages[expired:], sentMessage{
+		// send returns the RobustMessage of |relayed| since it was sent last.
+		id:        i.send(reply, relayed).Id,
+		author:    s.Id.Id,
+		recipient: recipient,
+		target:    target,
+	})
+}
+
+// findSent returns the entry of i.sentMessages with id |id|.
+func (i *IRCServer) findSent(id types.RobustId) (sentMessage, bool) {
+	idx := sort.Search(len(i.sentMessages), func(n int) bool {
+		return !idLess(i.sentMessages[n].id, id)
+	})
+	if idx < len(i.sentMessages) && i.sentMessages[idx].id == id {
+		return i.sentMessages[idx], true
+	}
+	return sentMessage{}, false
+}
+
+// cmdRedact retracts a previously sent PRIVMSG or NOTICE, see
+// https://ircv3.net/specs/extensions/message-redaction
+//
+// e.g. “REDACT #test 1420228218166687920.1 :oops, password”
+func (i *IRCServer) cmdRedact(s *Session, reply *Replyctx, msg *irc.Message) {
+	fail := func(code string, context []string, description string) {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  "FAIL",
+			Params:   append([]string{"REDACT", code}, context...),
+			Trailing: description,
+		})
+	}
+
+	target := msg.Params[0]
+	var c *channel
+	if strings.HasPrefix(target, "#") {
+		var ok bool
+		c, ok = i.channels[i.ChanToLower(target)]
+		if !ok {
+			fail("INVALID_TARGET", []string{target}, "No such channel")
+			return
+		}
+		target = c.name
+	}
+
+	unknown := func() {
+		fail("UNKNOWN_MSGID", []string{target, msg.Params[1]}, "This message does not exist or is too old")
+	}
+	id, ok := parseHistoryRef("msgid=" + msg.Params[1])
+	if !ok || i.redacted[id] || !time.Unix(0, reply.msgid).Before(time.Unix(0, id.Id).Add(redactWindow)) {
+		unknown()
+		return
+	}
+	sent, ok := i.findSent(id)
+	if !ok {
+		unknown()
+		return
+	}
+	author := sent.author == s.Id.Id
+	if c != nil {
+		if sent.recipient != 0 || i.ChanToLower(sent.target) != i.ChanToLower(c.name) {
+			unknown()
+			return
+		}
+	} else if !(author && i.NickToLower(sent.target) == i.NickToLower(target)) && sent.recipient != s.Id.Id {
+		// Private messages are only known to their author and recipient.
+		unknown()
+		return
+	}
+
+	if !author && (c == nil ||
+		(!c.nicks[i.NickToLower(s.Nick)][chanop] && !i.hasPrivilege(s, config.PrivilegeOverride))) {
+		fail("REDACT_FORBIDDEN", []string{target, msg.Params[1]}, "You are not authorized to redact this message")
+		return
+	}
+
+	i.redacted[id] = true
+
+	redact := &irc.Message{
+		Prefix:   &s.ircPrefix,
+		Command:  "REDACT",
+		Params:   []string{target, msg.Params[1]},
+		Trailing: msg.Trailing,
+	}
+	if c != nil {
+		i.sendChannel(c, reply, redact)
+		return
+	}
+	// In a private conversation, the message was exchanged between |s| and
+	// |target|, in either direction.
+	if session, ok := i.nicks[i.NickToLower(target)]; ok {
+		i.sendUser(session, reply, redact)
+	}
+	i.sendUser(s, reply, redact)
+}
@@ -0,0 +1,187 @@
+package ircserver
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/robustirc/robustirc/types"
+	"github.com/sorcix/irc"
+)
+
+// saslMechanisms lists the SASL mechanisms which clients can use in
+// AUTHENTICATE. The actual authentication is done by the services.
+var saslMechanisms = []string{"PLAIN", "EXTERNAL"}
+
+// maxSaslChunk is the maximum length of a single AUTHENTICATE payload.
+const maxSaslChunk = 400
+
+// saslId identifies |s| in the SASL and SVSLOGIN messages exchanged with the
+// services, which cannot use the nickname because the session might not have
+// one yet.
+func saslId(s *Session) string {
+	return strconv.FormatInt(s.Id.Id, 10)
+}
+
+// saslNick returns the nickname to use in numeric replies to |s|.
+func saslNick(s *Session) string {
+	if s.Nick == "" {
+		return "*"
+	}
+	return s.Nick
+}
+
+func (i *IRCServer) sendSaslResult(s *Session, reply *Replyctx, command, text string) {
+	s.saslMechanism = ""
+	i.sendUser(s, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  command,
+		Params:   []string{saslNick(s)},
+		Trailing: text,
+	})
+}
+
+func (i *IRCServer) cmdAuthenticate(s *Session, reply *Replyctx, msg *irc.Message) {
+	if s.loggedIn() {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.ERR_ALREADYREGISTRED,
+			Params:   []string{s.Nick},
+			Trailing: "You may not reregister",
+		})
+		return
+	}
+
+	if len(i.serverSessions) == 0 {
+		i.sendSaslResult(s, reply, "904", "SASL authentication failed") // ERR_SASLFAIL
+		return
+	}
+
+	payload := msg.Params[0]
+	if s.saslMechanism == "" {
+		mechanism := strings.ToUpper(payload)
+		supported := false
+		for _, m := range saslMechanisms {
+			if m == mechanism {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			i.sendUser(s, reply, &irc.Message{
+				Prefix:   i.ServerPrefix,
+				Command:  "908", // RPL_SASLMECHS
+				Params:   []string{saslNick(s), strings.Join(saslMechanisms, ",")},
+				Trailing: "are available SASL mechanisms",
+			})
+			i.sendSaslResult(s, reply, "904", "SASL authentication failed") // ERR_SASLFAIL
+			return
+		}
+		s.saslMechanism = mechanism
+		// e.g. “SASL * 1420228218166687917 S PLAIN”
+		i.sendServices(reply, &irc.Message{
+			Prefix:  i.ServerPrefix,
+			Command: "SASL",
+			Params:  []string{"*", saslId(s), "S", mechanism},
+		})
+		return
+	}
+
+	if payload == "*" {
+		i.sendServices(reply, &irc.Message{
+			Prefix:  i.ServerPrefix,
+			Command: "SASL",
+			Params:  []string{"*", saslId(s), "D", "A"},
+		})
+		i.sendSaslResult(s, reply, "906", "SASL authentication aborted") // ERR_SASLABORTED
+		return
+	}
+
+	if len(payload) > maxSaslChunk {
+		i.sendServices(reply, &irc.Message{
+			Prefix:  i.ServerPrefix,
+			Command: "SASL",
+			Params:  []string{"*", saslId(s), "D", "A"},
+		})
+		i.sendSaslResult(s, reply, "905", "SASL message too long") // ERR_SASLTOOLONG
+		return
+	}
+
+	i.sendServices(reply, &irc.Message{
+		Prefix:  i.ServerPrefix,
+		Command: "SASL",
+		Params:  []string{"*", saslId(s), "C", payload},
+	})
+}
+
+// saslSession returns the session which |id| (see saslId) refers to.
+func (i *IRCServer) saslSession(reply *Replyctx, id string) (*Session, bool) {
+	if parsed, err := strconv.ParseInt(id, 10, 64); err == nil {
+		session, ok := i.sessions[types.RobustId{Id: parsed}]
+		if ok && !session.deleted && !session.Server {
+			return session, true
+		}
+	}
+	i.sendServices(reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  irc.ERR_NOSUCHNICK,
+		Params:   []string{"*", id},
+		Trailing: "No such nick/channel",
+	})
+	return nil, false
+}
+
+func (i *IRCServer) cmdServerSasl(s *Session, reply *Replyctx, msg *irc.Message) {
+	// e.g. “:services.robustirc.net SASL robustirc.net 1420228218166687917 C +”
+	session, ok := i.saslSession(reply, msg.Params[1])
+	if !ok {
+		return
+	}
+	var data string
+	if len(msg.Params) > 3 {
+		data = msg.Params[3]
+	} else {
+		data = msg.Trailing
+	}
+	switch msg.Params[2] {
+	case "C":
+		i.sendUser(session, reply, &irc.Message{
+			Command: irc.AUTHENTICATE,
+			Params:  []string{data},
+		})
+	case "M":
+		i.sendUser(session, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  "908", // RPL_SASLMECHS
+			Params:   []string{saslNick(session), data},
+			Trailing: "are available SASL mechanisms",
+		})
+	case "D":
+		switch data {
+		case "S":
+			i.sendSaslResult(session, reply, "903", "SASL authentication successful") // RPL_SASLSUCCESS
+		case "A":
+			i.sendSaslResult(session, reply, "906", "SASL authentication aborted") // ERR_SASLABORTED
+		default:
+			i.sendSaslResult(session, reply, "904", "SASL authentication failed") // ERR_SASLFAIL
+		}
+	}
+}
+
+func (i *IRCServer) cmdServerSvslogin(s *Session, reply *Replyctx, msg *irc.Message) {
+	// e.g. “:services.robustirc.net SVSLOGIN robustirc.net 1420228218166687917 secure”
+	session, ok := i.saslSession(reply, msg.Params[1])
+	if !ok {
+		return
+	}
+	account := msg.Params[2]
+	// The svid is sent to the services when the session registers, which
+	// logs the session into |account| before it joins any channels.
+	i.setSvid(session, reply, account)
+	mask := saslNick(session) + "!" + session.Username + "@" + session.ircPrefix.Host
+	i.sendUser(session, reply, &irc.Message{
+		Prefix:   i.ServerPrefix,
+		Command:  "900", // RPL_LOGGEDIN
+		Params:   []string{saslNick(session), mask, account},
+		Trailing: "You are now logged in as " + account,
+	})
+}
@@ -1,6 +1,8 @@
 package ircserver
 
 import (
+	"fmt"
+	"sort"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -19,12 +21,69 @@ func timeToTimestamp(t time.Time) *pb.Timestamp {
 }
 
 func timestampToTime(t *pb.Timestamp) time.Time {
-	if t.IsZero {
+	// t is nil for fields which were added after the snapshot was taken.
+	if t == nil || t.IsZero {
 		return time.Time{}
 	}
 	return time.Unix(0, t.UnixNano)
 }
 
+func floodCountersToProto(counters map[floodKey]*floodCounter) []*pb.Snapshot_Channel_FloodCounter {
+	result := make([]*pb.Snapshot_Channel_FloodCounter, 0, len(counters))
+	for key, counter := range counters {
+		result = append(result, &pb.Snapshot_Channel_FloodCounter{
+			Kind:    string(key.kind),
+			Session: key.session,
+			Start:   timeToTimestamp(counter.start),
+			Count:   int64(counter.count),
+		})
+	}
+	return result
+}
+
+func floodCountersFromProto(counters []*pb.Snapshot_Channel_FloodCounter) map[floodKey]*floodCounter {
+	if len(counters) == 0 {
+		return nil
+	}
+	result := make(map[floodKey]*floodCounter, len(counters))
+	for _, counter := range counters {
+		if counter.Kind == "" {
+			continue
+		}
+		result[floodKey{kind: counter.Kind[0], session: counter.Session}] = &floodCounter{
+			start: timestampToTime(counter.Start),
+			count: int(counter.Count),
+		}
+	}
+	return result
+}
+
+func maskEntriesToProto(entries []maskEntry) []*pb.Snapshot_Channel_MaskEntry {
+	result := make([]*pb.Snapshot_Channel_MaskEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, &pb.Snapshot_Channel_MaskEntry{
+			Mask:    entry.mask,
+			SetBy:   entry.setBy,
+			SetAt:   timeToTimestamp(entry.setAt),
+			Expires: timeToTimestamp(entry.expires),
+		})
+	}
+	return result
+}
+
+func maskEntriesFromProto(entries []*pb.Snapshot_Channel_MaskEntry) []maskEntry {
+	var result []maskEntry
+	for _, entry := range entries {
+		result = append(result, maskEntry{
+			mask:    entry.Mask,
+			setBy:   entry.SetBy,
+			setAt:   timestampToTime(entry.SetAt),
+			expires: timestampToTime(entry.Expires),
+		})
+	}
+	return result
+}
+
 func (i *IRCServer) Marshal(lastIncludedIndex uint64) ([]byte, error) {
 	i.sessionsMu.RLock()
 	defer i.sessionsMu.RUnlock()
@@ -46,6 +105,10 @@ func (i *IRCServer) Marshal(lastIncludedIndex uint64) ([]byte, error) {
 				modes = append(modes, string(mode))
 			}
 		}
+		capabilities := make([]string, 0, len(session.capabilities))
+		for capability := range session.capabilities {
+			capabilities = append(capabilities, capability)
+		}
 		sessions = append(sessions, &pb.Snapshot_Session{
 			Id:                 &pb.RobustId{Id: id.Id, Reply: id.Reply},
 			Auth:               session.auth,
@@ -55,6 +118,10 @@ func (i *IRCServer) Marshal(lastIncludedIndex uint64) ([]byte, error) {
 			Channels:           channels,
 			LastActivity:       timeToTimestamp(session.LastActivity),
 			Operator:           session.Operator,
+			OperName:           session.operName,
+			PassCredentials:    session.passCredentials,
+			Snomask:            session.snomask,
+			SaslMechanism:      session.saslMechanism,
 			AwayMsg:            session.AwayMsg,
 			ThrottlingExponent: int64(session.throttlingExponent),
 			InvitedTo:          invitedTo,
@@ -72,6 +139,9 @@ func (i *IRCServer) Marshal(lastIncludedIndex uint64) ([]byte, error) {
 				User: session.ircPrefix.User,
 				Host: session.ircPrefix.Host,
 			},
+			Capabilities:   capabilities,
+			Monitored:      monitorTargets(session),
+			CapNegotiating: session.capNegotiating,
 		})
 	}
 
@@ -94,13 +164,25 @@ func (i *IRCServer) Marshal(lastIncludedIndex uint64) ([]byte, error) {
 				modes = append(modes, string(mode))
 			}
 		}
+		var flood string
+		if channel.modes['f'] {
+			flood = channel.flood.String()
+		}
 		channels = append(channels, &pb.Snapshot_Channel{
-			Name:      channel.name,
-			TopicNick: channel.topicNick,
-			TopicTime: timeToTimestamp(channel.topicTime),
-			Topic:     channel.topic,
-			Nicks:     nicks,
-			Modes:     modes,
+			Name:             channel.name,
+			TopicNick:        channel.topicNick,
+			TopicTime:        timeToTimestamp(channel.topicTime),
+			Topic:            channel.topic,
+			Nicks:            nicks,
+			Modes:            modes,
+			Bans:             maskEntriesToProto(channel.bans),
+			BanExceptions:    maskEntriesToProto(channel.banExceptions),
+			InviteExceptions: maskEntriesToProto(channel.inviteExceptions),
+			Key:              channel.key,
+			Limit:            int64(channel.limit),
+			Flood:            flood,
+			FloodCounters:    floodCountersToProto(channel.floodCounters),
+			FloodLockExpires: timeToTimestamp(channel.floodLockExpires),
 		})
 	}
 
@@ -112,11 +194,39 @@ func (i *IRCServer) Marshal(lastIncludedIndex uint64) ([]byte, error) {
 			Reason:   svshold.reason,
 		}
 	}
+	whowas := make([]*pb.Snapshot_WhowasEntry, 0, len(i.whowas.entries))
+	for _, entry := range i.whowas.all() {
+		whowas = append(whowas, &pb.Snapshot_WhowasEntry{
+			Nick:     entry.nick,
+			Username: entry.username,
+			Host:     entry.host,
+			Realname: entry.realname,
+			Signoff:  timeToTimestamp(entry.signoff),
+		})
+	}
+	klines := make([]*pb.Snapshot_KLine, 0, len(i.klines))
+	for _, k := range i.klines {
+		klines = append(klines, &pb.Snapshot_KLine{
+			Mask:    k.mask,
+			SetBy:   k.setBy,
+			SetAt:   timeToTimestamp(k.setAt),
+			Reason:  k.reason,
+			Expires: timeToTimestamp(k.expires),
+		})
+	}
 	operators := make([]*pb.Snapshot_Config_IRC_Operator, 0, len(i.Config.IRC.Operators))
 	for _, ircop := range i.Config.IRC.Operators {
 		operators = append(operators, &pb.Snapshot_Config_IRC_Operator{
 			Name:     ircop.Name,
 			Password: ircop.Password,
+			Class:    ircop.Class,
+		})
+	}
+	operatorClasses := make([]*pb.Snapshot_Config_IRC_OperatorClass, 0, len(i.Config.IRC.OperatorClasses))
+	for _, class := range i.Config.IRC.OperatorClasses {
+		operatorClasses = append(operatorClasses, &pb.Snapshot_Config_IRC_OperatorClass{
+			Name:       class.Name,
+			Privileges: class.Privileges,
 		})
 	}
 	services := make([]*pb.Snapshot_Config_IRC_Service, 0, len(i.Config.IRC.Services))
@@ -125,14 +235,73 @@ func (i *IRCServer) Marshal(lastIncludedIndex uint64) ([]byte, error) {
 			Password: service.Password,
 		})
 	}
+	spamFilters := make([]*pb.Snapshot_Config_SpamFilter, 0, len(i.Config.SpamFilters))
+	for _, filter := range i.Config.SpamFilters {
+		spamFilters = append(spamFilters, &pb.Snapshot_Config_SpamFilter{
+			Name:        filter.Name,
+			Pattern:     filter.Pattern,
+			Glob:        filter.Glob,
+			Targets:     filter.Targets,
+			Action:      filter.Action,
+			BanDuration: filter.BanDuration.String(),
+			Reason:      filter.Reason,
+		})
+	}
+	// 0 means that the snapshot does not specify the limit, so a disabled
+	// CHATHISTORY is stored as -1.
+	chatHistoryLimit := int64(i.Config.ChatHistoryLimit)
+	if chatHistoryLimit <= 0 {
+		chatHistoryLimit = -1
+	}
 	config := &pb.Snapshot_Config{
 		Revision: uint64(i.Config.Revision),
 		Irc: &pb.Snapshot_Config_IRC{
-			Operators: operators,
-			Services:  services,
+			Operators:       operators,
+			Services:        services,
+			OperatorClasses: operatorClasses,
 		},
 		SessionExpiration:  i.Config.SessionExpiration.String(),
 		PostMessageCooloff: i.Config.PostMessageCooloff.String(),
+		ChatHistoryLimit:   chatHistoryLimit,
+		NetworkDescription: i.Config.NetworkDescription,
+		Motd:               i.Config.MOTD,
+		Admin: &pb.Snapshot_Config_Admin{
+			Name:     i.Config.Admin.Name,
+			Location: i.Config.Admin.Location,
+			Email:    i.Config.Admin.Email,
+		},
+		CaseMapping:   i.Config.CaseMapping,
+		ClientTagDeny: i.Config.ClientTagDeny,
+		MaxTargets:    int64(i.Config.MaxTargets),
+		SpamFilters:   spamFilters,
+	}
+	// Snapshots only contain messages which were compacted, i.e. deleted from
+	// the outputstream (see FSM.Snapshot). Hence, redactions of messages
+	// which were processed more than redactWindow before the last processed
+	// message can be dropped: the outputstream no longer contains them, and
+	// REDACT rejects them as too old. This bounds the redactions to those of
+	// the last redactWindow.
+	lastProcessed := time.Unix(0, i.lastProcessed.Id)
+	redactedIds := make([]types.RobustId, 0, len(i.redacted))
+	for id := range i.redacted {
+		if !time.Unix(0, id.Id).Add(redactWindow).After(lastProcessed) {
+			continue
+		}
+		redactedIds = append(redactedIds, id)
+	}
+	sort.Sort(robustIds(redactedIds))
+	redacted := make([]*pb.RobustId, 0, len(redactedIds))
+	for _, id := range redactedIds {
+		redacted = append(redacted, &pb.RobustId{Id: id.Id, Reply: id.Reply})
+	}
+	sentMessages := make([]*pb.Snapshot_SentMessage, 0, len(i.sentMessages))
+	for _, m := range i.sentMessages {
+		sentMessages = append(sentMessages, &pb.Snapshot_SentMessage{
+			Id:        &pb.RobustId{Id: m.id.Id, Reply: m.id.Reply},
+			Author:    m.author,
+			Recipient: m.recipient,
+			Target:    m.target,
+		})
 	}
 	snapshot := pb.Snapshot{
 		Sessions:          sessions,
@@ -141,6 +310,11 @@ func (i *IRCServer) Marshal(lastIncludedIndex uint64) ([]byte, error) {
 		LastProcessed:     &pb.RobustId{Id: i.lastProcessed.Id, Reply: i.lastProcessed.Reply},
 		Config:            config,
 		LastIncludedIndex: lastIncludedIndex,
+		Whowas:            whowas,
+		Klines:            klines,
+		CaseMapping:       i.caseMapping,
+		Redacted:          redacted,
+		SentMessages:      sentMessages,
 	}
 	return proto.Marshal(&snapshot)
 }
@@ -154,19 +328,35 @@ func (i *IRCServer) Unmarshal(data []byte) (uint64, error) {
 		return 0, err
 	}
 
+	// Restore the lower-case names as they were. The case mapping is only
+	// switched when the configuration changes (see UpdateCaseMapping), so
+	// the snapshot’s case mapping matches its configuration.
+	i.caseMapping = snapshot.CaseMapping
+	if i.caseMapping == "" {
+		i.caseMapping = caseMappingLegacy
+	}
+
 	for _, s := range snapshot.Sessions {
 		channels := make(map[lcChan]bool, len(s.Channels))
 		for _, channel := range s.Channels {
-			channels[ChanToLower(channel)] = true
+			channels[i.ChanToLower(channel)] = true
 		}
 		invitedTo := make(map[lcChan]bool, len(s.InvitedTo))
 		for _, channel := range s.InvitedTo {
-			invitedTo[ChanToLower(channel)] = true
+			invitedTo[i.ChanToLower(channel)] = true
 		}
 		var modes ['z']bool
 		for _, mode := range s.Modes {
 			modes[mode[0]] = true
 		}
+		capabilities := make(map[string]bool, len(s.Capabilities))
+		for _, capability := range s.Capabilities {
+			capabilities[capability] = true
+		}
+		monitored := make(map[lcNick]string, len(s.Monitored))
+		for _, nick := range s.Monitored {
+			monitored[i.NickToLower(nick)] = nick
+		}
 		newSession := &Session{
 			Id:                 types.RobustId{Id: s.Id.Id, Reply: s.Id.Reply},
 			auth:               s.Auth,
@@ -176,6 +366,10 @@ func (i *IRCServer) Unmarshal(data []byte) (uint64, error) {
 			Channels:           channels,
 			LastActivity:       timestampToTime(s.LastActivity),
 			Operator:           s.Operator,
+			operName:           s.OperName,
+			passCredentials:    s.PassCredentials,
+			snomask:            s.Snomask,
+			saslMechanism:      s.SaslMechanism,
 			AwayMsg:            s.AwayMsg,
 			throttlingExponent: int(s.ThrottlingExponent),
 			invitedTo:          invitedTo,
@@ -193,12 +387,15 @@ func (i *IRCServer) Unmarshal(data []byte) (uint64, error) {
 				User: s.IrcPrefix.User,
 				Host: s.IrcPrefix.Host,
 			},
+			capabilities:   capabilities,
+			monitored:      monitored,
+			capNegotiating: s.CapNegotiating,
 		}
 		i.sessions[newSession.Id] = newSession
 		if s.Server {
 			i.serverSessions = append(i.serverSessions, newSession.Id.Id)
 		}
-		i.nicks[NickToLower(newSession.Nick)] = newSession
+		i.nicks[i.NickToLower(newSession.Nick)] = newSession
 	}
 	for _, c := range snapshot.Channels {
 		nicks := make(map[lcNick]*[maxChanMemberStatus]bool, len(c.Nicks))
@@ -207,44 +404,95 @@ func (i *IRCServer) Unmarshal(data []byte) (uint64, error) {
 			for _, mode := range channelNickModes.Mode {
 				modes[mode[0]] = true
 			}
-			nicks[NickToLower(nickName)] = &modes
+			nicks[i.NickToLower(nickName)] = &modes
 		}
 		var modes ['z']bool
 		for _, mode := range c.Modes {
 			modes[mode[0]] = true
 		}
 		newChannel := channel{
-			name:      c.Name,
-			topicNick: c.TopicNick,
-			topicTime: timestampToTime(c.TopicTime),
-			topic:     c.Topic,
-			nicks:     nicks,
-			modes:     modes,
+			name:             c.Name,
+			topicNick:        c.TopicNick,
+			topicTime:        timestampToTime(c.TopicTime),
+			topic:            c.Topic,
+			nicks:            nicks,
+			modes:            modes,
+			bans:             maskEntriesFromProto(c.Bans),
+			banExceptions:    maskEntriesFromProto(c.BanExceptions),
+			inviteExceptions: maskEntriesFromProto(c.InviteExceptions),
+			key:              c.Key,
+			limit:            int(c.Limit),
+			floodCounters:    floodCountersFromProto(c.FloodCounters),
+			floodLockExpires: timestampToTime(c.FloodLockExpires),
+		}
+		if modes['f'] {
+			flood, ok := parseFloodSettings(c.Flood)
+			if !ok {
+				return 0, fmt.Errorf("channel %q: invalid flood settings %q", c.Name, c.Flood)
+			}
+			newChannel.flood = flood
 		}
-		i.channels[ChanToLower(newChannel.name)] = &newChannel
+		i.channels[i.ChanToLower(newChannel.name)] = &newChannel
 	}
 	for nickName, s := range snapshot.Svsholds {
 		duration, err := time.ParseDuration(s.Duration)
 		if err != nil {
 			return 0, err
 		}
-		i.svsholds[NickToLower(nickName)] = svshold{
+		i.svsholds[i.NickToLower(nickName)] = svshold{
 			added:    timestampToTime(s.Added),
 			duration: duration,
 			reason:   s.Reason,
 		}
 	}
+	for _, entry := range snapshot.Whowas {
+		i.whowas.add(whowasEntry{
+			nick:     entry.Nick,
+			username: entry.Username,
+			host:     entry.Host,
+			realname: entry.Realname,
+			signoff:  timestampToTime(entry.Signoff),
+		})
+	}
+	for _, k := range snapshot.Klines {
+		i.klines = append(i.klines, kline{
+			mask:    k.Mask,
+			setBy:   k.SetBy,
+			setAt:   timestampToTime(k.SetAt),
+			reason:  k.Reason,
+			expires: timestampToTime(k.Expires),
+		})
+	}
 	i.lastProcessed = types.RobustId{
 		Id:    snapshot.LastProcessed.Id,
 		Reply: snapshot.LastProcessed.Reply,
 	}
+	for _, id := range snapshot.Redacted {
+		i.redacted[types.RobustId{Id: id.Id, Reply: id.Reply}] = true
+	}
+	for _, m := range snapshot.SentMessages {
+		i.sentMessages = append(i.sentMessages, sentMessage{
+			id:        types.RobustId{Id: m.Id.Id, Reply: m.Id.Reply},
+			author:    m.Author,
+			recipient: m.Recipient,
+			target:    m.Target,
+		})
+	}
 	operators := make([]config.IRCOp, len(snapshot.Config.Irc.Operators))
 	for idx, operator := range snapshot.Config.Irc.Operators {
 		operators[idx] = config.IRCOp{
 			Name:     operator.Name,
 			Password: operator.Password,
+			Class:    operator.Class,
 		}
 	}
+	var operatorClasses []config.OperatorClass
+	for _, class := range snapshot.Config.Irc.OperatorClasses {
+		operatorClasses = append(operatorClasses, config.OperatorClass{
+			Name:       class.Name,
+			Privileges: class.Privileges,
+		})
+	}
 	services := make([]config.Service, len(snapshot.Config.Irc.Services))
 	for idx, service := range snapshot.Config.Irc.Services {
 		services[idx] = config.Service{
@@ -259,14 +507,53 @@ func (i *IRCServer) Unmarshal(data []byte) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
+	var spamFilters []config.SpamFilter
+	for _, filter := range snapshot.Config.SpamFilters {
+		banDuration, err := time.ParseDuration(filter.BanDuration)
+		if err != nil {
+			return 0, err
+		}
+		spamFilters = append(spamFilters, config.SpamFilter{
+			Name:        filter.Name,
+			Pattern:     filter.Pattern,
+			Glob:        filter.Glob,
+			Targets:     filter.Targets,
+			Action:      filter.Action,
+			BanDuration: config.Duration(banDuration),
+			Reason:      filter.Reason,
+		})
+	}
+	chatHistoryLimit := int(snapshot.Config.ChatHistoryLimit)
+	switch {
+	case chatHistoryLimit == 0:
+		// The snapshot predates CHATHISTORY.
+		chatHistoryLimit = config.DefaultConfig.ChatHistoryLimit
+	case chatHistoryLimit < 0:
+		chatHistoryLimit = 0
+	}
 	i.Config = config.Network{
 		Revision: int(snapshot.Config.Revision),
 		IRC: config.IRC{
-			Operators: operators,
-			Services:  services,
+			Operators:       operators,
+			Services:        services,
+			OperatorClasses: operatorClasses,
 		},
 		SessionExpiration:  config.Duration(sessionExpiration),
 		PostMessageCooloff: config.Duration(postMessageCooloff),
+		ChatHistoryLimit:   chatHistoryLimit,
+		NetworkDescription: snapshot.Config.NetworkDescription,
+		MOTD:               snapshot.Config.Motd,
+		CaseMapping:        snapshot.Config.CaseMapping,
+		ClientTagDeny:      snapshot.Config.ClientTagDeny,
+		MaxTargets:         int(snapshot.Config.MaxTargets),
+		SpamFilters:        spamFilters,
+	}
+	if admin := snapshot.Config.Admin; admin != nil {
+		i.Config.Admin = config.Admin{
+			Name:     admin.Name,
+			Location: admin.Location,
+			Email:    admin.Email,
+		}
 	}
 
 	return snapshot.LastIncludedIndex, nil
@@ -87,6 +87,18 @@ func init() {
 		Func:      (*IRCServer).cmdServerInvite,
 		MinParams: 2,
 	}
+	Commands["server_WALLOPS"] = &ircCommand{
+		Func: (*IRCServer).cmdServerWallops,
+	}
+	Commands["server_GLOBOPS"] = Commands["server_WALLOPS"]
+	Commands["server_SASL"] = &ircCommand{
+		Func:      (*IRCServer).cmdServerSasl,
+		MinParams: 3,
+	}
+	Commands["server_SVSLOGIN"] = &ircCommand{
+		Func:      (*IRCServer).cmdServerSvslogin,
+		MinParams: 3,
+	}
 }
 
 func servicesPrefix(prefix *irc.Prefix) *irc.Prefix {
@@ -99,7 +111,7 @@ func servicesPrefix(prefix *irc.Prefix) *irc.Prefix {
 func (i *IRCServer) cmdServerKick(s *Session, reply *Replyctx, msg *irc.Message) {
 	// e.g. “:ChanServ KICK #noname-ev blArgh_ :get out”
 	channelname := msg.Params[0]
-	c, ok := i.channels[ChanToLower(channelname)]
+	c, ok := i.channels[i.ChanToLower(channelname)]
 	if !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -110,7 +122,7 @@ func (i *IRCServer) cmdServerKick(s *Session, reply *Replyctx, msg *irc.Message)
 		return
 	}
 
-	if _, ok := c.nicks[NickToLower(msg.Params[1])]; !ok {
+	if _, ok := c.nicks[i.NickToLower(msg.Params[1])]; !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_USERNOTINCHANNEL,
@@ -121,7 +133,7 @@ func (i *IRCServer) cmdServerKick(s *Session, reply *Replyctx, msg *irc.Message)
 	}
 
 	// Must exist since c.nicks contains the nick.
-	session, _ := i.nicks[NickToLower(msg.Params[1])]
+	session, _ := i.nicks[i.NickToLower(msg.Params[1])]
 
 	i.sendServices(reply, i.sendChannel(c, reply, &irc.Message{
 		Prefix: &irc.Prefix{
@@ -136,9 +148,9 @@ func (i *IRCServer) cmdServerKick(s *Session, reply *Replyctx, msg *irc.Message)
 	}))
 
 	// TODO(secure): reduce code duplication with cmdPart()
-	delete(c.nicks, NickToLower(msg.Params[1]))
+	delete(c.nicks, i.NickToLower(msg.Params[1]))
 	i.maybeDeleteChannel(c)
-	delete(session.Channels, ChanToLower(channelname))
+	delete(session.Channels, i.ChanToLower(channelname))
 }
 
 func (i *IRCServer) cmdServerKill(s *Session, reply *Replyctx, msg *irc.Message) {
@@ -154,14 +166,14 @@ func (i *IRCServer) cmdServerKill(s *Session, reply *Replyctx, msg *irc.Message)
 
 	killPrefix := msg.Prefix
 	for id, session := range i.sessions {
-		if id.Id != s.Id.Id || id.Reply == 0 || NickToLower(session.Nick) != NickToLower(msg.Prefix.Name) {
+		if id.Id != s.Id.Id || id.Reply == 0 || i.NickToLower(session.Nick) != i.NickToLower(msg.Prefix.Name) {
 			continue
 		}
 		killPrefix = &session.ircPrefix
 		break
 	}
 
-	session, ok := i.nicks[NickToLower(msg.Params[0])]
+	session, ok := i.nicks[i.NickToLower(msg.Params[0])]
 	if !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -187,13 +199,35 @@ func (i *IRCServer) cmdServerKill(s *Session, reply *Replyctx, msg *irc.Message)
 			Command:  irc.QUIT,
 			Trailing: "Killed: " + msg.Trailing,
 		}))
-	i.DeleteSession(session, reply.msgid)
+	i.DeleteSession(session, reply)
+
+	i.sendSnotice(reply, snoKills, fmt.Sprintf("Received KILL message for %s. From %s (%s)",
+		session.Nick, killPrefix.Name, msg.Trailing))
+}
+
+func (i *IRCServer) cmdServerWallops(s *Session, reply *Replyctx, msg *irc.Message) {
+	if strings.TrimSpace(msg.Trailing) == "" {
+		i.sendServices(reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.ERR_NEEDMOREPARAMS,
+			Params:   []string{"*", msg.Command},
+			Trailing: "Not enough parameters",
+		})
+		return
+	}
+
+	// e.g. “:OperServ WALLOPS :Services are being restarted”
+	prefix := i.ServerPrefix
+	if msg.Prefix != nil {
+		prefix = servicesPrefix(msg.Prefix)
+	}
+	i.sendWallops(reply, prefix, msg.Trailing)
 }
 
 func (i *IRCServer) cmdServerQuit(s *Session, reply *Replyctx, msg *irc.Message) {
 	// No prefix means the server quits the entire session.
 	if msg.Prefix == nil {
-		i.DeleteSession(s, reply.msgid)
+		i.DeleteSession(s, reply)
 		// For services, we also need to delete all sessions that share the
 		// same .Id, but have a different .Reply.
 		for id, session := range i.sessions {
@@ -206,7 +240,7 @@ func (i *IRCServer) cmdServerQuit(s *Session, reply *Replyctx, msg *irc.Message)
 				Trailing:      msg.Trailing,
 				EmptyTrailing: true,
 			})
-			i.DeleteSession(session, reply.msgid)
+			i.DeleteSession(session, reply)
 		}
 		return
 	}
@@ -214,7 +248,7 @@ func (i *IRCServer) cmdServerQuit(s *Session, reply *Replyctx, msg *irc.Message)
 	// We got a prefix, so only a single session quits (e.g. nickname
 	// enforcer).
 	for id, session := range i.sessions {
-		if id.Id != s.Id.Id || id.Reply == 0 || NickToLower(session.Nick) != NickToLower(msg.Prefix.Name) {
+		if id.Id != s.Id.Id || id.Reply == 0 || i.NickToLower(session.Nick) != i.NickToLower(msg.Prefix.Name) {
 			continue
 		}
 		i.sendCommonChannels(session, reply, &irc.Message{
@@ -223,7 +257,7 @@ func (i *IRCServer) cmdServerQuit(s *Session, reply *Replyctx, msg *irc.Message)
 			Trailing:      msg.Trailing,
 			EmptyTrailing: true,
 		})
-		i.DeleteSession(session, reply.msgid)
+		i.DeleteSession(session, reply)
 		return
 	}
 }
@@ -238,7 +272,7 @@ func (i *IRCServer) cmdServerNick(s *Session, reply *Replyctx, msg *irc.Message)
 		return
 	}
 
-	if _, ok := i.nicks[NickToLower(msg.Params[0])]; ok {
+	if _, ok := i.nicks[i.NickToLower(msg.Params[0])]; ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_NICKNAMEINUSE,
@@ -258,16 +292,17 @@ func (i *IRCServer) cmdServerNick(s *Session, reply *Replyctx, msg *irc.Message)
 	i.CreateSession(id, "")
 	ss := i.sessions[id]
 	ss.Nick = msg.Params[0]
-	i.nicks[NickToLower(ss.Nick)] = ss
+	i.nicks[i.NickToLower(ss.Nick)] = ss
 	ss.Username = msg.Params[3]
 	ss.Realname = msg.Trailing
 	ss.updateIrcPrefix()
+	i.notifyMonitors(reply, ss.ircPrefix, true)
 }
 
 func (i *IRCServer) cmdServerMode(s *Session, reply *Replyctx, msg *irc.Message) {
 	channelname := msg.Params[0]
 	// TODO(secure): properly distinguish between users and channels
-	c, ok := i.channels[ChanToLower(channelname)]
+	c, ok := i.channels[i.ChanToLower(channelname)]
 	if !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -280,16 +315,54 @@ func (i *IRCServer) cmdServerMode(s *Session, reply *Replyctx, msg *irc.Message)
 
 	// TODO(secure): possibly refactor this with cmdMode()
 	modes := normalizeModes(msg)
-	for _, mode := range modes {
+	// applied contains the modes which are broadcast, i.e. all but mask list
+	// changes which are no-ops.
+	var applied modeCmds
+	for idx, mode := range modes {
 		char := mode.Mode[1]
 		newvalue := (mode.Mode[0] == '+')
 
 		switch char {
-		case 't', 's', 'r', 'i':
+		case 't', 's', 'r', 'i', 'n':
+			c.modes[char] = newvalue
+		case 'm':
 			c.modes[char] = newvalue
-		case 'o':
+			c.floodLockExpires = time.Time{}
+		case 'b', 'e', 'I':
+			if mode.Param == "" {
+				i.sendServices(reply, &irc.Message{
+					Prefix:   i.ServerPrefix,
+					Command:  irc.ERR_NEEDMOREPARAMS,
+					Params:   []string{msg.Prefix.Name, irc.MODE},
+					Trailing: "Not enough parameters",
+				})
+				continue
+			}
+			mask, changed := i.setMaskMode(c, mode, servicesPrefix(msg.Prefix).String(), reply)
+			if !changed {
+				continue
+			}
+			modes[idx].Param = mask
+		case 'k', 'l', 'f':
+			var param string
+			var ok bool
+			if char == 'f' {
+				param, ok = c.setFlood(mode)
+			} else {
+				param, ok = c.setKeyOrLimit(mode)
+			}
+			if !ok {
+				i.sendServices(reply, &irc.Message{
+					Prefix:   i.ServerPrefix,
+					Command:  irc.ERR_NEEDMOREPARAMS,
+					Params:   []string{msg.Prefix.Name, irc.MODE},
+					Trailing: "Not enough parameters",
+				})
+			}
+			modes[idx].Param = param
+		case 'o', 'h', 'v':
 			nick := mode.Param
-			perms, ok := c.nicks[NickToLower(nick)]
+			perms, ok := c.nicks[i.NickToLower(nick)]
 			if !ok {
 				i.sendServices(reply, &irc.Message{
 					Prefix:   i.ServerPrefix,
@@ -298,11 +371,9 @@ func (i *IRCServer) cmdServerMode(s *Session, reply *Replyctx, msg *irc.Message)
 					Trailing: "They aren't on that channel",
 				})
 			} else {
-				// If the user already is a chanop, silently do
+				// If the user already has that status, silently do
 				// nothing (like UnrealIRCd).
-				if perms[chanop] != newvalue {
-					c.nicks[NickToLower(nick)][chanop] = newvalue
-				}
+				perms[statusForMode(char)] = newvalue
 			}
 		default:
 			i.sendServices(reply, &irc.Message{
@@ -312,26 +383,24 @@ func (i *IRCServer) cmdServerMode(s *Session, reply *Replyctx, msg *irc.Message)
 				Trailing: "is unknown mode char to me",
 			})
 		}
+		applied = append(applied, modes[idx])
 	}
-	if reply.replyid > 0 {
+	if len(reply.Messages) > 0 || len(applied) == 0 {
 		return
 	}
 	i.sendChannel(c, reply, &irc.Message{
 		Prefix:  servicesPrefix(msg.Prefix),
 		Command: irc.MODE,
-		Params:  append([]string{channelname}, modeCmds(modes).IRCParams()...),
+		Params:  append([]string{channelname}, applied.IRCParams()...),
 	})
 }
 
 func (i *IRCServer) cmdServer(s *Session, reply *Replyctx, msg *irc.Message) {
-	authenticated := false
-	for _, service := range i.Config.IRC.Services {
-		if s.Pass == "services="+service.Password {
-			authenticated = true
-			break
-		}
-	}
-	if !authenticated {
+	// The services password was verified when the PASS message was
+	// accepted, see VerifyCredentials.
+	if !strings.HasPrefix(s.Pass, "services=") ||
+		!hasCredential(s.passCredentials, "services") ||
+		len(i.Config.IRC.Services) == 0 {
 		i.sendUser(s, reply, &irc.Message{
 			Command:  irc.ERROR,
 			Trailing: "Invalid password",
@@ -390,11 +459,7 @@ func (i *IRCServer) cmdServer(s *Session, reply *Replyctx, msg *irc.Message) {
 		}
 		sort.Strings(channelnames)
 		for _, channelname := range channelnames {
-			var prefix string
-
-			if i.channels[lcChan(channelname)].nicks[NickToLower(session.Nick)][chanop] {
-				prefix = prefix + string('@')
-			}
+			prefix := memberPrefix(i.channels[lcChan(channelname)].nicks[i.NickToLower(session.Nick)])
 			i.sendServices(reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
 				Command:  "SJOIN",
@@ -407,7 +472,7 @@ func (i *IRCServer) cmdServer(s *Session, reply *Replyctx, msg *irc.Message) {
 
 func (i *IRCServer) cmdServerSvshold(s *Session, reply *Replyctx, msg *irc.Message) {
 	// SVSHOLD <nick> [<expirationtimerelative> :<reason>]
-	nick := NickToLower(msg.Params[0])
+	nick := i.NickToLower(msg.Params[0])
 	if len(msg.Params) > 1 {
 		duration, err := time.ParseDuration(msg.Params[1] + "s")
 		if err != nil {
@@ -431,7 +496,7 @@ func (i *IRCServer) cmdServerSvshold(s *Session, reply *Replyctx, msg *irc.Messa
 
 func (i *IRCServer) cmdServerSvsjoin(s *Session, reply *Replyctx, msg *irc.Message) {
 	// SVSJOIN <nick> <chan>
-	nick := NickToLower(msg.Params[0])
+	nick := i.NickToLower(msg.Params[0])
 	channelname := msg.Params[1]
 
 	session, ok := i.nicks[nick]
@@ -454,13 +519,13 @@ func (i *IRCServer) cmdServerSvsjoin(s *Session, reply *Replyctx, msg *irc.Messa
 		})
 		return
 	}
-	c, ok := i.channels[ChanToLower(channelname)]
+	c, ok := i.channels[i.ChanToLower(channelname)]
 	if !ok {
 		c = &channel{
 			name:  channelname,
 			nicks: make(map[lcNick]*[maxChanMemberStatus]bool),
 		}
-		i.channels[ChanToLower(channelname)] = c
+		i.channels[i.ChanToLower(channelname)] = c
 	}
 	if _, ok := c.nicks[nick]; ok {
 		return
@@ -471,17 +536,14 @@ func (i *IRCServer) cmdServerSvsjoin(s *Session, reply *Replyctx, msg *irc.Messa
 	if !ok {
 		c.nicks[nick][chanop] = true
 	}
-	session.Channels[ChanToLower(channelname)] = true
+	session.Channels[i.ChanToLower(channelname)] = true
 
 	i.sendChannel(c, reply, &irc.Message{
 		Prefix:   &session.ircPrefix,
 		Command:  irc.JOIN,
 		Trailing: channelname,
 	})
-	var prefix string
-	if c.nicks[nick][chanop] {
-		prefix = prefix + string('@')
-	}
+	prefix := memberPrefix(c.nicks[nick])
 	i.sendServices(reply, &irc.Message{
 		Prefix:   i.ServerPrefix,
 		Command:  "SJOIN",
@@ -495,7 +557,7 @@ func (i *IRCServer) cmdServerSvsjoin(s *Session, reply *Replyctx, msg *irc.Messa
 
 func (i *IRCServer) cmdServerSvspart(s *Session, reply *Replyctx, msg *irc.Message) {
 	// SVSPART <nick> <chan>
-	nick := NickToLower(msg.Params[0])
+	nick := i.NickToLower(msg.Params[0])
 	channelname := msg.Params[1]
 
 	session, ok := i.nicks[nick]
@@ -509,7 +571,7 @@ func (i *IRCServer) cmdServerSvspart(s *Session, reply *Replyctx, msg *irc.Messa
 		return
 	}
 
-	c, ok := i.channels[ChanToLower(channelname)]
+	c, ok := i.channels[i.ChanToLower(channelname)]
 	if !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -538,11 +600,11 @@ func (i *IRCServer) cmdServerSvspart(s *Session, reply *Replyctx, msg *irc.Messa
 
 	delete(c.nicks, nick)
 	i.maybeDeleteChannel(c)
-	delete(session.Channels, ChanToLower(channelname))
+	delete(session.Channels, i.ChanToLower(channelname))
 }
 
 func (i *IRCServer) cmdServerSvsmode(s *Session, reply *Replyctx, msg *irc.Message) {
-	session, ok := i.nicks[NickToLower(msg.Params[0])]
+	session, ok := i.nicks[i.NickToLower(msg.Params[0])]
 	if !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -570,7 +632,7 @@ func (i *IRCServer) cmdServerSvsmode(s *Session, reply *Replyctx, msg *irc.Messa
 		char := mode.Mode[1]
 		switch char {
 		case 'd':
-			session.svid = mode.Param
+			i.setSvid(session, reply, mode.Param)
 		case 'r':
 			// Store registered flag
 			session.modes[char] = newvalue
@@ -599,7 +661,7 @@ func (i *IRCServer) cmdServerSvsmode(s *Session, reply *Replyctx, msg *irc.Messa
 
 func (i *IRCServer) cmdServerSvsnick(s *Session, reply *Replyctx, msg *irc.Message) {
 	// e.g. “SVSNICK blArgh Guest30503 :1425036445”
-	if !IsValidNickname(msg.Params[1]) {
+	if !i.isValidNickname(msg.Params[1]) {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_ERRONEUSNICKNAME,
@@ -609,7 +671,7 @@ func (i *IRCServer) cmdServerSvsnick(s *Session, reply *Replyctx, msg *irc.Messa
 		return
 	}
 
-	session, ok := i.nicks[NickToLower(msg.Params[0])]
+	session, ok := i.nicks[i.NickToLower(msg.Params[0])]
 	if !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -622,13 +684,14 @@ func (i *IRCServer) cmdServerSvsnick(s *Session, reply *Replyctx, msg *irc.Messa
 
 	// TODO(secure): kill this code duplication with cmdNick()
 	oldPrefix := session.ircPrefix
-	oldNick := NickToLower(msg.Params[0])
+	i.addWhowas(oldPrefix, session.Realname, reply.msgid)
+	oldNick := i.NickToLower(msg.Params[0])
 	session.Nick = msg.Params[1]
-	i.nicks[NickToLower(session.Nick)] = session
+	i.nicks[i.NickToLower(session.Nick)] = session
 	delete(i.nicks, oldNick)
 	for _, c := range i.channels {
 		if modes, ok := c.nicks[oldNick]; ok {
-			c.nicks[NickToLower(session.Nick)] = modes
+			c.nicks[i.NickToLower(session.Nick)] = modes
 		}
 		delete(c.nicks, oldNick)
 	}
@@ -640,6 +703,12 @@ func (i *IRCServer) cmdServerSvsnick(s *Session, reply *Replyctx, msg *irc.Messa
 				Command:  irc.NICK,
 				Trailing: session.Nick,
 			})))
+	if i.NickToLower(oldPrefix.Name) != i.NickToLower(session.Nick) {
+		i.notifyMonitors(reply, oldPrefix, false)
+		i.notifyMonitors(reply, session.ircPrefix, true)
+	}
+	i.sendSnotice(reply, snoNicks, fmt.Sprintf("Nick change: From %s to %s [%s@%s]",
+		oldPrefix.Name, session.Nick, session.ircPrefix.User, session.ircPrefix.Host))
 }
 
 func (i *IRCServer) cmdServerJoin(s *Session, reply *Replyctx, msg *irc.Message) {
@@ -656,7 +725,7 @@ func (i *IRCServer) cmdServerJoin(s *Session, reply *Replyctx, msg *irc.Message)
 			continue
 		}
 
-		nick := NickToLower(msg.Prefix.Name)
+		nick := i.NickToLower(msg.Prefix.Name)
 		session, ok := i.nicks[nick]
 		if !ok {
 			i.sendServices(reply, &irc.Message{
@@ -669,13 +738,13 @@ func (i *IRCServer) cmdServerJoin(s *Session, reply *Replyctx, msg *irc.Message)
 		}
 
 		// TODO(secure): reduce code duplication with cmdJoin()
-		c, ok := i.channels[ChanToLower(channelname)]
+		c, ok := i.channels[i.ChanToLower(channelname)]
 		if !ok {
 			c = &channel{
 				name:  channelname,
 				nicks: make(map[lcNick]*[maxChanMemberStatus]bool),
 			}
-			i.channels[ChanToLower(channelname)] = c
+			i.channels[i.ChanToLower(channelname)] = c
 		}
 		c.nicks[nick] = &[maxChanMemberStatus]bool{}
 		// If the channel did not exist before, the first joining user becomes a
@@ -683,7 +752,7 @@ func (i *IRCServer) cmdServerJoin(s *Session, reply *Replyctx, msg *irc.Message)
 		if !ok {
 			c.nicks[nick][chanop] = true
 		}
-		session.Channels[ChanToLower(channelname)] = true
+		session.Channels[i.ChanToLower(channelname)] = true
 
 		i.sendCommonChannels(session, reply, &irc.Message{
 			Prefix:   servicesPrefix(msg.Prefix),
@@ -696,7 +765,7 @@ func (i *IRCServer) cmdServerJoin(s *Session, reply *Replyctx, msg *irc.Message)
 func (i *IRCServer) cmdServerPart(s *Session, reply *Replyctx, msg *irc.Message) {
 	// e.g. “:ChanServ PART #noname-ev” (after enforcing AKICK).
 	for _, channelname := range strings.Split(msg.Params[0], ",") {
-		c, ok := i.channels[ChanToLower(channelname)]
+		c, ok := i.channels[i.ChanToLower(channelname)]
 		if !ok {
 			i.sendServices(reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
@@ -707,7 +776,7 @@ func (i *IRCServer) cmdServerPart(s *Session, reply *Replyctx, msg *irc.Message)
 			continue
 		}
 
-		if _, ok := c.nicks[NickToLower(msg.Prefix.Name)]; !ok {
+		if _, ok := c.nicks[i.NickToLower(msg.Prefix.Name)]; !ok {
 			i.sendServices(reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
 				Command:  irc.ERR_NOTONCHANNEL,
@@ -716,7 +785,7 @@ func (i *IRCServer) cmdServerPart(s *Session, reply *Replyctx, msg *irc.Message)
 			})
 			continue
 		}
-		session, _ := i.nicks[NickToLower(msg.Prefix.Name)]
+		session, _ := i.nicks[i.NickToLower(msg.Prefix.Name)]
 
 		i.sendCommonChannels(session, reply, &irc.Message{
 			Prefix:  servicesPrefix(msg.Prefix),
@@ -725,16 +794,16 @@ func (i *IRCServer) cmdServerPart(s *Session, reply *Replyctx, msg *irc.Message)
 		})
 
 		// TODO(secure): reduce code duplication with cmdPart()
-		delete(c.nicks, NickToLower(msg.Prefix.Name))
+		delete(c.nicks, i.NickToLower(msg.Prefix.Name))
 		i.maybeDeleteChannel(c)
-		delete(session.Channels, ChanToLower(channelname))
+		delete(session.Channels, i.ChanToLower(channelname))
 	}
 }
 
 func (i *IRCServer) cmdServerTopic(s *Session, reply *Replyctx, msg *irc.Message) {
 	// e.g. “:ChanServ TOPIC #chaos-hd ChanServ 0 :”
 	channel := msg.Params[0]
-	c, ok := i.channels[ChanToLower(channel)]
+	c, ok := i.channels[i.ChanToLower(channel)]
 	if !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -808,7 +877,7 @@ func (i *IRCServer) cmdServerPrivmsg(s *Session, reply *Replyctx, msg *irc.Messa
 	}
 
 	if strings.HasPrefix(msg.Params[0], "#") {
-		c, ok := i.channels[ChanToLower(msg.Params[0])]
+		c, ok := i.channels[i.ChanToLower(msg.Params[0])]
 		if !ok {
 			i.sendServices(reply, &irc.Message{
 				Prefix:   i.ServerPrefix,
@@ -828,7 +897,7 @@ func (i *IRCServer) cmdServerPrivmsg(s *Session, reply *Replyctx, msg *irc.Messa
 		return
 	}
 
-	session, ok := i.nicks[NickToLower(msg.Params[0])]
+	session, ok := i.nicks[i.NickToLower(msg.Params[0])]
 	if !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -853,7 +922,7 @@ func (i *IRCServer) cmdServerInvite(s *Session, reply *Replyctx, msg *irc.Messag
 	nickname := msg.Params[0]
 	channelname := msg.Params[1]
 
-	session, ok := i.nicks[NickToLower(nickname)]
+	session, ok := i.nicks[i.NickToLower(nickname)]
 	if !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -864,7 +933,7 @@ func (i *IRCServer) cmdServerInvite(s *Session, reply *Replyctx, msg *irc.Messag
 		return
 	}
 
-	c, ok := i.channels[ChanToLower(channelname)]
+	c, ok := i.channels[i.ChanToLower(channelname)]
 	if !ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
@@ -875,7 +944,7 @@ func (i *IRCServer) cmdServerInvite(s *Session, reply *Replyctx, msg *irc.Messag
 		return
 	}
 
-	if _, ok := c.nicks[NickToLower(nickname)]; ok {
+	if _, ok := c.nicks[i.NickToLower(nickname)]; ok {
 		i.sendServices(reply, &irc.Message{
 			Prefix:   i.ServerPrefix,
 			Command:  irc.ERR_USERONCHANNEL,
@@ -885,7 +954,7 @@ func (i *IRCServer) cmdServerInvite(s *Session, reply *Replyctx, msg *irc.Messag
 		return
 	}
 
-	session.invitedTo[ChanToLower(channelname)] = true
+	session.invitedTo[i.ChanToLower(channelname)] = true
 	i.sendServices(reply, &irc.Message{
 		Prefix:  i.ServerPrefix,
 		Command: irc.RPL_INVITING,
@@ -1,6 +1,7 @@
 package ircserver
 
 import (
+	"reflect"
 	"testing"
 	"time"
 
@@ -57,6 +58,31 @@ func TestServerHandshake(t *testing.T) {
 		})
 }
 
+func TestServerHashedPassword(t *testing.T) {
+	i, ids := stdIRCServer()
+	hash, err := config.HashPassword("mypass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Config.IRC.Services = append(i.Config.IRC.Services, config.Service{
+		Password: hash,
+	})
+
+	ids["services"] = types.RobustId{Id: 0x13c6cdee3e749faf}
+	i.CreateSession(ids["services"], "auth-server")
+
+	i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage("PASS :services="+hash))
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage("SERVER services.robustirc.net 1 :Services for IRC Networks")),
+		"ERROR :Invalid password")
+
+	i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage("PASS :services=mypass"))
+	i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage("SERVER services.robustirc.net 1 :Services for IRC Networks"))
+	if !i.sessions[ids["services"]].Server {
+		t.Fatalf("services could not authenticate using a hashed password")
+	}
+}
+
 func TestServerSjoin(t *testing.T) {
 	i, ids := stdIRCServerWithServices()
 
@@ -163,6 +189,11 @@ func TestServerSvsmode(t *testing.T) {
 		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE secure")),
 		":sECuRE!blah@robust/0x13b5aa0a2bcfb8ad MODE sECuRE :+")
 
+	mustMatchInterested(t, i,
+		ids["secure"], irc.ParseMessage("MODE secure"),
+		[]types.RobustId{ids["secure"], ids["mero"], ids["services"]},
+		[]bool{true, false, true})
+
 	mustMatchMsg(t,
 		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage("SVSMODE secure +r")),
 		":services.robustirc.net MODE sECuRE :+r")
@@ -265,6 +296,21 @@ func TestServerModeTopic(t *testing.T) {
 		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":ChanServ MODE #test +o mero")),
 		":robustirc.net 441 ChanServ mero #test :They aren't on that channel")
 
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":ChanServ MODE #test +bI *@evil.example mero")),
+		":ChanServ!services@services MODE #test +bI *!*@evil.example mero!*@*")
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("MODE #test b")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 367 sECuRE #test *!*@evil.example ChanServ!services@services 0"),
+			irc.ParseMessage(":robustirc.net 368 sECuRE #test :End of Channel Ban List"),
+		})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":ChanServ MODE #test -b *!*@evil.example")),
+		":ChanServ!services@services MODE #test -b *!*@evil.example")
+
 	mustMatchMsg(t,
 		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":ChanServ TOPIC #test ChanServ 0 :locked")),
 		":ChanServ!services@services TOPIC #test :locked")
@@ -324,7 +370,7 @@ func TestServerJoinPart(t *testing.T) {
 		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("WHO #test")),
 		[]*irc.Message{
 			irc.ParseMessage(":robustirc.net 352 sECuRE #test services robust/0x13c6cdee3e749faf robustirc.net ChanServ H :0 ChanServ"),
-			irc.ParseMessage(":robustirc.net 352 sECuRE #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H :0 Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 352 sECuRE #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H@ :0 Michael Stapelberg"),
 			irc.ParseMessage(":robustirc.net 315 sECuRE #test :End of /WHO list"),
 		})
 
@@ -337,7 +383,7 @@ func TestServerJoinPart(t *testing.T) {
 		[]*irc.Message{
 			irc.ParseMessage(":robustirc.net 352 sECuRE #test services robust/0x13c6cdee3e749faf robustirc.net ChanServ H :0 ChanServ"),
 			irc.ParseMessage(":robustirc.net 352 sECuRE #test services robust/0x13c6cdee3e749faf robustirc.net NickServ H :0 NickServ"),
-			irc.ParseMessage(":robustirc.net 352 sECuRE #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H :0 Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 352 sECuRE #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H@ :0 Michael Stapelberg"),
 			irc.ParseMessage(":robustirc.net 315 sECuRE #test :End of /WHO list"),
 		})
 
@@ -349,7 +395,7 @@ func TestServerJoinPart(t *testing.T) {
 		i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("WHO #test")),
 		[]*irc.Message{
 			irc.ParseMessage(":robustirc.net 352 sECuRE #test services robust/0x13c6cdee3e749faf robustirc.net NickServ H :0 NickServ"),
-			irc.ParseMessage(":robustirc.net 352 sECuRE #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H :0 Michael Stapelberg"),
+			irc.ParseMessage(":robustirc.net 352 sECuRE #test blah robust/0x13b5aa0a2bcfb8ad robustirc.net sECuRE H@ :0 Michael Stapelberg"),
 			irc.ParseMessage(":robustirc.net 315 sECuRE #test :End of /WHO list"),
 		})
 
@@ -500,3 +546,133 @@ func TestServerSvsjoin(t *testing.T) {
 		[]bool{true, false, true, true})
 
 }
+
+func TestServerSasl(t *testing.T) {
+	i, ids := stdIRCServerWithServices()
+
+	ids["new"] = types.RobustId{Id: 1420228218166687920}
+	i.CreateSession(ids["new"], "auth-new")
+
+	i.ProcessMessage(types.RobustId{}, ids["new"], irc.ParseMessage("CAP REQ :sasl"))
+	i.ProcessMessage(types.RobustId{}, ids["new"], irc.ParseMessage("NICK new"))
+	i.ProcessMessage(types.RobustId{}, ids["new"], irc.ParseMessage("USER new 0 * :New User"))
+
+	mustMatchIrcmsgs(t,
+		i.ProcessMessage(types.RobustId{}, ids["new"], irc.ParseMessage("AUTHENTICATE FOO")),
+		[]*irc.Message{
+			irc.ParseMessage(":robustirc.net 908 new PLAIN,EXTERNAL :are available SASL mechanisms"),
+			irc.ParseMessage(":robustirc.net 904 new :SASL authentication failed"),
+		})
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["new"], irc.ParseMessage("AUTHENTICATE PLAIN")),
+		":robustirc.net SASL * 1420228218166687920 S PLAIN")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":services.robustirc.net SASL robustirc.net 1420228218166687920 C +")),
+		"AUTHENTICATE +")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["new"], irc.ParseMessage("AUTHENTICATE bmV3AG5ldwBzM2NyM3Q=")),
+		":robustirc.net SASL * 1420228218166687920 C bmV3AG5ldwBzM2NyM3Q=")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":services.robustirc.net SVSLOGIN robustirc.net 1420228218166687920 new")),
+		":robustirc.net 900 new new!new@robust/0x13b5aa0a2bcfb8b0 new :You are now logged in as new")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":services.robustirc.net SASL robustirc.net 1420228218166687920 D S")),
+		":robustirc.net 903 new :SASL authentication successful")
+
+	// Registration completes after CAP END and introduces the session to the
+	// services with the account as svid.
+	reply := i.ProcessMessage(types.RobustId{}, ids["new"], irc.ParseMessage("CAP END"))
+	want := irc.ParseMessage("NICK new 1 1 new robust/0x13b5aa0a2bcfb8b0 robustirc.net new + :New User")
+	found := false
+	for _, msg := range reply.Messages {
+		if msg.Data == string(want.Bytes()) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("services not told about account: %v", reply.Messages)
+	}
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["new"], irc.ParseMessage("AUTHENTICATE PLAIN")),
+		":robustirc.net 462 new :You may not reregister")
+
+	mustMatchMsg(t,
+		i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":services.robustirc.net SVSLOGIN robustirc.net 42 new")),
+		":robustirc.net 401 * 42 :No such nick/channel")
+}
+
+// dataFor returns the data of all messages in |reply| which |session| receives.
+func dataFor(reply *Replyctx, session types.RobustId) []string {
+	var result []string
+	for _, msg := range reply.Messages {
+		if msg.InterestingFor[session.Id] {
+			result = append(result, msg.Data)
+		}
+	}
+	return result
+}
+
+func TestAccountCapabilities(t *testing.T) {
+	i, ids := stdIRCServerWithServices()
+
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("CAP REQ :account-notify account-tag away-notify extended-join"))
+	i.ProcessMessage(types.RobustId{}, ids["secure"], irc.ParseMessage("JOIN #test"))
+
+	got := i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	if want := ":mero!foo@robust/0x13b5aa0a2bcfb8ae JOIN #test * :Axel Wagner"; !reflect.DeepEqual(dataFor(got, ids["secure"]), []string{want}) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+	if want := ":mero!foo@robust/0x13b5aa0a2bcfb8ae JOIN :#test"; dataFor(got, ids["mero"])[0] != want {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["mero"])[0], want)
+	}
+
+	// A numeric svid does not reveal the account name.
+	got = i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":services.robustirc.net SVSMODE mero +d 1420228218"))
+	if data := dataFor(got, ids["secure"]); len(data) != 0 {
+		t.Fatalf("got %q, want no messages", data)
+	}
+
+	got = i.ProcessMessage(types.RobustId{}, ids["services"], irc.ParseMessage(":services.robustirc.net SVSMODE mero +d mero"))
+	if want := "@account=mero :mero!foo@robust/0x13b5aa0a2bcfb8ae ACCOUNT mero"; !reflect.DeepEqual(dataFor(got, ids["secure"]), []string{want}) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+	// mero did not negotiate account-notify.
+	if want := ":services.robustirc.net MODE mero :+"; !reflect.DeepEqual(dataFor(got, ids["mero"]), []string{want}) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["mero"]), want)
+	}
+
+	got = i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PRIVMSG #test :hi"))
+	if want := "@account=mero :mero!foo@robust/0x13b5aa0a2bcfb8ae PRIVMSG #test :hi"; !reflect.DeepEqual(dataFor(got, ids["secure"]), []string{want}) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+
+	i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("PART #test"))
+	got = i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("JOIN #test"))
+	if want := "@account=mero :mero!foo@robust/0x13b5aa0a2bcfb8ae JOIN #test mero :Axel Wagner"; !reflect.DeepEqual(dataFor(got, ids["secure"]), []string{want}) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+
+	got = i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("AWAY :lunch"))
+	if want := "@account=mero :mero!foo@robust/0x13b5aa0a2bcfb8ae AWAY :lunch"; !reflect.DeepEqual(dataFor(got, ids["secure"]), []string{want}) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+	if want := ":robustirc.net 306 mero :You have been marked as being away"; !reflect.DeepEqual(dataFor(got, ids["mero"]), []string{want}) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["mero"]), want)
+	}
+
+	// xeen did not negotiate away-notify.
+	i.ProcessMessage(types.RobustId{}, ids["xeen"], irc.ParseMessage("JOIN #test"))
+	got = i.ProcessMessage(types.RobustId{}, ids["mero"], irc.ParseMessage("AWAY"))
+	if want := "@account=mero :mero!foo@robust/0x13b5aa0a2bcfb8ae AWAY"; !reflect.DeepEqual(dataFor(got, ids["secure"]), []string{want}) {
+		t.Fatalf("got %q, want %q", dataFor(got, ids["secure"]), want)
+	}
+	if data := dataFor(got, ids["xeen"]); len(data) != 0 {
+		t.Fatalf("got %q, want no messages", data)
+	}
+}
@@ -0,0 +1,75 @@
+package ircserver
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/robustirc/robustirc/config"
+	"github.com/sorcix/irc"
+)
+
+// Server notice mask (snomask) categories, which IRC operators subscribe to
+// using “MODE <nick> +s <snomask>”, e.g. “MODE sECuRE +s +ck”.
+const (
+	snoConnects = 'c' // clients logging in and quitting
+	snoKills    = 'k' // KILLs and disconnects due to K-lines
+	snoNicks    = 'n' // nickname changes
+	snoOpers    = 'o' // clients becoming IRC operators
+	snoBans     = 'b' // K-lines being added or removed
+	snoFlood    = 'f' // channel flood protection being triggered
+	snoSpam     = 's' // spam filter matches
+)
+
+// snomaskCategories contains all snomask categories, sorted.
+const snomaskCategories = "bcfknos"
+
+// applySnomask applies |change| (e.g. “+ck-n” or “ck”) to the snomask
+// |current| and returns the new snomask, which contains the categories in
+// sorted order. Unknown categories are ignored.
+func applySnomask(current, change string) string {
+	enabled := make(map[rune]bool)
+	for _, category := range current {
+		enabled[category] = true
+	}
+	adding := true
+	for _, category := range change {
+		switch category {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		default:
+			enabled[category] = adding
+		}
+	}
+	var result []string
+	for _, category := range snomaskCategories {
+		if enabled[category] {
+			result = append(result, string(category))
+		}
+	}
+	return strings.Join(result, "")
+}
+
+// sendSnotice sends a server notice about |text| to all IRC operators who
+// subscribed to |category|.
+func (i *IRCServer) sendSnotice(reply *Replyctx, category rune, text string) {
+	var nicks []string
+	for nick, session := range i.nicks {
+		if session.modes['s'] && !session.deleted && i.hasPrivilege(session, config.PrivilegeSnomask) &&
+			strings.ContainsRune(session.snomask, category) {
+			nicks = append(nicks, string(nick))
+		}
+	}
+	// Sort the recipients so that the output is deterministic.
+	sort.Strings(nicks)
+	for _, nick := range nicks {
+		session := i.nicks[lcNick(nick)]
+		i.sendUser(session, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.NOTICE,
+			Params:   []string{session.Nick},
+			Trailing: "*** Notice -- " + text,
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package ircserver
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/robustirc/robustirc/config"
+	"github.com/sorcix/irc"
+)
+
+// defaultSpamFilterBanDuration is used for spam filter rules which do not
+// specify a BanDuration.
+const defaultSpamFilterBanDuration = 1 * time.Hour
+
+// spamFilterRegexp returns the compiled regular expression of |f|, or nil if it
+// does not compile (config.FromString rejects such rules).
+func (i *IRCServer) spamFilterRegexp(f config.SpamFilter) *regexp.Regexp {
+	expr := f.Expr()
+	if re, ok := i.spamFilterRegexps[expr]; ok {
+		return re
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		re = nil
+	}
+	if i.spamFilterRegexps == nil {
+		i.spamFilterRegexps = make(map[string]*regexp.Regexp)
+	}
+	i.spamFilterRegexps[expr] = re
+	return re
+}
+
+// matchSpamFilter returns the first rule of config.Network.SpamFilters which
+// applies to |target| (one of config.SpamFilterTargets) and matches |text|,
+// which |s| sent. Every match is counted and reported to IRC operators.
+func (i *IRCServer) matchSpamFilter(s *Session, reply *Replyctx, target, text string) (config.SpamFilter, bool) {
+	if s.Operator || s.Server || s.Id.Reply != 0 || text == "" {
+		return config.SpamFilter{}, false
+	}
+	for _, f := range i.Config.SpamFilters {
+		if !f.AppliesTo(target) {
+			continue
+		}
+		if re := i.spamFilterRegexp(f); re == nil || !re.MatchString(text) {
+			continue
+		}
+		spamFilterMatches.WithLabelValues(f.Name, target, f.Action).Inc()
+		i.sendSnotice(reply, snoSpam, fmt.Sprintf("Spam filter %s matched %s of %s (%s@%s), action: %s",
+			f.Name, target, s.Nick, s.ircPrefix.User, s.ircPrefix.Host, f.Action))
+		return f, true
+	}
+	return config.SpamFilter{}, false
+}
+
+// spamFilterReason returns the reason which is sent to users whose text
+// matched |f|.
+func spamFilterReason(f config.SpamFilter) string {
+	if f.Reason != "" {
+		return f.Reason
+	}
+	return "Spam"
+}
+
+// spamFilterBan adds the K-line which the SpamFilterBan action of |f| calls
+// for. |s| must already be deleted.
+//
+// Session hosts are unique per session and the IP address of clients is not
+// known, so the K-line matches the nickname of |s|, which is the only part of
+// the prefix that survives a reconnect. Users who reconnect with a different
+// nickname are not affected.
+func (i *IRCServer) spamFilterBan(s *Session, reply *Replyctx, f config.SpamFilter) {
+	now := time.Unix(0, reply.msgid)
+	duration := time.Duration(f.BanDuration)
+	if duration <= 0 {
+		duration = defaultSpamFilterBanDuration
+	}
+	i.addKline(reply, kline{
+		mask:    s.Nick + "!*@*",
+		setBy:   i.ServerPrefix.Name,
+		setAt:   now,
+		reason:  spamFilterReason(f),
+		expires: now.Add(duration),
+	})
+}
+
+// spamFilterDisconnect disconnects |s| as the SpamFilterKill or SpamFilterBan
+// action of |f| calls for. |announced| specifies whether the services and
+// channels know about |s|, i.e. whether a QUIT needs to be sent.
+func (i *IRCServer) spamFilterDisconnect(s *Session, reply *Replyctx, f config.SpamFilter, announced bool) {
+	reason := spamFilterReason(f)
+	i.DeleteSession(s, reply)
+	if f.Action == config.SpamFilterBan {
+		i.spamFilterBan(s, reply, f)
+	}
+	if announced {
+		i.sendServices(reply,
+			i.sendCommonChannels(s, reply, &irc.Message{
+				Prefix:   &s.ircPrefix,
+				Command:  irc.QUIT,
+				Trailing: "Killed by spam filter: " + reason,
+			}))
+	}
+	i.sendUser(s, reply, &irc.Message{
+		Command:  irc.ERROR,
+		Trailing: fmt.Sprintf("Closing Link: %s[%s] (Killed by spam filter: %s)", s.Nick, s.ircPrefix.Host, reason),
+	})
+}
+
+// spamFiltered applies the spam filter to the PRIVMSG or NOTICE text |text|
+// which |s| sent to |target| and returns true if the message must be dropped.
+// |kind| is config.SpamFilterChannel or config.SpamFilterPrivate.
+func (i *IRCServer) spamFiltered(s *Session, reply *Replyctx, kind, target, text string) bool {
+	f, ok := i.matchSpamFilter(s, reply, kind, text)
+	if !ok || f.Action == config.SpamFilterNotice {
+		return false
+	}
+	if f.Action == config.SpamFilterBlock {
+		i.sendUser(s, reply, &irc.Message{
+			Prefix:   i.ServerPrefix,
+			Command:  irc.ERR_CANNOTSENDTOCHAN,
+			Params:   []string{s.Nick, target},
+			Trailing: "Message blocked by spam filter: " + spamFilterReason(f),
+		})
+		return true
+	}
+	i.spamFilterDisconnect(s, reply, f, true)
+	return true
+}
@@ -0,0 +1,350 @@
+package ircserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robustirc/robustirc/types"
+	"github.com/sorcix/irc"
+)
+
+// serverTimeFormat is the timestamp format mandated by the IRCv3 server-time
+// specification, see http://ircv3.net/specs/extensions/server-time-3.2.html
+const serverTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// messageTags returns the IRCv3 message tags (without the leading “@”) which
+// |s| should receive for the output message with id |id| from |sender| (nil
+// for messages from the server), or the empty string if |s| did not negotiate
+// any capability which enables tags.
+//
+// The time and msgid tags are derived from the RobustId only, so that they are
+// identical on every server and when replaying the raft log.
+func messageTags(s *Session, id types.RobustId, sender *Session) string {
+	var tags []string
+	if s.capabilities["account-tag"] && sender != nil {
+		if account := sender.account(); account != "" {
+			tags = append(tags, "account="+account)
+		}
+	}
+	if s.capabilities["server-time"] {
+		tags = append(tags, "time="+time.Unix(0, id.Id).UTC().Format(serverTimeFormat))
+	}
+	if s.capabilities["message-tags"] {
+		tags = append(tags, "msgid="+id.String())
+	}
+	return strings.Join(tags, ";")
+}
+
+// messageFor returns the message which |s| should receive instead of |data|,
+// parsed as |parsed|, or the empty string if |s| should not receive the
+// message at all. ACCOUNT, AWAY, REDACT and TAGMSG are only sent to clients
+// which negotiated account-notify, away-notify, draft/message-redaction and
+// message-tags, respectively, and
+// JOIN carries the account and realname of |sender| for clients which
+// negotiated extended-join.
+func messageFor(s *Session, data string, parsed *irc.Message, sender *Session) string {
+	if parsed == nil {
+		return data
+	}
+	switch parsed.Command {
+	case "ACCOUNT":
+		if !s.capabilities["account-notify"] {
+			return ""
+		}
+	case irc.AWAY:
+		if !s.capabilities["away-notify"] || s == sender {
+			return ""
+		}
+	case "REDACT":
+		if !s.capabilities["draft/message-redaction"] {
+			return ""
+		}
+	case "TAGMSG":
+		if !s.capabilities["message-tags"] {
+			return ""
+		}
+	case irc.JOIN:
+		if !s.capabilities["extended-join"] || sender == nil {
+			return data
+		}
+		channelname := parsed.Trailing
+		if len(parsed.Params) > 0 {
+			channelname = parsed.Params[0]
+		}
+		account := sender.account()
+		if account == "" {
+			account = "*"
+		}
+		return (&irc.Message{
+			Prefix:        parsed.Prefix,
+			Command:       irc.JOIN,
+			Params:        []string{channelname, account},
+			Trailing:      sender.Realname,
+			EmptyTrailing: true,
+		}).String()
+	}
+	return data
+}
+
+// batchRef returns a reference tag for a new BATCH. It is derived from |id|,
+// the id of the message which starts the batch, and therefore unique within
+// the session.
+func batchRef(id types.RobustId) string {
+	return fmt.Sprintf("%x.%d", id.Id, id.Reply)
+}
+
+// tagValueEscaper and tagValueUnescaper convert tag values as described in
+// http://ircv3.net/specs/core/message-tags-3.2.html#escaping-values
+var (
+	tagValueEscaper   = strings.NewReplacer(";", "\\:", " ", "\\s", "\\", "\\\\", "\r", "\\r", "\n", "\\n")
+	tagValueUnescaper = strings.NewReplacer("\\:", ";", "\\s", " ", "\\\\", "\\", "\\r", "\r", "\\n", "\n")
+)
+
+// parseTags parses the IRCv3 message tags |raw|, as returned by
+// types.SplitTags, which a client sent along with its message.
+func parseTags(raw string) map[string]string {
+	raw = strings.TrimSpace(strings.TrimPrefix(raw, "@"))
+	if raw == "" {
+		return nil
+	}
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		if idx := strings.IndexByte(tag, '='); idx > -1 {
+			tags[tag[:idx]] = tagValueUnescaper.Replace(tag[idx+1:])
+		} else {
+			tags[tag] = ""
+		}
+	}
+	return tags
+}
+
+// clientTagAllowed returns whether clients may send the client-only tag
+// |name| (without the leading “+”), see config.Network.ClientTagDeny.
+func (i *IRCServer) clientTagAllowed(name string) bool {
+	for _, entry := range i.Config.ClientTagDeny {
+		if entry == "-"+name {
+			return true
+		}
+	}
+	for _, entry := range i.Config.ClientTagDeny {
+		if entry == "*" || entry == name {
+			return false
+		}
+	}
+	return true
+}
+
+// clientTags returns the client-only tags (e.g. “+typing=active”) in |tags|
+// which clients may send, in the format which messageTags uses.
+func (i *IRCServer) clientTags(tags map[string]string) string {
+	var names []string
+	for name := range tags {
+		if strings.HasPrefix(name, "+") && i.clientTagAllowed(name[1:]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for idx, name := range names {
+		if value := tags[name]; value != "" {
+			names[idx] = name + "=" + tagValueEscaper.Replace(value)
+		}
+	}
+	return strings.Join(names, ";")
+}
+
+// relayClientTags attaches the client-only tags of the incoming message to
+// |msg|, which must be the message which was sent last, for all recipients
+// which negotiated message-tags.
+func (i *IRCServer) relayClientTags(reply *Replyctx, msg *irc.Message) *irc.Message {
+	if reply.clientTags != "" {
+		if reply.relayed == nil {
+			reply.relayed = make(map[*types.RobustMessage]bool)
+		}
+		reply.relayed[i.send(reply, msg)] = true
+	}
+	return msg
+}
+
+// addTag prepends |tag| to the tags of the IRC message |data|.
+func addTag(tag, data string) string {
+	if strings.HasPrefix(data, "@") {
+		return "@" + tag + ";" + data[1:]
+	}
+	return "@" + tag + " " + data
+}
+
+// recipientData returns the data which each recipient of |msg| receives (see
+// messageTags and messageFor), keyed by session id. Recipients which should
+// not receive |msg| at all are omitted. Messages which already carry tags and
+// CHATHISTORY placeholders, which ExpandHistory tags, are left alone.
+func (i *IRCServer) recipientData(reply *Replyctx, msg *types.RobustMessage) map[int64]string {
+	result := make(map[int64]string, len(msg.InterestingFor))
+	if strings.HasPrefix(msg.Data, "@") || msg.History {
+		for sessionid := range msg.InterestingFor {
+			result[sessionid] = msg.Data
+		}
+		return result
+	}
+	parsed := irc.ParseMessage(msg.Data)
+	var sender *Session
+	if parsed != nil && parsed.Prefix != nil && parsed.Prefix.User != "" {
+		if s, ok := i.nicks[i.NickToLower(parsed.Prefix.Name)]; ok {
+			sender = s
+		}
+	}
+	var clientTags string
+	if reply.relayed[msg] {
+		clientTags = reply.clientTags
+	}
+	for sessionid := range msg.InterestingFor {
+		data := msg.Data
+		if s, ok := i.sessions[types.RobustId{Id: sessionid}]; ok {
+			data = messageFor(s, msg.Data, parsed, sender)
+			if data == "" {
+				continue
+			}
+			tags := messageTags(s, msg.Id, sender)
+			if clientTags != "" && s.capabilities["message-tags"] {
+				if tags != "" {
+					tags = tags + ";"
+				}
+				tags = tags + clientTags
+			}
+			if tags != "" {
+				data = "@" + tags + " " + data
+			}
+		}
+		result[sessionid] = data
+	}
+	return result
+}
+
+// labelMessages attaches the label which the client sent along with its
+// message to the replies it receives, see
+// http://ircv3.net/specs/extensions/labeled-response.html: a single reply
+// carries the label itself, multiple replies are wrapped in a labeled-response
+// BATCH and an ACK is sent if there is no reply at all. |datas| contains the
+// recipientData of each message in |reply| and is returned updated.
+func (i *IRCServer) labelMessages(reply *Replyctx, datas []map[int64]string) []map[int64]string {
+	s := reply.session
+	var count int
+	for _, data := range datas {
+		if _, ok := data[s.Id.Id]; ok {
+			count++
+		}
+	}
+	label := "label=" + tagValueEscaper.Replace(reply.label)
+
+	// sendLabeled sends |msg| to |s| only, tagged with |tag|.
+	sendLabeled := func(msg *irc.Message, tag string) map[int64]string {
+		robustmsg := i.send(reply, msg)
+		robustmsg.InterestingFor[s.Id.Id] = true
+		data := i.recipientData(reply, robustmsg)
+		data[s.Id.Id] = addTag(tag, data[s.Id.Id])
+		return data
+	}
+
+	switch {
+	case count == 0:
+		return append(datas, sendLabeled(&irc.Message{
+			Prefix:  i.ServerPrefix,
+			Command: "ACK",
+		}, label))
+	case count == 1:
+		for _, data := range datas {
+			if d, ok := data[s.Id.Id]; ok {
+				data[s.Id.Id] = addTag(label, d)
+			}
+		}
+		return datas
+	case !s.capabilities["batch"]:
+		return datas
+	}
+
+	// The start of the batch uses the reply id which ProcessTaggedMessage
+	// reserved, so that it precedes the messages it wraps and the reply ids
+	// stay in order.
+	startId := types.RobustId{Id: reply.msgid, Reply: reply.labelBatchId}
+	ref := batchRef(startId)
+	for _, data := range datas {
+		if d, ok := data[s.Id.Id]; ok {
+			data[s.Id.Id] = addTag("batch="+ref, d)
+		}
+	}
+	start := &types.RobustMessage{
+		Id: startId,
+		Data: string((&irc.Message{
+			Prefix:  i.ServerPrefix,
+			Command: "BATCH",
+			Params:  []string{"+" + ref, "labeled-response"},
+		}).Bytes()),
+		InterestingFor: map[int64]bool{s.Id.Id: true},
+	}
+	startData := i.recipientData(reply, start)
+	startData[s.Id.Id] = addTag(label, startData[s.Id.Id])
+	end := i.send(reply, &irc.Message{
+		Prefix:  i.ServerPrefix,
+		Command: "BATCH",
+		Params:  []string{"-" + ref},
+	})
+	end.InterestingFor[s.Id.Id] = true
+
+	reply.Messages = append([]*types.RobustMessage{start}, reply.Messages...)
+	result := make([]map[int64]string, 0, len(reply.Messages))
+	result = append(result, startData)
+	result = append(result, datas...)
+	return append(result, i.recipientData(reply, end))
+}
+
+// tagMessages splits each message in |reply| into one variant per distinct
+// data its recipients need, e.g. one untagged variant for clients which did
+// not negotiate any capabilities and one “@time=…” variant for clients which
+// negotiated server-time (see recipientData and labelMessages). All variants
+// keep the RobustId of the original message: each session is interested in at
+// most one of them, and the msgid tag refers to the same message for everyone.
+func (i *IRCServer) tagMessages(reply *Replyctx) {
+	datas := make([]map[int64]string, len(reply.Messages))
+	for idx, msg := range reply.Messages {
+		datas[idx] = i.recipientData(reply, msg)
+	}
+	if reply.label != "" {
+		datas = i.labelMessages(reply, datas)
+	}
+
+	result := make([]*types.RobustMessage, 0, len(reply.Messages))
+	for idx, msg := range reply.Messages {
+		if len(msg.InterestingFor) == 0 {
+			result = append(result, msg)
+			continue
+		}
+		variants := make(map[string]map[int64]bool)
+		for sessionid, data := range datas[idx] {
+			if _, ok := variants[data]; !ok {
+				variants[data] = make(map[int64]bool)
+			}
+			variants[data][sessionid] = true
+		}
+		if recipients, ok := variants[msg.Data]; len(variants) == 1 && ok && len(recipients) == len(msg.InterestingFor) {
+			result = append(result, msg)
+			continue
+		}
+		// Sort the variants so that the output is deterministic.
+		keys := make([]string, 0, len(variants))
+		for data := range variants {
+			keys = append(keys, data)
+		}
+		sort.Strings(keys)
+		for _, data := range keys {
+			variant := *msg
+			variant.InterestingFor = variants[data]
+			variant.Data = data
+			result = append(result, &variant)
+		}
+	}
+	reply.Messages = result
+}
@@ -0,0 +1,57 @@
+package ircserver
+
+import (
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// maxWhowasEntries is the number of nicknames which WHOWAS remembers. Once
+// the limit is reached, the oldest entries are overwritten.
+const maxWhowasEntries = 1000
+
+// whowasEntry describes a nickname which is no longer in use, either because
+// the session quit or because it changed its nickname.
+type whowasEntry struct {
+	nick     string
+	username string
+	host     string
+	realname string
+	signoff  time.Time
+}
+
+// whowasHistory is a ring buffer of the most recent whowasEntries.
+type whowasHistory struct {
+	entries []whowasEntry
+	// next is the index in entries which will be overwritten next once the
+	// ring buffer is full.
+	next int
+}
+
+func (h *whowasHistory) add(entry whowasEntry) {
+	if len(h.entries) < maxWhowasEntries {
+		h.entries = append(h.entries, entry)
+		return
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// all returns all entries in chronological order.
+func (h *whowasHistory) all() []whowasEntry {
+	result := make([]whowasEntry, 0, len(h.entries))
+	result = append(result, h.entries[h.next:]...)
+	return append(result, h.entries[:h.next]...)
+}
+
+// addWhowas records that |prefix| signed off (or changed its nickname) when
+// the message with id |msgid| was processed.
+func (i *IRCServer) addWhowas(prefix irc.Prefix, realname string, msgid int64) {
+	i.whowas.add(whowasEntry{
+		nick:     prefix.Name,
+		username: prefix.User,
+		host:     prefix.Host,
+		realname: realname,
+		signoff:  time.Unix(0, msgid),
+	})
+}
@@ -32,6 +32,7 @@ type Message struct {
 	Id             types.RobustId
 	Data           string
 	InterestingFor map[int64]bool
+	History        bool
 }
 
 type messageBatch struct {
@@ -301,6 +302,42 @@ func (os *OutputStream) GetNext(ctx context.Context, lastseen types.RobustId) []
 	}
 }
 
+// Iterate calls fn for all batches of IRC output messages which were
+// generated in reply to an input message whose id is within [start, end], in
+// ascending order or, if reverse is true, in descending order. Iteration stops
+// as soon as fn returns false. In contrast to GetNext, Iterate never blocks.
+func (os *OutputStream) Iterate(start, end int64, reverse bool, fn func(msgs []Message) bool) {
+	var startKey, limitKey [8]byte
+
+	os.messagesMu.RLock()
+	defer os.messagesMu.RUnlock()
+
+	binary.BigEndian.PutUint64(startKey[:], uint64(start))
+	r := &util.Range{Start: startKey[:]}
+	if end < math.MaxInt64 {
+		binary.BigEndian.PutUint64(limitKey[:], uint64(end)+1)
+		r.Limit = limitKey[:]
+	}
+	i := os.db.NewIterator(r, nil)
+	defer i.Release()
+	var ok bool
+	if reverse {
+		ok = i.Last()
+	} else {
+		ok = i.First()
+	}
+	for ok {
+		if !fn(unmarshalMessageBatch(i.Value()).Messages) {
+			return
+		}
+		if reverse {
+			ok = i.Prev()
+		} else {
+			ok = i.Next()
+		}
+	}
+}
+
 // InterruptGetNext interrupts any running GetNext() calls so that they return
 // if |cancelled| is specified and true in the GetNext() call.
 func (os *OutputStream) InterruptGetNext() {
@@ -202,3 +202,31 @@ func TestInterrupt(t *testing.T) {
 	default:
 	}
 }
+
+func TestIterate(t *testing.T) {
+	os, err := NewOutputStream("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id := int64(1); id <= 5; id++ {
+		addEmptyMsg(os, id, 1)
+	}
+
+	var got []int64
+	collect := func(msgs []Message) bool {
+		got = append(got, msgs[0].Id.Id)
+		return len(got) < 2
+	}
+
+	os.Iterate(2, 4, false, collect)
+	if len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatalf("Iterate(2, 4, false): got %v, want [2 3]", got)
+	}
+
+	got = nil
+	os.Iterate(2, 4, true, collect)
+	if len(got) != 2 || got[0] != 4 || got[1] != 3 {
+		t.Fatalf("Iterate(2, 4, true): got %v, want [4 3]", got)
+	}
+}
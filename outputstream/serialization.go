@@ -17,7 +17,8 @@ func (m *messageBatch) marshal() []byte {
 			unsafe.Sizeof(uint64(0)) /* len(Data) */ +
 			unsafe.Sizeof(byte(0))*uintptr(len(msg.Data)) /* Data */ +
 			unsafe.Sizeof(uint64(0)) /* len(InterestingFor) */ +
-			unsafe.Sizeof(uint64(0))*uintptr(len(msg.InterestingFor)) /* InterestingFor */
+			unsafe.Sizeof(uint64(0))*uintptr(len(msg.InterestingFor)) /* InterestingFor */ +
+			unsafe.Sizeof(byte(0)) /* History */
 	}
 
 	buffer := make([]byte, bufLen)
@@ -41,6 +42,10 @@ func (m *messageBatch) marshal() []byte {
 			binary.LittleEndian.PutUint64(buffer[n:], uint64(session))
 			n += 8
 		}
+		if msg.History {
+			buffer[n] = 1
+		}
+		n++
 	}
 	return buffer
 }
@@ -71,6 +76,8 @@ func unmarshalMessageBatch(buffer []byte) *messageBatch {
 			msg.InterestingFor[int64(binary.LittleEndian.Uint64(buffer[n:]))] = true
 			n += 8
 		}
+		msg.History = buffer[n] == 1
+		n++
 	}
 	return &result
 }
@@ -39,6 +39,19 @@ type Snapshot struct {
 	// snapshot in fsm.lastSnapshotState when restoring after ircstore
 	// was deleted.
 	LastIncludedIndex uint64 `protobuf:"varint,6,opt,name=last_included_index,json=lastIncludedIndex" json:"last_included_index,omitempty"`
+	// whowas contains the WHOWAS entries in chronological order.
+	Whowas []*Snapshot_WhowasEntry `protobuf:"bytes,7,rep,name=whowas" json:"whowas,omitempty"`
+	Klines []*Snapshot_KLine       `protobuf:"bytes,8,rep,name=klines" json:"klines,omitempty"`
+	// case_mapping is the case mapping which was used to compute the
+	// lower-case nicknames and channel names in this snapshot. Snapshots
+	// without a case_mapping use the legacy case mapping.
+	CaseMapping string `protobuf:"bytes,9,opt,name=case_mapping,json=caseMapping" json:"case_mapping,omitempty"`
+	// redacted contains the ids of output messages which were retracted
+	// using REDACT.
+	Redacted []*RobustId `protobuf:"bytes,10,rep,name=redacted" json:"redacted,omitempty"`
+	// sent_messages contains the PRIVMSGs and NOTICEs which can still be
+	// retracted using REDACT, in chronological order.
+	SentMessages []*Snapshot_SentMessage `protobuf:"bytes,11,rep,name=sent_messages,json=sentMessages" json:"sent_messages,omitempty"`
 }
 
 func (m *Snapshot) Reset()                    { *m = Snapshot{} }
@@ -81,6 +94,34 @@ func (m *Snapshot) GetConfig() *Snapshot_Config {
 	return nil
 }
 
+func (m *Snapshot) GetWhowas() []*Snapshot_WhowasEntry {
+	if m != nil {
+		return m.Whowas
+	}
+	return nil
+}
+
+func (m *Snapshot) GetKlines() []*Snapshot_KLine {
+	if m != nil {
+		return m.Klines
+	}
+	return nil
+}
+
+func (m *Snapshot) GetRedacted() []*RobustId {
+	if m != nil {
+		return m.Redacted
+	}
+	return nil
+}
+
+func (m *Snapshot) GetSentMessages() []*Snapshot_SentMessage {
+	if m != nil {
+		return m.SentMessages
+	}
+	return nil
+}
+
 type Snapshot_IRCPrefix struct {
 	Name string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
 	User string `protobuf:"bytes,2,opt,name=user" json:"user,omitempty"`
@@ -111,6 +152,15 @@ type Snapshot_Session struct {
 	StartId             *RobustId           `protobuf:"bytes,16,opt,name=start_id,json=startId" json:"start_id,omitempty"`
 	LastClientMessageId uint64              `protobuf:"varint,17,opt,name=last_client_message_id,json=lastClientMessageId" json:"last_client_message_id,omitempty"`
 	IrcPrefix           *Snapshot_IRCPrefix `protobuf:"bytes,18,opt,name=irc_prefix,json=ircPrefix" json:"irc_prefix,omitempty"`
+	Capabilities        []string            `protobuf:"bytes,19,rep,name=capabilities" json:"capabilities,omitempty"`
+	CapNegotiating      bool                `protobuf:"varint,20,opt,name=cap_negotiating,json=capNegotiating" json:"cap_negotiating,omitempty"`
+	Monitored           []string            `protobuf:"bytes,21,rep,name=monitored" json:"monitored,omitempty"`
+	OperName            string              `protobuf:"bytes,22,opt,name=oper_name,json=operName" json:"oper_name,omitempty"`
+	Snomask             string              `protobuf:"bytes,23,opt,name=snomask" json:"snomask,omitempty"`
+	SaslMechanism       string              `protobuf:"bytes,24,opt,name=sasl_mechanism,json=saslMechanism" json:"sasl_mechanism,omitempty"`
+	// pass_credentials are the credentials in the PASS message which were
+	// verified before applying it, see ircserver.VerifyCredentials.
+	PassCredentials []string `protobuf:"bytes,25,rep,name=pass_credentials,json=passCredentials" json:"pass_credentials,omitempty"`
 }
 
 func (m *Snapshot_Session) Reset()                    { *m = Snapshot_Session{} }
@@ -147,12 +197,21 @@ func (m *Snapshot_Session) GetIrcPrefix() *Snapshot_IRCPrefix {
 }
 
 type Snapshot_Channel struct {
-	Name      string                             `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
-	TopicNick string                             `protobuf:"bytes,2,opt,name=topic_nick,json=topicNick" json:"topic_nick,omitempty"`
-	TopicTime *Timestamp                         `protobuf:"bytes,3,opt,name=topic_time,json=topicTime" json:"topic_time,omitempty"`
-	Topic     string                             `protobuf:"bytes,4,opt,name=topic" json:"topic,omitempty"`
-	Nicks     map[string]*Snapshot_Channel_Modes `protobuf:"bytes,5,rep,name=nicks" json:"nicks,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
-	Modes     []string                           `protobuf:"bytes,6,rep,name=modes" json:"modes,omitempty"`
+	Name             string                             `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	TopicNick        string                             `protobuf:"bytes,2,opt,name=topic_nick,json=topicNick" json:"topic_nick,omitempty"`
+	TopicTime        *Timestamp                         `protobuf:"bytes,3,opt,name=topic_time,json=topicTime" json:"topic_time,omitempty"`
+	Topic            string                             `protobuf:"bytes,4,opt,name=topic" json:"topic,omitempty"`
+	Nicks            map[string]*Snapshot_Channel_Modes `protobuf:"bytes,5,rep,name=nicks" json:"nicks,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Modes            []string                           `protobuf:"bytes,6,rep,name=modes" json:"modes,omitempty"`
+	Bans             []*Snapshot_Channel_MaskEntry      `protobuf:"bytes,7,rep,name=bans" json:"bans,omitempty"`
+	BanExceptions    []*Snapshot_Channel_MaskEntry      `protobuf:"bytes,8,rep,name=ban_exceptions,json=banExceptions" json:"ban_exceptions,omitempty"`
+	InviteExceptions []*Snapshot_Channel_MaskEntry      `protobuf:"bytes,9,rep,name=invite_exceptions,json=inviteExceptions" json:"invite_exceptions,omitempty"`
+	Key              string                             `protobuf:"bytes,10,opt,name=key" json:"key,omitempty"`
+	Limit            int64                              `protobuf:"varint,11,opt,name=limit" json:"limit,omitempty"`
+	// flood is the parameter of the +f mode, e.g. “10m#k:15”.
+	Flood            string                           `protobuf:"bytes,12,opt,name=flood" json:"flood,omitempty"`
+	FloodCounters    []*Snapshot_Channel_FloodCounter `protobuf:"bytes,13,rep,name=flood_counters,json=floodCounters" json:"flood_counters,omitempty"`
+	FloodLockExpires *Timestamp                       `protobuf:"bytes,14,opt,name=flood_lock_expires,json=floodLockExpires" json:"flood_lock_expires,omitempty"`
 }
 
 func (m *Snapshot_Channel) Reset()                    { *m = Snapshot_Channel{} }
@@ -174,6 +233,41 @@ func (m *Snapshot_Channel) GetNicks() map[string]*Snapshot_Channel_Modes {
 	return nil
 }
 
+func (m *Snapshot_Channel) GetBans() []*Snapshot_Channel_MaskEntry {
+	if m != nil {
+		return m.Bans
+	}
+	return nil
+}
+
+func (m *Snapshot_Channel) GetBanExceptions() []*Snapshot_Channel_MaskEntry {
+	if m != nil {
+		return m.BanExceptions
+	}
+	return nil
+}
+
+func (m *Snapshot_Channel) GetInviteExceptions() []*Snapshot_Channel_MaskEntry {
+	if m != nil {
+		return m.InviteExceptions
+	}
+	return nil
+}
+
+func (m *Snapshot_Channel) GetFloodCounters() []*Snapshot_Channel_FloodCounter {
+	if m != nil {
+		return m.FloodCounters
+	}
+	return nil
+}
+
+func (m *Snapshot_Channel) GetFloodLockExpires() *Timestamp {
+	if m != nil {
+		return m.FloodLockExpires
+	}
+	return nil
+}
+
 // Modes is a workaround because proto3 does not support
 // map<string, repeated string>.
 type Snapshot_Channel_Modes struct {
@@ -185,6 +279,56 @@ func (m *Snapshot_Channel_Modes) String() string            { return proto1.Comp
 func (*Snapshot_Channel_Modes) ProtoMessage()               {}
 func (*Snapshot_Channel_Modes) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{1, 2, 0} }
 
+type Snapshot_Channel_MaskEntry struct {
+	// kind is one of “j”, “m” or “n”, see ircserver/flood.go.
+	Mask    string     `protobuf:"bytes,1,opt,name=mask" json:"mask,omitempty"`
+	SetBy   string     `protobuf:"bytes,2,opt,name=set_by,json=setBy" json:"set_by,omitempty"`
+	SetAt   *Timestamp `protobuf:"bytes,3,opt,name=set_at,json=setAt" json:"set_at,omitempty"`
+	Expires *Timestamp `protobuf:"bytes,4,opt,name=expires" json:"expires,omitempty"`
+}
+
+func (m *Snapshot_Channel_MaskEntry) Reset()         { *m = Snapshot_Channel_MaskEntry{} }
+func (m *Snapshot_Channel_MaskEntry) String() string { return proto1.CompactTextString(m) }
+func (*Snapshot_Channel_MaskEntry) ProtoMessage()    {}
+func (*Snapshot_Channel_MaskEntry) Descriptor() ([]byte, []int) {
+	return fileDescriptor1, []int{1, 2, 2}
+}
+
+func (m *Snapshot_Channel_MaskEntry) GetSetAt() *Timestamp {
+	if m != nil {
+		return m.SetAt
+	}
+	return nil
+}
+
+func (m *Snapshot_Channel_MaskEntry) GetExpires() *Timestamp {
+	if m != nil {
+		return m.Expires
+	}
+	return nil
+}
+
+type Snapshot_Channel_FloodCounter struct {
+	Kind    string     `protobuf:"bytes,1,opt,name=kind" json:"kind,omitempty"`
+	Session int64      `protobuf:"varint,2,opt,name=session" json:"session,omitempty"`
+	Start   *Timestamp `protobuf:"bytes,3,opt,name=start" json:"start,omitempty"`
+	Count   int64      `protobuf:"varint,4,opt,name=count" json:"count,omitempty"`
+}
+
+func (m *Snapshot_Channel_FloodCounter) Reset()         { *m = Snapshot_Channel_FloodCounter{} }
+func (m *Snapshot_Channel_FloodCounter) String() string { return proto1.CompactTextString(m) }
+func (*Snapshot_Channel_FloodCounter) ProtoMessage()    {}
+func (*Snapshot_Channel_FloodCounter) Descriptor() ([]byte, []int) {
+	return fileDescriptor1, []int{1, 2, 3}
+}
+
+func (m *Snapshot_Channel_FloodCounter) GetStart() *Timestamp {
+	if m != nil {
+		return m.Start
+	}
+	return nil
+}
+
 type Snapshot_SVSHold struct {
 	Added    *Timestamp `protobuf:"bytes,1,opt,name=added" json:"added,omitempty"`
 	Duration string     `protobuf:"bytes,2,opt,name=duration" json:"duration,omitempty"`
@@ -204,10 +348,18 @@ func (m *Snapshot_SVSHold) GetAdded() *Timestamp {
 }
 
 type Snapshot_Config struct {
-	Revision           uint64               `protobuf:"varint,1,opt,name=revision" json:"revision,omitempty"`
-	Irc                *Snapshot_Config_IRC `protobuf:"bytes,2,opt,name=irc" json:"irc,omitempty"`
-	SessionExpiration  string               `protobuf:"bytes,3,opt,name=session_expiration,json=sessionExpiration" json:"session_expiration,omitempty"`
-	PostMessageCooloff string               `protobuf:"bytes,4,opt,name=post_message_cooloff,json=postMessageCooloff" json:"post_message_cooloff,omitempty"`
+	Revision           uint64                        `protobuf:"varint,1,opt,name=revision" json:"revision,omitempty"`
+	Irc                *Snapshot_Config_IRC          `protobuf:"bytes,2,opt,name=irc" json:"irc,omitempty"`
+	SessionExpiration  string                        `protobuf:"bytes,3,opt,name=session_expiration,json=sessionExpiration" json:"session_expiration,omitempty"`
+	PostMessageCooloff string                        `protobuf:"bytes,4,opt,name=post_message_cooloff,json=postMessageCooloff" json:"post_message_cooloff,omitempty"`
+	ChatHistoryLimit   int64                         `protobuf:"varint,5,opt,name=chat_history_limit,json=chatHistoryLimit" json:"chat_history_limit,omitempty"`
+	NetworkDescription string                        `protobuf:"bytes,6,opt,name=network_description,json=networkDescription" json:"network_description,omitempty"`
+	Motd               string                        `protobuf:"bytes,7,opt,name=motd" json:"motd,omitempty"`
+	Admin              *Snapshot_Config_Admin        `protobuf:"bytes,8,opt,name=admin" json:"admin,omitempty"`
+	CaseMapping        string                        `protobuf:"bytes,9,opt,name=case_mapping,json=caseMapping" json:"case_mapping,omitempty"`
+	ClientTagDeny      []string                      `protobuf:"bytes,10,rep,name=client_tag_deny,json=clientTagDeny" json:"client_tag_deny,omitempty"`
+	MaxTargets         int64                         `protobuf:"varint,11,opt,name=max_targets,json=maxTargets" json:"max_targets,omitempty"`
+	SpamFilters        []*Snapshot_Config_SpamFilter `protobuf:"bytes,12,rep,name=spam_filters,json=spamFilters" json:"spam_filters,omitempty"`
 }
 
 func (m *Snapshot_Config) Reset()                    { *m = Snapshot_Config{} }
@@ -222,9 +374,24 @@ func (m *Snapshot_Config) GetIrc() *Snapshot_Config_IRC {
 	return nil
 }
 
+func (m *Snapshot_Config) GetAdmin() *Snapshot_Config_Admin {
+	if m != nil {
+		return m.Admin
+	}
+	return nil
+}
+
+func (m *Snapshot_Config) GetSpamFilters() []*Snapshot_Config_SpamFilter {
+	if m != nil {
+		return m.SpamFilters
+	}
+	return nil
+}
+
 type Snapshot_Config_IRC struct {
-	Operators []*Snapshot_Config_IRC_Operator `protobuf:"bytes,1,rep,name=operators" json:"operators,omitempty"`
-	Services  []*Snapshot_Config_IRC_Service  `protobuf:"bytes,2,rep,name=services" json:"services,omitempty"`
+	Operators       []*Snapshot_Config_IRC_Operator      `protobuf:"bytes,1,rep,name=operators" json:"operators,omitempty"`
+	Services        []*Snapshot_Config_IRC_Service       `protobuf:"bytes,2,rep,name=services" json:"services,omitempty"`
+	OperatorClasses []*Snapshot_Config_IRC_OperatorClass `protobuf:"bytes,3,rep,name=operator_classes,json=operatorClasses" json:"operator_classes,omitempty"`
 }
 
 func (m *Snapshot_Config_IRC) Reset()                    { *m = Snapshot_Config_IRC{} }
@@ -246,9 +413,17 @@ func (m *Snapshot_Config_IRC) GetServices() []*Snapshot_Config_IRC_Service {
 	return nil
 }
 
+func (m *Snapshot_Config_IRC) GetOperatorClasses() []*Snapshot_Config_IRC_OperatorClass {
+	if m != nil {
+		return m.OperatorClasses
+	}
+	return nil
+}
+
 type Snapshot_Config_IRC_Operator struct {
 	Name     string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
 	Password string `protobuf:"bytes,2,opt,name=password" json:"password,omitempty"`
+	Class    string `protobuf:"bytes,3,opt,name=class" json:"class,omitempty"`
 }
 
 func (m *Snapshot_Config_IRC_Operator) Reset()         { *m = Snapshot_Config_IRC_Operator{} }
@@ -269,6 +444,112 @@ func (*Snapshot_Config_IRC_Service) Descriptor() ([]byte, []int) {
 	return fileDescriptor1, []int{1, 5, 0, 1}
 }
 
+type Snapshot_Config_IRC_OperatorClass struct {
+	Name       string   `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Privileges []string `protobuf:"bytes,2,rep,name=privileges" json:"privileges,omitempty"`
+}
+
+func (m *Snapshot_Config_IRC_OperatorClass) Reset()         { *m = Snapshot_Config_IRC_OperatorClass{} }
+func (m *Snapshot_Config_IRC_OperatorClass) String() string { return proto1.CompactTextString(m) }
+func (*Snapshot_Config_IRC_OperatorClass) ProtoMessage()    {}
+func (*Snapshot_Config_IRC_OperatorClass) Descriptor() ([]byte, []int) {
+	return fileDescriptor1, []int{1, 5, 0, 2}
+}
+
+type Snapshot_Config_Admin struct {
+	Name     string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Location string `protobuf:"bytes,2,opt,name=location" json:"location,omitempty"`
+	Email    string `protobuf:"bytes,3,opt,name=email" json:"email,omitempty"`
+}
+
+func (m *Snapshot_Config_Admin) Reset()                    { *m = Snapshot_Config_Admin{} }
+func (m *Snapshot_Config_Admin) String() string            { return proto1.CompactTextString(m) }
+func (*Snapshot_Config_Admin) ProtoMessage()               {}
+func (*Snapshot_Config_Admin) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{1, 5, 1} }
+
+type Snapshot_Config_SpamFilter struct {
+	Name        string   `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Pattern     string   `protobuf:"bytes,2,opt,name=pattern" json:"pattern,omitempty"`
+	Glob        bool     `protobuf:"varint,3,opt,name=glob" json:"glob,omitempty"`
+	Targets     []string `protobuf:"bytes,4,rep,name=targets" json:"targets,omitempty"`
+	Action      string   `protobuf:"bytes,5,opt,name=action" json:"action,omitempty"`
+	BanDuration string   `protobuf:"bytes,6,opt,name=ban_duration,json=banDuration" json:"ban_duration,omitempty"`
+	Reason      string   `protobuf:"bytes,7,opt,name=reason" json:"reason,omitempty"`
+}
+
+func (m *Snapshot_Config_SpamFilter) Reset()         { *m = Snapshot_Config_SpamFilter{} }
+func (m *Snapshot_Config_SpamFilter) String() string { return proto1.CompactTextString(m) }
+func (*Snapshot_Config_SpamFilter) ProtoMessage()    {}
+func (*Snapshot_Config_SpamFilter) Descriptor() ([]byte, []int) {
+	return fileDescriptor1, []int{1, 5, 2}
+}
+
+type Snapshot_WhowasEntry struct {
+	Nick     string     `protobuf:"bytes,1,opt,name=nick" json:"nick,omitempty"`
+	Username string     `protobuf:"bytes,2,opt,name=username" json:"username,omitempty"`
+	Host     string     `protobuf:"bytes,3,opt,name=host" json:"host,omitempty"`
+	Realname string     `protobuf:"bytes,4,opt,name=realname" json:"realname,omitempty"`
+	Signoff  *Timestamp `protobuf:"bytes,5,opt,name=signoff" json:"signoff,omitempty"`
+}
+
+func (m *Snapshot_WhowasEntry) Reset()                    { *m = Snapshot_WhowasEntry{} }
+func (m *Snapshot_WhowasEntry) String() string            { return proto1.CompactTextString(m) }
+func (*Snapshot_WhowasEntry) ProtoMessage()               {}
+func (*Snapshot_WhowasEntry) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{1, 6} }
+
+func (m *Snapshot_WhowasEntry) GetSignoff() *Timestamp {
+	if m != nil {
+		return m.Signoff
+	}
+	return nil
+}
+
+type Snapshot_KLine struct {
+	Mask    string     `protobuf:"bytes,1,opt,name=mask" json:"mask,omitempty"`
+	SetBy   string     `protobuf:"bytes,2,opt,name=set_by,json=setBy" json:"set_by,omitempty"`
+	SetAt   *Timestamp `protobuf:"bytes,3,opt,name=set_at,json=setAt" json:"set_at,omitempty"`
+	Reason  string     `protobuf:"bytes,4,opt,name=reason" json:"reason,omitempty"`
+	Expires *Timestamp `protobuf:"bytes,5,opt,name=expires" json:"expires,omitempty"`
+}
+
+func (m *Snapshot_KLine) Reset()                    { *m = Snapshot_KLine{} }
+func (m *Snapshot_KLine) String() string            { return proto1.CompactTextString(m) }
+func (*Snapshot_KLine) ProtoMessage()               {}
+func (*Snapshot_KLine) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{1, 7} }
+
+func (m *Snapshot_KLine) GetSetAt() *Timestamp {
+	if m != nil {
+		return m.SetAt
+	}
+	return nil
+}
+
+func (m *Snapshot_KLine) GetExpires() *Timestamp {
+	if m != nil {
+		return m.Expires
+	}
+	return nil
+}
+
+type Snapshot_SentMessage struct {
+	Id        *RobustId `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Author    int64     `protobuf:"varint,2,opt,name=author" json:"author,omitempty"`
+	Recipient int64     `protobuf:"varint,3,opt,name=recipient" json:"recipient,omitempty"`
+	Target    string    `protobuf:"bytes,4,opt,name=target" json:"target,omitempty"`
+}
+
+func (m *Snapshot_SentMessage) Reset()                    { *m = Snapshot_SentMessage{} }
+func (m *Snapshot_SentMessage) String() string            { return proto1.CompactTextString(m) }
+func (*Snapshot_SentMessage) ProtoMessage()               {}
+func (*Snapshot_SentMessage) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{1, 8} }
+
+func (m *Snapshot_SentMessage) GetId() *RobustId {
+	if m != nil {
+		return m.Id
+	}
+	return nil
+}
+
 func init() {
 	proto1.RegisterType((*Timestamp)(nil), "proto.Timestamp")
 	proto1.RegisterType((*Snapshot)(nil), "proto.Snapshot")
@@ -276,73 +557,134 @@ func init() {
 	proto1.RegisterType((*Snapshot_Session)(nil), "proto.Snapshot.Session")
 	proto1.RegisterType((*Snapshot_Channel)(nil), "proto.Snapshot.Channel")
 	proto1.RegisterType((*Snapshot_Channel_Modes)(nil), "proto.Snapshot.Channel.Modes")
+	proto1.RegisterType((*Snapshot_Channel_MaskEntry)(nil), "proto.Snapshot.Channel.MaskEntry")
+	proto1.RegisterType((*Snapshot_Channel_FloodCounter)(nil), "proto.Snapshot.Channel.FloodCounter")
 	proto1.RegisterType((*Snapshot_SVSHold)(nil), "proto.Snapshot.SVSHold")
 	proto1.RegisterType((*Snapshot_Config)(nil), "proto.Snapshot.Config")
 	proto1.RegisterType((*Snapshot_Config_IRC)(nil), "proto.Snapshot.Config.IRC")
 	proto1.RegisterType((*Snapshot_Config_IRC_Operator)(nil), "proto.Snapshot.Config.IRC.Operator")
 	proto1.RegisterType((*Snapshot_Config_IRC_Service)(nil), "proto.Snapshot.Config.IRC.Service")
+	proto1.RegisterType((*Snapshot_Config_IRC_OperatorClass)(nil), "proto.Snapshot.Config.IRC.OperatorClass")
+	proto1.RegisterType((*Snapshot_Config_Admin)(nil), "proto.Snapshot.Config.Admin")
+	proto1.RegisterType((*Snapshot_Config_SpamFilter)(nil), "proto.Snapshot.Config.SpamFilter")
+	proto1.RegisterType((*Snapshot_WhowasEntry)(nil), "proto.Snapshot.WhowasEntry")
+	proto1.RegisterType((*Snapshot_KLine)(nil), "proto.Snapshot.KLine")
+	proto1.RegisterType((*Snapshot_SentMessage)(nil), "proto.Snapshot.SentMessage")
 }
 
 var fileDescriptor1 = []byte{
-	// 945 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x7c, 0x55, 0xef, 0x6e, 0xdc, 0x44,
-	0x10, 0xd7, 0xe5, 0xfe, 0x4f, 0x9a, 0x7f, 0xdb, 0x2a, 0x75, 0x5d, 0x55, 0xa0, 0x20, 0x50, 0x85,
-	0xe0, 0x8a, 0x5a, 0x81, 0x4a, 0x3f, 0x20, 0x55, 0x51, 0x04, 0xf7, 0x21, 0xa5, 0x72, 0x22, 0x90,
-	0xf8, 0x72, 0xda, 0xda, 0x9b, 0xbb, 0x55, 0x7d, 0x5e, 0xcb, 0xbb, 0x77, 0xcd, 0xf1, 0x1e, 0x3c,
-	0x00, 0x8f, 0xc3, 0x03, 0xf0, 0x14, 0xbc, 0x04, 0x33, 0xb3, 0x6b, 0x27, 0xe1, 0x5c, 0x3e, 0x79,
-	0x67, 0x7e, 0xb3, 0x33, 0xb3, 0x33, 0xbf, 0x19, 0xc3, 0xbe, 0x2d, 0x64, 0x69, 0x17, 0xc6, 0x4d,
-	0xca, 0xca, 0x38, 0x23, 0xfa, 0xfc, 0x89, 0x77, 0xdd, 0xa6, 0x54, 0xd6, 0xeb, 0x4e, 0x5e, 0xc3,
-	0xf8, 0x52, 0x2f, 0x95, 0x75, 0x72, 0x59, 0x8a, 0xc7, 0x30, 0x5e, 0x15, 0xfa, 0x7a, 0x56, 0xc8,
-	0xc2, 0x44, 0x9d, 0x4f, 0x3b, 0x4f, 0xbb, 0xc9, 0x88, 0x14, 0x6f, 0x50, 0x16, 0x0f, 0x61, 0xa8,
-	0xed, 0xec, 0x77, 0x55, 0x99, 0x68, 0x07, 0xa1, 0x51, 0x32, 0xd0, 0xf6, 0x37, 0x94, 0x4e, 0xfe,
-	0x38, 0x80, 0xd1, 0x45, 0x88, 0x24, 0x5e, 0xc0, 0xc8, 0x2a, 0x6b, 0xb5, 0x29, 0x2c, 0x7a, 0xe8,
-	0x3e, 0xdd, 0x7d, 0xfe, 0xd0, 0x47, 0x9a, 0xd4, 0x26, 0x93, 0x0b, 0x8f, 0x27, 0x8d, 0x21, 0x5d,
-	0x4a, 0x17, 0xb2, 0x28, 0x54, 0x6e, 0xd1, 0x77, 0xeb, 0xa5, 0x53, 0x8f, 0x27, 0x8d, 0xa1, 0xf8,
-	0x1e, 0x23, 0xad, 0x11, 0xcb, 0x33, 0x1b, 0x75, 0xf9, 0xd2, 0x93, 0xad, 0x48, 0x01, 0x3f, 0x2b,
-	0x5c, 0xb5, 0x49, 0x1a, 0x73, 0xf1, 0x1d, 0xec, 0xe7, 0xd2, 0xba, 0x19, 0x9a, 0xa7, 0x98, 0x83,
-	0xca, 0xa2, 0x1e, 0xbe, 0x68, 0xf7, 0xf9, 0x41, 0x70, 0x90, 0x98, 0x77, 0x2b, 0xeb, 0xa6, 0x59,
-	0xb2, 0x47, 0x66, 0x6f, 0x6b, 0x2b, 0x31, 0x81, 0x41, 0x6a, 0x8a, 0x2b, 0x3d, 0x8f, 0xfa, 0x6c,
-	0x7f, 0xbc, 0x95, 0x25, 0xa3, 0x49, 0xb0, 0x42, 0xfb, 0xfb, 0x1c, 0x47, 0x17, 0x69, 0xbe, 0xca,
-	0x54, 0x86, 0x87, 0x4c, 0x5d, 0x47, 0x03, 0xbc, 0xdc, 0x4b, 0x8e, 0x08, 0x9a, 0x06, 0x64, 0x4a,
-	0x40, 0xfc, 0x23, 0x8c, 0xa7, 0xc9, 0xe9, 0xdb, 0x4a, 0x5d, 0xe9, 0x6b, 0x21, 0xa0, 0x57, 0xc8,
-	0xa5, 0xe2, 0x3e, 0x8c, 0x13, 0x3e, 0x93, 0x6e, 0x65, 0x55, 0xc5, 0x0d, 0x40, 0x1d, 0x9d, 0x49,
-	0xb7, 0x30, 0xd6, 0x61, 0x0d, 0x58, 0x47, 0xe7, 0xf8, 0xef, 0x1e, 0x0c, 0x43, 0x99, 0xc5, 0x27,
-	0xb0, 0xa3, 0x33, 0xf6, 0xd2, 0xf2, 0x40, 0x84, 0xc8, 0x81, 0x5c, 0xb9, 0x45, 0xed, 0x94, 0xce,
-	0x1c, 0x5c, 0xa7, 0xef, 0x6b, 0xa7, 0x74, 0x16, 0x31, 0x8c, 0x28, 0x20, 0x27, 0xd5, 0x63, 0x7d,
-	0x23, 0x13, 0x56, 0x29, 0x99, 0x33, 0xd6, 0xf7, 0x58, 0x2d, 0x13, 0xd6, 0x74, 0x77, 0x80, 0x8d,
-	0x1a, 0xdf, 0x6a, 0xe2, 0xb7, 0xc0, 0x25, 0x9e, 0xc9, 0xd4, 0xe9, 0xb5, 0x76, 0x9b, 0x68, 0xc8,
-	0x79, 0x1e, 0x86, 0x3c, 0x1b, 0x6a, 0x26, 0xf7, 0xc8, 0xec, 0x75, 0xb0, 0x22, 0x97, 0xa6, 0x54,
-	0x95, 0x74, 0xa6, 0x8a, 0x46, 0x4c, 0xc6, 0x46, 0x16, 0x8f, 0x60, 0x24, 0x3f, 0xc8, 0xcd, 0x6c,
-	0x69, 0xe7, 0xd1, 0x98, 0x53, 0x19, 0x92, 0x7c, 0x6e, 0xe7, 0xe2, 0x19, 0xdc, 0x77, 0x0b, 0x74,
-	0xec, 0x72, 0x5d, 0xcc, 0x67, 0xea, 0xba, 0x34, 0x85, 0x2a, 0x5c, 0x04, 0xcc, 0x74, 0x71, 0x03,
-	0x9d, 0x05, 0x44, 0x3c, 0x01, 0xd0, 0x05, 0x46, 0xc4, 0xd6, 0x39, 0x13, 0xed, 0x72, 0xf2, 0xe3,
-	0xa0, 0xb9, 0x34, 0xe2, 0x01, 0xf4, 0x97, 0x26, 0x53, 0x36, 0xba, 0xc7, 0x88, 0x17, 0xa8, 0x76,
-	0x76, 0x8d, 0x25, 0xdf, 0xf3, 0xb5, 0xa3, 0x33, 0xe9, 0x4a, 0x69, 0x6d, 0xb4, 0xef, 0x75, 0x74,
-	0x16, 0xc7, 0x30, 0xc0, 0xf2, 0xad, 0xb1, 0x9d, 0x07, 0x7e, 0x9e, 0xbc, 0x24, 0xbe, 0x44, 0x62,
-	0x3b, 0x59, 0x21, 0x6d, 0xb2, 0xe8, 0xb0, 0xbd, 0x6d, 0x43, 0x36, 0x98, 0x66, 0x38, 0x39, 0xc7,
-	0x5c, 0xbf, 0x34, 0xd7, 0x98, 0xef, 0x0c, 0xab, 0x65, 0xe5, 0x5c, 0xd1, 0xcd, 0x23, 0x26, 0x19,
-	0xf3, 0xef, 0x94, 0xc1, 0x73, 0x8f, 0xe1, 0xa5, 0x97, 0xf8, 0xaa, 0x2a, 0x45, 0xf6, 0x13, 0xcf,
-	0x22, 0xc1, 0x21, 0x1e, 0xfd, 0x97, 0xca, 0x0d, 0x11, 0xf1, 0xc1, 0x55, 0xea, 0x8f, 0xf1, 0x5f,
-	0x3b, 0x30, 0x0c, 0x93, 0xd8, 0xca, 0x4f, 0xac, 0x97, 0x33, 0xa5, 0x4e, 0x67, 0x4c, 0x1e, 0x4f,
-	0xa8, 0x31, 0x6b, 0xde, 0x10, 0x83, 0x9e, 0xd5, 0xb0, 0xc3, 0xbe, 0x32, 0xb7, 0xda, 0x5a, 0xed,
-	0x2f, 0x90, 0x4c, 0x05, 0x66, 0x21, 0xf0, 0xcd, 0x0b, 0x98, 0x7f, 0x9f, 0xfc, 0x5b, 0x64, 0x1a,
-	0x8d, 0xfd, 0xc9, 0x47, 0x76, 0xc5, 0x84, 0x62, 0x86, 0xd9, 0xf7, 0x17, 0x6e, 0x1a, 0x36, 0xb8,
-	0xd5, 0xb0, 0xf8, 0x31, 0xf4, 0xcf, 0xeb, 0xce, 0x91, 0x86, 0x17, 0x17, 0x3e, 0x89, 0xce, 0xf1,
-	0xaf, 0x00, 0x37, 0x7e, 0xc4, 0x21, 0x74, 0xdf, 0xab, 0x4d, 0x78, 0x33, 0x1d, 0xb1, 0x03, 0xfd,
-	0xb5, 0xcc, 0x57, 0x8a, 0x5f, 0xdb, 0xb2, 0x83, 0xea, 0x64, 0x38, 0x42, 0xe2, 0x6d, 0x5f, 0xed,
-	0xbc, 0xec, 0xc4, 0x0a, 0x47, 0xf4, 0x97, 0x8b, 0x9f, 0x70, 0x21, 0x89, 0x2f, 0xa0, 0x2f, 0x33,
-	0xdc, 0x02, 0x61, 0x4a, 0xb7, 0x4b, 0xe2, 0x61, 0xa2, 0x7d, 0xb6, 0x42, 0x96, 0xe3, 0x58, 0x87,
-	0xe2, 0x36, 0x32, 0xb1, 0x09, 0x27, 0xce, 0x22, 0xe2, 0x67, 0x36, 0x48, 0xf1, 0x25, 0xec, 0xdd,
-	0x59, 0x83, 0x2d, 0x4f, 0xf8, 0xfa, 0xee, 0x13, 0xb6, 0x17, 0xb6, 0x4f, 0xf3, 0x76, 0xf2, 0x7f,
-	0x76, 0x61, 0xe0, 0x97, 0x9d, 0x1f, 0xfd, 0xb5, 0xa6, 0x5d, 0xc3, 0x4e, 0x7b, 0x49, 0x23, 0x8b,
-	0xaf, 0xa0, 0x8b, 0xe4, 0x09, 0x7e, 0xe3, 0xf6, 0x6d, 0x49, 0x4c, 0x4b, 0xc8, 0x0c, 0xf3, 0x10,
-	0xe1, 0x97, 0x40, 0xb3, 0xa9, 0xc3, 0x43, 0xfd, 0x73, 0x8e, 0x02, 0x72, 0xd6, 0x00, 0xe2, 0x1b,
-	0x78, 0x50, 0xe2, 0xb2, 0x6b, 0x48, 0x9f, 0x1a, 0x93, 0x9b, 0xab, 0xab, 0xc0, 0x15, 0x41, 0x58,
-	0xe0, 0xfc, 0xa9, 0x47, 0xe2, 0x7f, 0x3a, 0xd0, 0xc5, 0x68, 0x02, 0x7f, 0x7a, 0xf5, 0xba, 0xa8,
-	0xff, 0x52, 0x9f, 0x7d, 0x3c, 0xb9, 0xc9, 0xcf, 0xc1, 0x36, 0xb9, 0xb9, 0x25, 0x7e, 0xa0, 0xff,
-	0x5c, 0xb5, 0xd6, 0xf8, 0x67, 0x08, 0xbf, 0xac, 0x93, 0xff, 0xf1, 0x70, 0xe1, 0x4d, 0x93, 0xe6,
-	0x4e, 0xfc, 0x0a, 0x46, 0xb5, 0xdb, 0xd6, 0x49, 0xc2, 0xaa, 0xd2, 0x92, 0xf8, 0x60, 0xaa, 0xac,
-	0x6e, 0x75, 0x2d, 0xc7, 0x9f, 0xd3, 0x72, 0x67, 0x3f, 0x77, 0xcc, 0x3a, 0x77, 0xcd, 0xde, 0x0d,
-	0x38, 0x9f, 0x17, 0xff, 0x06, 0x00, 0x00, 0xff, 0xff, 0xa8, 0x2b, 0xe1, 0xaf, 0x07, 0x08, 0x00,
-	0x00,
+	// 1807 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xb4, 0x57, 0xcd, 0x6e, 0x1c, 0xc7,
+	0xf1, 0xc7, 0x72, 0xb9, 0x1f, 0x53, 0xcb, 0x25, 0xa9, 0xd6, 0xd7, 0x68, 0x64, 0xfd, 0x4d, 0xf1,
+	0x1f, 0xdb, 0x8c, 0x62, 0xd1, 0x81, 0x08, 0x07, 0x4a, 0x0e, 0x46, 0x18, 0x8a, 0x8e, 0x08, 0x8b,
+	0x8c, 0x30, 0x24, 0x62, 0x20, 0x97, 0x41, 0x73, 0xa6, 0xb9, 0xdb, 0xe0, 0x4c, 0xf7, 0x60, 0xba,
+	0xf9, 0xb1, 0x46, 0xde, 0x20, 0x4f, 0x10, 0xe4, 0x90, 0xc7, 0xc8, 0x21, 0x4f, 0x90, 0xa7, 0xc9,
+	0x31, 0xd7, 0xa0, 0xaa, 0x7b, 0x66, 0x77, 0xa9, 0x5d, 0x5b, 0x97, 0x9c, 0xa6, 0xab, 0xea, 0xd7,
+	0xd5, 0x35, 0x5d, 0x9f, 0x0d, 0xeb, 0x46, 0xf1, 0xd2, 0x8c, 0xb5, 0xdd, 0x2d, 0x2b, 0x6d, 0x35,
+	0xeb, 0xd0, 0x27, 0x1a, 0xd8, 0x49, 0x29, 0x8c, 0xe3, 0x6d, 0xef, 0x43, 0x70, 0x26, 0x0b, 0x61,
+	0x2c, 0x2f, 0x4a, 0xf6, 0x14, 0x82, 0x2b, 0x25, 0x6f, 0x13, 0xc5, 0x95, 0x0e, 0x5b, 0x5b, 0xad,
+	0x9d, 0x76, 0xdc, 0x47, 0xc6, 0x09, 0x57, 0x9a, 0x3d, 0x86, 0x9e, 0x34, 0xc9, 0x0f, 0xa2, 0xd2,
+	0xe1, 0xca, 0x56, 0x6b, 0xa7, 0x1f, 0x77, 0xa5, 0xf9, 0x93, 0xa8, 0xf4, 0xf6, 0x7f, 0x9e, 0x43,
+	0xff, 0xd4, 0x9f, 0xc4, 0xf6, 0xa0, 0x6f, 0x84, 0x31, 0x52, 0x2b, 0x13, 0xb6, 0xb6, 0xda, 0x3b,
+	0x83, 0x57, 0x8f, 0xdd, 0x49, 0xbb, 0x35, 0x64, 0xf7, 0xd4, 0xc9, 0xe3, 0x06, 0x88, 0x9b, 0xd2,
+	0x31, 0x57, 0x4a, 0xe4, 0x26, 0x5c, 0x59, 0xbc, 0xe9, 0xc0, 0xc9, 0xe3, 0x06, 0xc8, 0x7e, 0x0d,
+	0x7d, 0x73, 0x6d, 0xc6, 0x3a, 0xcf, 0x4c, 0xd8, 0xa6, 0x4d, 0xcf, 0x3e, 0x38, 0xc9, 0xcb, 0x0f,
+	0x95, 0xad, 0x26, 0x71, 0x03, 0x67, 0xbf, 0x82, 0xf5, 0x9c, 0x1b, 0x9b, 0x94, 0x95, 0x4e, 0x85,
+	0x31, 0x22, 0x0b, 0x57, 0xb7, 0x5a, 0x3b, 0x83, 0x57, 0x1b, 0x5e, 0x41, 0xac, 0xcf, 0xaf, 0x8c,
+	0x3d, 0xca, 0xe2, 0x21, 0xc2, 0xde, 0xd7, 0x28, 0xb6, 0x0b, 0xdd, 0x54, 0xab, 0x0b, 0x39, 0x0a,
+	0x3b, 0x84, 0x7f, 0xf4, 0x81, 0x95, 0x24, 0x8d, 0x3d, 0x8a, 0xed, 0xc2, 0x7d, 0x3a, 0x47, 0xaa,
+	0x34, 0xbf, 0xca, 0x44, 0x96, 0x48, 0x95, 0x89, 0xdb, 0xb0, 0xbb, 0xd5, 0xda, 0x59, 0x8d, 0xef,
+	0xa1, 0xe8, 0xc8, 0x4b, 0x8e, 0x50, 0xc0, 0xf6, 0xa0, 0x7b, 0x33, 0xd6, 0x37, 0xdc, 0x84, 0x3d,
+	0xfa, 0xa1, 0xa7, 0x77, 0xf5, 0x7f, 0x4f, 0x52, 0xf7, 0x3b, 0x1e, 0xca, 0x5e, 0x42, 0xf7, 0x32,
+	0x97, 0x4a, 0x98, 0xb0, 0x4f, 0x9b, 0x1e, 0xde, 0xdd, 0xf4, 0xdd, 0x3b, 0xa9, 0x44, 0xec, 0x41,
+	0xec, 0x39, 0xac, 0xa5, 0xdc, 0x88, 0xa4, 0xe0, 0x65, 0x29, 0xd5, 0x28, 0x0c, 0xb6, 0x5a, 0x3b,
+	0x41, 0x3c, 0x40, 0xde, 0xb1, 0x63, 0xb1, 0x5f, 0x40, 0xbf, 0x12, 0x19, 0x4f, 0xad, 0xc8, 0x42,
+	0xd8, 0x6a, 0x2f, 0xba, 0x98, 0x06, 0xc0, 0x7e, 0x0b, 0x43, 0x23, 0x94, 0x4d, 0x0a, 0x61, 0x0c,
+	0x1f, 0x09, 0x13, 0x0e, 0x16, 0x9b, 0x7e, 0x2a, 0x94, 0x3d, 0x76, 0x98, 0x78, 0xcd, 0x4c, 0x09,
+	0x13, 0xfd, 0x1e, 0x82, 0xa3, 0xf8, 0xe0, 0x7d, 0x25, 0x2e, 0xe4, 0x2d, 0x63, 0xb0, 0xaa, 0x78,
+	0x21, 0x28, 0xfa, 0x82, 0x98, 0xd6, 0xc8, 0xbb, 0x32, 0xa2, 0xa2, 0xb0, 0x0b, 0x62, 0x5a, 0x23,
+	0x6f, 0xac, 0x8d, 0x0d, 0xdb, 0x8e, 0x87, 0xeb, 0xe8, 0x5f, 0x5d, 0xe8, 0xf9, 0xe0, 0x62, 0x9f,
+	0xc2, 0x8a, 0xcc, 0x48, 0xcb, 0x02, 0xeb, 0x57, 0x64, 0x86, 0x0a, 0xf8, 0x95, 0x1d, 0xd7, 0x4a,
+	0x71, 0x4d, 0x87, 0xcb, 0xf4, 0xb2, 0x56, 0x8a, 0x6b, 0x16, 0x41, 0x1f, 0x0f, 0x24, 0xa3, 0x56,
+	0x89, 0xdf, 0xd0, 0x28, 0xab, 0x04, 0xcf, 0x49, 0xd6, 0x71, 0xb2, 0x9a, 0x46, 0x59, 0x13, 0xd3,
+	0xdd, 0xad, 0x36, 0xca, 0x6a, 0x9a, 0x7d, 0x0d, 0x14, 0x58, 0x09, 0x4f, 0xad, 0xbc, 0x96, 0x76,
+	0x12, 0xf6, 0xc8, 0xce, 0x4d, 0x6f, 0x67, 0x93, 0x90, 0xf1, 0x1a, 0xc2, 0xf6, 0x3d, 0x0a, 0x55,
+	0xea, 0x52, 0x54, 0xdc, 0xea, 0x2a, 0xec, 0x53, 0x0a, 0x36, 0x34, 0x7b, 0x02, 0x7d, 0x7e, 0xc3,
+	0x27, 0x49, 0x61, 0x6a, 0x97, 0xf6, 0x90, 0x3e, 0x36, 0x23, 0xf6, 0x15, 0xdc, 0xb7, 0xe3, 0x4a,
+	0x5b, 0x9b, 0x4b, 0x35, 0x4a, 0xc4, 0x6d, 0xa9, 0x95, 0x50, 0x36, 0x04, 0xca, 0x6f, 0x36, 0x15,
+	0x1d, 0x7a, 0x09, 0x7b, 0x06, 0x20, 0xd5, 0xb5, 0xb4, 0x22, 0x4b, 0xac, 0x26, 0x7f, 0x06, 0x71,
+	0xe0, 0x39, 0x67, 0x9a, 0x3d, 0x80, 0x4e, 0xa1, 0x33, 0x61, 0xc2, 0x35, 0x92, 0x38, 0x02, 0xef,
+	0xce, 0x5c, 0xcb, 0x2c, 0x1c, 0xba, 0xbb, 0xc3, 0x35, 0xf2, 0x4a, 0x6e, 0x4c, 0xb8, 0xee, 0x78,
+	0xb8, 0x66, 0x8f, 0xa0, 0x6b, 0x44, 0x75, 0x2d, 0xaa, 0x70, 0xc3, 0x55, 0x11, 0x47, 0xb1, 0x17,
+	0xd0, 0x37, 0x96, 0x57, 0x36, 0x91, 0x59, 0xb8, 0xb9, 0xd8, 0x6d, 0x3d, 0x02, 0x1c, 0x65, 0x6c,
+	0x0f, 0x1e, 0xd1, 0xfd, 0xa5, 0xb9, 0x9c, 0x09, 0x3d, 0xdc, 0x79, 0x8f, 0x52, 0x8b, 0xb2, 0xee,
+	0x20, 0x97, 0xd3, 0x28, 0x3b, 0xca, 0xd8, 0x6b, 0x00, 0x59, 0xa5, 0x49, 0x49, 0x71, 0x16, 0x32,
+	0x3a, 0xe2, 0xc9, 0xdd, 0x28, 0x6d, 0x02, 0x31, 0x0e, 0x64, 0x95, 0xba, 0x25, 0xdb, 0xc6, 0x94,
+	0x29, 0xf9, 0xb9, 0xcc, 0xa5, 0x95, 0xc2, 0x84, 0xf7, 0xe9, 0xbf, 0xe7, 0x78, 0xec, 0x0b, 0xd8,
+	0x48, 0x79, 0x99, 0x28, 0x31, 0xd2, 0x56, 0x72, 0x8b, 0x99, 0xf5, 0x80, 0xfe, 0x6f, 0x3d, 0xe5,
+	0xe5, 0xc9, 0x94, 0xcb, 0x3e, 0x81, 0xa0, 0xd0, 0x4a, 0x5a, 0x5d, 0x89, 0x2c, 0x7c, 0xe8, 0xee,
+	0xb6, 0x61, 0x60, 0x05, 0x46, 0x97, 0x26, 0x14, 0x52, 0x8f, 0x5c, 0x48, 0x21, 0xe3, 0x04, 0x43,
+	0x2a, 0x84, 0x9e, 0x51, 0xba, 0xe0, 0xe6, 0x32, 0x7c, 0xec, 0x5c, 0xec, 0x49, 0xf6, 0x19, 0xac,
+	0x1b, 0x6e, 0xf2, 0xa4, 0x10, 0x18, 0x63, 0xd2, 0x14, 0x61, 0x48, 0x80, 0x21, 0x72, 0x8f, 0x6b,
+	0x26, 0xfb, 0x39, 0x6c, 0xa2, 0x0f, 0x92, 0xb4, 0x12, 0x99, 0x50, 0x56, 0xf2, 0xdc, 0x84, 0x4f,
+	0xc8, 0x84, 0x0d, 0xe4, 0x1f, 0x4c, 0xd9, 0xd1, 0xbf, 0x7b, 0xd0, 0xf3, 0x35, 0x77, 0x61, 0x4e,
+	0x3e, 0x03, 0xb0, 0xba, 0x94, 0x69, 0x42, 0x09, 0xe3, 0x92, 0x28, 0x20, 0xce, 0x09, 0x66, 0xcd,
+	0x57, 0xb5, 0xd8, 0xca, 0x42, 0x84, 0xed, 0x25, 0xe1, 0xed, 0x36, 0x20, 0x8d, 0x41, 0x45, 0x84,
+	0xcf, 0x31, 0x47, 0xb0, 0xd7, 0xd0, 0x41, 0xfd, 0x26, 0xec, 0x50, 0x51, 0xd9, 0x5e, 0xd2, 0x15,
+	0x76, 0xf1, 0x4c, 0x5f, 0x16, 0xdd, 0x86, 0x69, 0x90, 0x76, 0x67, 0x83, 0xf4, 0x6b, 0x58, 0x3d,
+	0xe7, 0xaa, 0x2e, 0xaf, 0xcf, 0x97, 0xa9, 0x3b, 0xe6, 0xe6, 0xd2, 0x69, 0x23, 0x38, 0x7b, 0x0b,
+	0xeb, 0xe7, 0x5c, 0x25, 0xe2, 0x36, 0x15, 0xa5, 0xa5, 0xd6, 0xd6, 0xff, 0x58, 0x05, 0xc3, 0x73,
+	0xae, 0x0e, 0x9b, 0x7d, 0xec, 0x04, 0xee, 0xb9, 0x44, 0x9a, 0x55, 0x16, 0x7c, 0xac, 0xb2, 0x4d,
+	0xb7, 0x77, 0x46, 0xdf, 0x26, 0xb4, 0x2f, 0xc5, 0x84, 0x72, 0x39, 0x88, 0x71, 0x89, 0x3f, 0x9e,
+	0xcb, 0x42, 0xda, 0x70, 0x40, 0xf9, 0xed, 0x08, 0xe4, 0x5e, 0xe4, 0x5a, 0x67, 0xe1, 0x9a, 0xbb,
+	0x5e, 0x22, 0xd8, 0x77, 0xb0, 0x4e, 0x8b, 0x24, 0xd5, 0x57, 0xca, 0x8a, 0xca, 0x84, 0x43, 0x32,
+	0xe5, 0x67, 0xcb, 0x4c, 0xf9, 0x16, 0xd1, 0x07, 0x0e, 0x1c, 0x0f, 0x2f, 0x66, 0x28, 0xc3, 0xbe,
+	0x01, 0xe6, 0x94, 0xe5, 0x3a, 0xbd, 0xc4, 0x32, 0x23, 0x2b, 0xe1, 0x52, 0x7f, 0x91, 0xeb, 0x37,
+	0x09, 0xfb, 0x4e, 0xa7, 0x97, 0x87, 0x0e, 0x19, 0x3d, 0x85, 0xce, 0x71, 0x5d, 0x49, 0xd0, 0x5b,
+	0x34, 0x3e, 0x04, 0x31, 0xad, 0xa3, 0xef, 0x01, 0xa6, 0x3e, 0xae, 0xff, 0xba, 0x35, 0xfd, 0xeb,
+	0x3d, 0xe8, 0x5c, 0xf3, 0xfc, 0x4a, 0x50, 0x24, 0x2e, 0x98, 0x04, 0x9a, 0xbb, 0xc4, 0x13, 0x62,
+	0x87, 0xfd, 0xcd, 0xca, 0xeb, 0x56, 0xf4, 0x97, 0x16, 0x04, 0xcd, 0x05, 0xd3, 0xd1, 0x98, 0x5e,
+	0x3e, 0xd2, 0x71, 0xcd, 0x1e, 0x62, 0xc1, 0xb2, 0xc9, 0xf9, 0xc4, 0x47, 0x79, 0xc7, 0x08, 0xfb,
+	0xbb, 0x09, 0xfb, 0xc2, 0xb1, 0xb9, 0x5d, 0x1a, 0xdd, 0x08, 0xdc, 0xb7, 0xec, 0x05, 0xf4, 0xea,
+	0xcb, 0x58, 0x5d, 0x82, 0xac, 0x01, 0xd1, 0x0f, 0xb0, 0x36, 0x7b, 0xc5, 0x68, 0xcf, 0xa5, 0x54,
+	0x59, 0x6d, 0x0f, 0xae, 0xa9, 0x0a, 0xb8, 0x26, 0x47, 0x06, 0xb5, 0xe3, 0x9a, 0x64, 0x9f, 0x43,
+	0x87, 0x2a, 0xe4, 0x8f, 0x58, 0x84, 0x62, 0x0c, 0x06, 0x72, 0x38, 0xd9, 0xd3, 0x8e, 0x1d, 0x11,
+	0x09, 0xe8, 0x9d, 0xfe, 0xf1, 0xf4, 0xad, 0xce, 0x33, 0x54, 0xc4, 0xb3, 0x4c, 0xd4, 0xfd, 0x73,
+	0x81, 0x22, 0x12, 0x63, 0x43, 0xca, 0xae, 0x2a, 0x6e, 0x6b, 0x5b, 0x82, 0xb8, 0xa1, 0xb1, 0xce,
+	0x57, 0x82, 0x1b, 0xad, 0x7c, 0x37, 0xf5, 0x54, 0x74, 0x06, 0xc3, 0xb9, 0xb1, 0x6c, 0x81, 0x33,
+	0x5f, 0xce, 0x3b, 0xf3, 0xc3, 0x01, 0xd2, 0x99, 0x39, 0xeb, 0xc6, 0x7f, 0x04, 0xd0, 0x75, 0xc3,
+	0x97, 0x6b, 0xca, 0xd7, 0x92, 0x2e, 0xa8, 0x45, 0xed, 0xa0, 0xa1, 0xd9, 0x97, 0xd0, 0x96, 0x55,
+	0xea, 0xf5, 0x46, 0x8b, 0xa7, 0x37, 0xec, 0x01, 0x31, 0xc2, 0xd8, 0x4b, 0x60, 0xfe, 0x6a, 0x5d,
+	0x38, 0xbb, 0x1f, 0x75, 0xbf, 0x73, 0xcf, 0x4b, 0x0e, 0x1b, 0x01, 0xfb, 0x25, 0x3c, 0x28, 0xb5,
+	0x99, 0xb6, 0xa3, 0x54, 0xeb, 0x5c, 0x5f, 0x5c, 0xf8, 0x8a, 0xc6, 0x50, 0xe6, 0xbb, 0xd1, 0x81,
+	0x93, 0xb0, 0x2f, 0x81, 0xa5, 0x63, 0x6e, 0x93, 0xb1, 0x34, 0x56, 0x57, 0x93, 0xc4, 0x25, 0x6e,
+	0x87, 0xbc, 0xb2, 0x89, 0x92, 0xb7, 0x4e, 0xf0, 0x0e, 0xf9, 0xd8, 0xc7, 0x95, 0xb0, 0x37, 0xba,
+	0xba, 0x4c, 0x32, 0x61, 0xd2, 0x4a, 0x52, 0x0d, 0xa0, 0x69, 0x32, 0x88, 0x99, 0x17, 0xbd, 0x99,
+	0x4a, 0x5c, 0x22, 0xd9, 0x2c, 0xec, 0xf9, 0x68, 0xd6, 0x36, 0x63, 0xaf, 0xd0, 0xb5, 0x85, 0x54,
+	0x34, 0x40, 0x0c, 0x5e, 0x7d, 0xb2, 0xe4, 0x0e, 0xf6, 0x11, 0x13, 0x3b, 0xe8, 0xc7, 0x8c, 0x8c,
+	0x9f, 0xc3, 0x86, 0x6f, 0xc6, 0x96, 0x8f, 0x92, 0x4c, 0xa8, 0x09, 0x4d, 0x8e, 0x41, 0x3c, 0x74,
+	0xec, 0x33, 0x3e, 0x7a, 0x23, 0xd4, 0x84, 0x7d, 0x0a, 0x83, 0x82, 0xdf, 0x26, 0x96, 0x57, 0x23,
+	0x61, 0x8d, 0xaf, 0x51, 0x50, 0xf0, 0xdb, 0x33, 0xc7, 0x61, 0x6f, 0x60, 0xcd, 0x94, 0xbc, 0x48,
+	0x2e, 0x64, 0x4e, 0x05, 0x69, 0x6d, 0x49, 0x6d, 0x74, 0x66, 0x9e, 0x96, 0xbc, 0xf8, 0x96, 0x90,
+	0xf1, 0xc0, 0x34, 0x6b, 0x13, 0xfd, 0xad, 0x0d, 0xed, 0xa3, 0xf8, 0x80, 0xed, 0x43, 0x50, 0x4f,
+	0x48, 0xf5, 0x73, 0xe4, 0xff, 0x97, 0x7b, 0x7d, 0xf7, 0x0f, 0x1e, 0x1b, 0x4f, 0x77, 0xb1, 0x6f,
+	0xf0, 0x41, 0x53, 0x5d, 0xcb, 0x54, 0xd4, 0x6f, 0x93, 0xed, 0x1f, 0xd1, 0x70, 0xea, 0xa0, 0x71,
+	0xb3, 0x87, 0x9d, 0xc2, 0x66, 0xad, 0x2c, 0x49, 0x73, 0x6e, 0x8c, 0xa8, 0x9f, 0x2b, 0x3b, 0x1f,
+	0x61, 0xc9, 0x01, 0xee, 0x88, 0x37, 0xf4, 0x2c, 0x29, 0x4c, 0xf4, 0x1e, 0xfa, 0x35, 0x62, 0x61,
+	0x77, 0x8e, 0xa0, 0x8f, 0x0d, 0xfd, 0x46, 0x57, 0x59, 0x9d, 0x98, 0x35, 0x4d, 0xd9, 0x8f, 0x6a,
+	0x7c, 0x20, 0x3b, 0x22, 0xfa, 0x0c, 0x47, 0x67, 0x32, 0x79, 0x6e, 0x73, 0x6b, 0x7e, 0x73, 0x74,
+	0x00, 0xc3, 0x39, 0xd3, 0x16, 0x9e, 0xfe, 0x7f, 0x00, 0x65, 0x25, 0xaf, 0x65, 0x2e, 0x46, 0xfe,
+	0xd2, 0x82, 0x78, 0x86, 0x13, 0x1d, 0x43, 0x87, 0xe2, 0x6b, 0x99, 0xe9, 0xb9, 0x4e, 0xe7, 0x6a,
+	0x4a, 0x4d, 0xa3, 0xe9, 0xa2, 0xe0, 0x32, 0xaf, 0x4d, 0x27, 0x22, 0xfa, 0x67, 0x0b, 0x60, 0x1a,
+	0x08, 0x0b, 0x95, 0x86, 0xd0, 0x2b, 0xb9, 0xb5, 0xa2, 0xaa, 0x75, 0xd6, 0x24, 0xa2, 0x47, 0xb9,
+	0x3e, 0x27, 0x8d, 0xfd, 0x98, 0xd6, 0x88, 0xae, 0x03, 0x74, 0x95, 0x8c, 0xaf, 0x49, 0x2c, 0x6a,
+	0x38, 0xb3, 0x6b, 0xe5, 0xc7, 0x7d, 0x4f, 0x61, 0x86, 0xe0, 0x80, 0xd0, 0x14, 0x43, 0x97, 0x93,
+	0x83, 0x73, 0xae, 0xde, 0x7c, 0x58, 0x0f, 0x7b, 0x73, 0xf5, 0xf0, 0xaf, 0x2d, 0x18, 0xcc, 0x3c,
+	0xeb, 0x9a, 0x37, 0x48, 0x6b, 0xc9, 0x1b, 0x64, 0xe5, 0xce, 0x1b, 0x64, 0xc1, 0x43, 0x68, 0xee,
+	0x5d, 0xb2, 0x7a, 0xe7, 0x5d, 0xf2, 0x02, 0x7a, 0x46, 0x8e, 0x14, 0x16, 0xa6, 0xce, 0xb2, 0x76,
+	0xe4, 0x01, 0xd1, 0xdf, 0x5b, 0xd0, 0xa1, 0xd7, 0xe3, 0xff, 0xa4, 0x31, 0x4e, 0x6f, 0x64, 0x75,
+	0xf6, 0x46, 0x66, 0x1b, 0x66, 0xe7, 0xa7, 0x1a, 0xe6, 0x9f, 0x61, 0x30, 0xf3, 0xb0, 0xfc, 0xe9,
+	0x57, 0x1f, 0x3a, 0xf0, 0xca, 0x8e, 0x75, 0xe5, 0x7b, 0xa7, 0xa7, 0x70, 0x2a, 0xaf, 0x44, 0x2a,
+	0x4b, 0xac, 0x55, 0x64, 0x77, 0x3b, 0x9e, 0x32, 0x70, 0x97, 0x8b, 0x80, 0xda, 0x52, 0x47, 0x9d,
+	0x77, 0xe9, 0x84, 0xbd, 0xff, 0x0e, 0x00, 0x84, 0x0f, 0xda, 0xfa, 0x69, 0x11, 0x00, 0x00,
 }
@@ -56,8 +56,15 @@ func applyRobustMessage(msg *types.RobustMessage, i *ircserver.IRCServer) {
 		if err := i.UpdateLastClientMessageID(msg); err != nil {
 			log.Printf("Error updating the last message for session: %v\n", err)
 		} else {
-			ircmsg := irc.ParseMessage(string(msg.Data))
-			reply := i.ProcessMessage(msg.Id, msg.Session, ircmsg)
+			tags, data := types.SplitTags(string(msg.Data))
+			ircmsg := irc.ParseMessage(data)
+			credentials := msg.Credentials
+			if !msg.CredentialsVerified {
+				// The message was stored before credentials were verified
+				// by the server which accepts the message.
+				credentials = i.VerifyCredentials(data)
+			}
+			reply := i.ProcessTaggedMessage(msg.Id, msg.Session, tags, credentials, ircmsg)
 			i.SendMessages(reply, msg.Session, msg.Session.Id)
 		}
 
@@ -67,6 +74,8 @@ func applyRobustMessage(msg *types.RobustMessage, i *ircserver.IRCServer) {
 			log.Printf("Skipping unexpectedly invalid configuration (%v)\n", err)
 		} else {
 			i.Config = newCfg
+			reply := i.UpdateCaseMapping(msg.Id)
+			i.SendMessages(reply, msg.Session, msg.Id.Id)
 		}
 	}
 }
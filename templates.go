@@ -53,6 +53,10 @@ var statusTpl = template.Must(template.New("status").Parse(`<!DOCTYPE html>
 							<th>PostMessageCooloff</th>
 							<td>{{.NetConfig.PostMessageCooloff}}</td>
 						</tr>
+						<tr>
+							<th>NetworkDescription</th>
+							<td>{{.NetConfig.NetworkDescription}}</td>
+						</tr>
 						{{ range .NetConfig.IRC.Operators }}
 						<tr>
 							<th>IRC.Operators</th>
@@ -72,6 +72,12 @@ type RobustMessage struct {
 	// InterestingFor gets set once in SendMessages and stays constant.
 	InterestingFor map[int64]bool `json:"-"`
 
+	// History is true for placeholders which stand for the response to a
+	// CHATHISTORY request. The response depends on the outputstream of the
+	// server which delivers it, so it is only generated when delivering the
+	// placeholder (see ircserver.ExpandHistory).
+	History bool `json:"-"`
+
 	// List of all servers currently in the network. Only present when Type == RobustPing.
 	Servers []string `json:",omitempty"`
 
@@ -83,6 +89,17 @@ type RobustMessage struct {
 
 	// Revision is the config file revision. Only present when Type == RobustConfig
 	Revision int `json:",omitempty"`
+
+	// Credentials are the credentials (e.g. “oper=mero”) which the server that
+	// accepted the message verified before applying it, see
+	// ircserver.VerifyCredentials. Only present when Type == RobustIRCFromClient
+	Credentials []string `json:",omitempty"`
+
+	// CredentialsVerified is true if Credentials were set by the server that
+	// accepted the message. Messages which were stored before credentials
+	// were verified that way lack it and are verified when applied instead.
+	// Only present when Type == RobustIRCFromClient
+	CredentialsVerified bool `json:",omitempty"`
 }
 
 func (m *RobustMessage) Timestamp() string {
@@ -93,18 +110,33 @@ func (m *RobustMessage) PrivacyFilter() string {
 	if m.Type != RobustIRCToClient && m.Type != RobustIRCFromClient {
 		return m.Data
 	}
-	if msg := irc.ParseMessage(m.Data); msg != nil {
+	tags, data := SplitTags(m.Data)
+	if msg := irc.ParseMessage(data); msg != nil {
 		command := strings.ToUpper(msg.Command)
 		if command == irc.PRIVMSG ||
 			command == irc.NOTICE ||
+			command == "REDACT" ||
 			strings.HasSuffix(command, "serv") {
 			msg.Trailing = "<privacy filtered>"
-			return string(msg.Bytes())
+			return tags + string(msg.Bytes())
 		}
 	}
 	return m.Data
 }
 
+// SplitTags splits an IRC message into its IRCv3 message tags (including the
+// leading “@” and the trailing space, or the empty string if there are no
+// tags) and the remainder, which can be parsed by irc.ParseMessage.
+func SplitTags(data string) (tags string, message string) {
+	if !strings.HasPrefix(data, "@") {
+		return "", data
+	}
+	if idx := strings.IndexByte(data, ' '); idx > -1 {
+		return data[:idx+1], data[idx+1:]
+	}
+	return data, ""
+}
+
 func NewRobustMessageFromBytes(b []byte) RobustMessage {
 	var msg RobustMessage
 	if err := json.Unmarshal(b, &msg); err != nil {
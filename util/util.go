@@ -171,22 +171,47 @@ func PrivacyFilterIrcmsg(message *irc.Message) *irc.Message {
 	if message == nil {
 		return nil
 	}
-	if message.Command == irc.PRIVMSG || message.Command == irc.NOTICE {
+	if message.Command == irc.PRIVMSG || message.Command == irc.NOTICE || message.Command == "REDACT" {
 		message.Trailing = "<privacy filtered>"
 	}
 	if message.Command == irc.PASS {
 		message.Params = []string{"<privacy filtered>"}
 		message.Trailing = ""
 	}
+	// SASL payloads (e.g. PLAIN) contain base64-encoded passwords, both when
+	// sent by the client (“AUTHENTICATE <payload>”) and when relayed to the
+	// services (“SASL <uid> <sid> C <payload>”).
+	if strings.ToUpper(message.Command) == "AUTHENTICATE" {
+		privacyFilterSaslPayload(message, 0)
+	}
+	if message.Command == "SASL" && len(message.Params) > 2 && message.Params[2] == "C" {
+		privacyFilterSaslPayload(message, 3)
+	}
 	return message
 }
 
+// privacyFilterSaslPayload filters the SASL payload of |message|, which is
+// the parameter at |idx| or the trailing parameter. Aborts (“*”) and empty
+// payloads (“+”) are kept.
+func privacyFilterSaslPayload(message *irc.Message, idx int) {
+	if len(message.Params) > idx {
+		if payload := message.Params[idx]; payload != "*" && payload != "+" {
+			message.Params[idx] = "<privacy filtered>"
+		}
+		return
+	}
+	if message.Trailing != "*" && message.Trailing != "+" && message.Trailing != "" {
+		message.Trailing = "<privacy filtered>"
+	}
+}
+
 func PrivacyFilterMsg(message *types.RobustMessage) *types.RobustMessage {
+	tags, data := types.SplitTags(message.Data)
 	return &types.RobustMessage{
 		Id:      message.Id,
 		Session: message.Session,
 		Type:    message.Type,
-		Data:    PrivacyFilterIrcmsg(irc.ParseMessage(message.Data)).String(),
+		Data:    tags + PrivacyFilterIrcmsg(irc.ParseMessage(data)).String(),
 	}
 }
 
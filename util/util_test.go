@@ -0,0 +1,39 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestPrivacyFilterIrcmsg(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  string
+	}{
+		{"PRIVMSG #test :my password is hunter2", "PRIVMSG #test :<privacy filtered>"},
+		{"PASS nickserv=secret", "PASS <privacy filtered>"},
+		{"AUTHENTICATE PLAIN", "AUTHENTICATE <privacy filtered>"},
+		{"AUTHENTICATE AG1lcm8AaHVudGVyMg==", "AUTHENTICATE <privacy filtered>"},
+		{"AUTHENTICATE :AG1lcm8AaHVudGVyMg==", "AUTHENTICATE :<privacy filtered>"},
+		{"AUTHENTICATE *", "AUTHENTICATE *"},
+		{"AUTHENTICATE +", "AUTHENTICATE +"},
+		{
+			":robustirc.net SASL * 1420228218166687917 C AG1lcm8AaHVudGVyMg==",
+			":robustirc.net SASL * 1420228218166687917 C <privacy filtered>",
+		},
+		{
+			":robustirc.net SASL * 1420228218166687917 S PLAIN",
+			":robustirc.net SASL * 1420228218166687917 S PLAIN",
+		},
+		{
+			":services.robustirc.net SASL robustirc.net 1420228218166687917 C +",
+			":services.robustirc.net SASL robustirc.net 1420228218166687917 C +",
+		},
+		{"JOIN #test", "JOIN #test"},
+	} {
+		if got := PrivacyFilterIrcmsg(irc.ParseMessage(tc.input)).String(); got != tc.want {
+			t.Errorf("PrivacyFilterIrcmsg(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}